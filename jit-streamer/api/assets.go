@@ -0,0 +1,190 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"amka.ru/jit-streamer/services"
+)
+
+// ListAssets returns all virtual assets
+func (h *Handlers) ListAssets(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"assets": h.assets.List()})
+}
+
+// GetAsset returns videos of a virtual asset
+func (h *Handlers) GetAsset(c *gin.Context) {
+	a, err := h.assets.Get(c.Param("name"))
+	if err != nil {
+		assetError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+// PutAsset creates a virtual asset or replaces its videos: {"videos": [...]}
+func (h *Handlers) PutAsset(c *gin.Context) {
+	var req struct {
+		Videos []string `json:"videos"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	a, err := h.assets.Put(c.Param("name"), req.Videos)
+	if err != nil {
+		assetError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+// DeleteAsset removes a virtual asset
+func (h *Handlers) DeleteAsset(c *gin.Context) {
+	if err := h.assets.Delete(c.Param("name")); err != nil {
+		assetError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetAssetMasterPlaylist returns HLS master playlist of a virtual asset
+func (h *Handlers) GetAssetMasterPlaylist(c *gin.Context) {
+	name := c.Param("name")
+
+	tl, err := h.assets.Timeline(name)
+	if err != nil {
+		assetError(c, err)
+		return
+	}
+
+	params := tl.Params()
+	params.Query = h.tokenQuery(c, services.ScopeAsset, name)
+	playlist := h.manifestService.GenerateHLSMasterPlaylist(name, tl.Duration.Seconds(), params)
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.Header("Cache-Control", "no-cache")
+	serveManifest(c, playlist)
+}
+
+// GetAssetMediaPlaylist returns HLS media playlist of a virtual asset
+func (h *Handlers) GetAssetMediaPlaylist(c *gin.Context) {
+	h.assetPlaylist(c, false)
+}
+
+// GetAssetAudioPlaylist returns HLS playlist of virtual asset audio
+func (h *Handlers) GetAssetAudioPlaylist(c *gin.Context) {
+	h.assetPlaylist(c, true)
+}
+
+func (h *Handlers) assetPlaylist(c *gin.Context, audio bool) {
+	tl, err := h.assets.Timeline(c.Param("name"))
+	if err != nil {
+		assetError(c, err)
+		return
+	}
+	if audio && !tl.Audio {
+		c.JSON(http.StatusNotFound, gin.H{"error": "asset has no audio"})
+		return
+	}
+
+	playlist := h.manifestService.GenerateAssetPlaylist(tl.Parts, audio, h.tokenQuery(c, services.ScopeAsset, c.Param("name")))
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.Header("Cache-Control", "no-cache")
+	serveManifest(c, playlist)
+}
+
+// GetAssetDASHManifest returns static multi-period MPD of a virtual asset
+func (h *Handlers) GetAssetDASHManifest(c *gin.Context) {
+	tl, err := h.assets.Timeline(c.Param("name"))
+	if err != nil {
+		assetError(c, err)
+		return
+	}
+
+	mpd, err := h.manifestService.GenerateAssetMPD(tl, h.tokenQuery(c, services.ScopeAsset, c.Param("name")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/dash+xml")
+	c.Header("Cache-Control", "no-cache")
+	serveManifest(c, mpd)
+}
+
+// GetAssetFile serves init and media segments of a video of a virtual
+// asset: /:part/init.mp4, /:part/audio_init.mp4, /:part/segment_N.m4s,
+// /:part/audio_segment_N.m4s
+func (h *Handlers) GetAssetFile(c *gin.Context) {
+	file := c.Param("file")
+
+	tl, err := h.assets.Timeline(c.Param("name"))
+	if err != nil {
+		assetError(c, err)
+		return
+	}
+	n, err := strconv.Atoi(c.Param("part"))
+	part := tl.Part(n)
+	if err != nil || part == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "part not found"})
+		return
+	}
+	vf := part.VideoFile
+
+	audioNum, isAudio := parseSegmentNumber(file, "audio_segment_", ".m4s")
+	segmentNum, isSegment := parseSegmentNumber(file, "segment_", ".m4s")
+	if (isAudio && (audioNum < 0 || audioNum >= part.SegmentCount)) || (isSegment && (segmentNum < 0 || segmentNum >= part.SegmentCount)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "segment not found"})
+		return
+	}
+
+	var generate func() ([]byte, error)
+	var key services.SegmentKey
+	contentType := "video/mp4"
+	switch {
+	case file == "init.mp4":
+		key = segmentKey(vf, "video", "", -1, "fmp4")
+		generate = func() ([]byte, error) {
+			return h.segmenter.GenerateInitSegment(vf)
+		}
+	case file == "audio_init.mp4" && tl.Audio:
+		key = segmentKey(vf, "audio", "", -1, "fmp4")
+		generate = func() ([]byte, error) {
+			return h.segmenter.GenerateAudioInitSegment(vf)
+		}
+		contentType = "audio/mp4"
+	case isAudio && tl.Audio:
+		key = segmentKey(vf, "audio", "", audioNum, "fmp4")
+		generate = func() ([]byte, error) {
+			return h.segmenter.GenerateAudioMediaSegment(vf, audioNum)
+		}
+		contentType = "audio/mp4"
+	case isSegment:
+		key = segmentKey(vf, "video", "", segmentNum, "fmp4")
+		generate = func() ([]byte, error) {
+			return h.segmenter.GenerateMediaSegment(vf, segmentNum)
+		}
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+	h.serveSegment(c, vf, key, contentType, generate)
+}
+
+// assetError responds to a failed virtual asset operation
+func assetError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrAssetNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidAsset):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		openVideoError(c, err)
+	}
+}
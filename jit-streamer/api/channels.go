@@ -0,0 +1,140 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"amka.ru/jit-streamer/services"
+)
+
+// ListChannels returns all linear channels
+func (h *Handlers) ListChannels(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"channels": h.channels.List()})
+}
+
+// GetChannel returns schedule of a channel
+func (h *Handlers) GetChannel(c *gin.Context) {
+	ch, err := h.channels.Get(c.Param("name"))
+	if err != nil {
+		channelError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, ch)
+}
+
+// PutChannel creates a channel or replaces its schedule: {"videos": [...]}.
+// A new schedule of a running channel starts at the next segment boundary
+func (h *Handlers) PutChannel(c *gin.Context) {
+	var req struct {
+		Videos []string `json:"videos"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ch, err := h.channels.Put(c.Param("name"), req.Videos)
+	if err != nil {
+		channelError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, ch)
+}
+
+// DeleteChannel stops a channel
+func (h *Handlers) DeleteChannel(c *gin.Context) {
+	if err := h.channels.Delete(c.Param("name")); err != nil {
+		channelError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetChannelMasterPlaylist returns HLS master playlist of a channel
+func (h *Handlers) GetChannelMasterPlaylist(c *gin.Context) {
+	name := c.Param("name")
+
+	tl, err := h.channels.Timeline(name)
+	if err != nil {
+		channelError(c, err)
+		return
+	}
+
+	params := tl.Params()
+	params.Query = h.tokenQuery(c, services.ScopeChannel, name)
+	playlist := h.manifestService.GenerateHLSMasterPlaylist(name, 0, params)
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.Header("Cache-Control", "no-cache")
+	serveManifest(c, playlist)
+}
+
+// GetChannelMediaPlaylist returns sliding window HLS media playlist of a channel
+func (h *Handlers) GetChannelMediaPlaylist(c *gin.Context) {
+	h.channelPlaylist(c, false)
+}
+
+// GetChannelAudioPlaylist returns sliding window HLS playlist of channel audio
+func (h *Handlers) GetChannelAudioPlaylist(c *gin.Context) {
+	h.channelPlaylist(c, true)
+}
+
+func (h *Handlers) channelPlaylist(c *gin.Context, audio bool) {
+	tl, err := h.channels.Timeline(c.Param("name"))
+	if err != nil {
+		channelError(c, err)
+		return
+	}
+	if audio && !tl.Audio {
+		c.JSON(http.StatusNotFound, gin.H{"error": "channel has no audio"})
+		return
+	}
+
+	playlist := h.manifestService.GenerateChannelPlaylist(tl.Window(time.Now()), tl.TargetDuration(), audio, h.videoTokenQuery(c))
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.Header("Cache-Control", "no-cache")
+	serveManifest(c, playlist)
+}
+
+// GetChannelDASHManifest returns dynamic multi-period MPD of a channel
+func (h *Handlers) GetChannelDASHManifest(c *gin.Context) {
+	tl, err := h.channels.Timeline(c.Param("name"))
+	if err != nil {
+		channelError(c, err)
+		return
+	}
+
+	mpd, err := h.manifestService.GenerateChannelMPD(tl.Window(time.Now()), tl.Channel.Created, tl.Audio, h.videoTokenQuery(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/dash+xml")
+	c.Header("Cache-Control", "no-cache")
+	serveManifest(c, mpd)
+}
+
+// videoTokenQuery returns the query of URIs of a video in a channel
+// manifest, which carries a token of the video derived from the channel one
+func (h *Handlers) videoTokenQuery(c *gin.Context) func(video string) string {
+	return func(video string) string {
+		return h.tokenQuery(c, services.ScopeVideo, video)
+	}
+}
+
+// channelError responds to a failed channel operation
+func channelError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrChannelNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidSchedule):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		openVideoError(c, err)
+	}
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"amka.ru/jit-streamer/services"
+)
+
+// serveSegment writes the segment of vf under key, from the cache or made
+// by generate. Revalidation with If-None-Match or If-Modified-Since gets 304
+// before anything is generated, range requests get partial content
+func (h *Handlers) serveSegment(c *gin.Context, vf *services.VideoFile, key services.SegmentKey, contentType string, generate func() ([]byte, error)) {
+	etag, err := h.segmentETag(c, vf, key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if notModified(c.Request, etag, vf.ModTime) {
+		c.Header("Cache-Control", "max-age=31536000")
+		c.Header("ETag", etag)
+		serveContent(c, vf.ModTime, nil)
+		return
+	}
+	data, err := h.cache.GetOrGenerate(c.Request.Context(), key, generate)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Cache-Control", "max-age=31536000")
+	c.Header("ETag", etag)
+	serveContent(c, vf.ModTime, data)
+}
+
+// segmentETag returns the ETag of the segment of vf under key. Encrypted
+// segments are tagged with their key too, so a rotated key is not revalidated
+func (h *Handlers) segmentETag(c *gin.Context, vf *services.VideoFile, key services.SegmentKey) (string, error) {
+	var kid string
+	if key.Encryption != "" {
+		ck, err := h.keys.Key(c.Param("name"))
+		if err != nil {
+			return "", err
+		}
+		kid = ck.KID
+	}
+	return services.SegmentETag(vf, key, kid), nil
+}
+
+// notModified reports whether the request revalidates a copy tagged etag or
+// one modified at modTime. It follows http.ServeContent, which then answers
+// with 304: If-None-Match takes precedence over If-Modified-Since
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modTime.IsZero() && !modTime.Truncate(time.Second).After(since)
+}
+
+// serveManifest writes a playlist or MPD like serveSegment. Its ETag is
+// taken from the content, which changes without the source for live streams
+// and channels
+func serveManifest(c *gin.Context, manifest string) {
+	sum := sha1.Sum([]byte(manifest))
+	c.Header("ETag", fmt.Sprintf("\"%x\"", sum))
+	serveContent(c, time.Time{}, []byte(manifest))
+}
+
+func serveContent(c *gin.Context, modTime time.Time, data []byte) {
+	http.ServeContent(c.Writer, c.Request, "", modTime, bytes.NewReader(data))
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"amka.ru/jit-streamer/services"
+)
+
+// encryptionParams returns protection of an encrypted view for manifests,
+// nil when it is clear
+func (h *Handlers) encryptionParams(c *gin.Context, vf *services.VideoFile) *services.EncryptionParams {
+	if vf.Encryption == "" {
+		return nil
+	}
+	key, err := h.keys.Key(c.Param("name"))
+	if err != nil {
+		log.Printf("Failed to get content key of %s: %v", c.Param("name"), err)
+		return nil
+	}
+	pssh, err := services.ClearKeyPSSH(key)
+	if err != nil {
+		log.Printf("Failed to create pssh of %s: %v", c.Param("name"), err)
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := pssh.Encode(&buf); err != nil {
+		log.Printf("Failed to encode pssh of %s: %v", c.Param("name"), err)
+		return nil
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return &services.EncryptionParams{
+		Scheme:     vf.Encryption,
+		KID:        key.KID,
+		PSSH:       base64.StdEncoding.EncodeToString(buf.Bytes()),
+		LicenseURL: scheme + "://" + c.Request.Host + "/clearkey/license" + h.tokenQuery(c, services.ScopeVideo, c.Param("name")),
+	}
+}
+
+// protectInit wraps generation of an init segment of vf so protection is
+// added when vf is served encrypted
+func (h *Handlers) protectInit(c *gin.Context, vf *services.VideoFile, generate func() ([]byte, error)) func() ([]byte, error) {
+	if vf.Encryption == "" {
+		return generate
+	}
+	name := c.Param("name")
+	return func() ([]byte, error) {
+		key, err := h.keys.Key(name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := generate()
+		if err != nil {
+			return nil, err
+		}
+		return services.EncryptInit(data, vf.Encryption, key)
+	}
+}
+
+// protect wraps generation of a media segment of vf so its samples are
+// encrypted when vf is served encrypted. The clear init segment of the
+// track, which tells how to split samples, is taken from the cache under
+// initKey with encryption left out
+func (h *Handlers) protect(c *gin.Context, vf *services.VideoFile, initKey services.SegmentKey, init, generate func() ([]byte, error)) func() ([]byte, error) {
+	if vf.Encryption == "" {
+		return generate
+	}
+	name := c.Param("name")
+	initKey.Encryption = ""
+	return func() ([]byte, error) {
+		key, err := h.keys.Key(name)
+		if err != nil {
+			return nil, err
+		}
+		// Generation runs detached from the request
+		clearInit, err := h.cache.GetOrGenerate(context.Background(), initKey, init)
+		if err != nil {
+			return nil, err
+		}
+		data, err := generate()
+		if err != nil {
+			return nil, err
+		}
+		return services.EncryptSegment(clearInit, data, vf.Encryption, key, initKey.String())
+	}
+}
+
+// protectVideo wraps generation of a media segment of the video track
+func (h *Handlers) protectVideo(c *gin.Context, vf *services.VideoFile, generate func() ([]byte, error)) func() ([]byte, error) {
+	return h.protect(c, vf, segmentKey(vf, "video", "", -1, "fmp4"), func() ([]byte, error) {
+		return h.segmenter.GenerateInitSegment(vf)
+	}, generate)
+}
+
+// protectAudio wraps generation of a media segment of the selected audio
+// track
+func (h *Handlers) protectAudio(c *gin.Context, vf *services.VideoFile, generate func() ([]byte, error)) func() ([]byte, error) {
+	return h.protect(c, vf, segmentKey(vf, "audio", "", -1, "fmp4"), func() ([]byte, error) {
+		return h.segmenter.GenerateAudioInitSegment(vf)
+	}, generate)
+}
+
+// rejectEncrypted responds to requests for MPEG-TS or I-frame files of an
+// encrypted view, which are only served clear. It returns true when vf is
+// encrypted
+func rejectEncrypted(c *gin.Context, vf *services.VideoFile) bool {
+	if vf.Encryption == "" {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "not available with encryption"})
+	return true
+}
+
+// clearKeyRequest is a W3C ClearKey license request
+type clearKeyRequest struct {
+	KIDs []string `json:"kids"`
+	Type string   `json:"type"`
+}
+
+// PostClearKeyLicense answers ClearKey license requests with keys from the
+// key store. With playback tokens enabled only keys of videos the token of
+// the request grants are handed out
+func (h *Handlers) PostClearKeyLicense(c *gin.Context) {
+	allowed := func(string) bool { return true }
+	if h.tokens.Enabled() {
+		claims, err := h.tokens.Verify(c.Query("token"), time.Now())
+		if err != nil {
+			tokenError(c, err)
+			return
+		}
+		ip := c.ClientIP()
+		allowed = func(video string) bool { return claims.Allows(services.Scope(services.ScopeVideo, video), ip) == nil }
+	}
+
+	var req clearKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.KIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid license request"})
+		return
+	}
+	license, err := h.keys.License(req.KIDs, req.Type, allowed)
+	if errors.Is(err, services.ErrKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, license)
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"errors"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -14,13 +16,31 @@ type Handlers struct {
 	videoService    *services.VideoService
 	segmenter       *services.Segmenter
 	manifestService *services.ManifestService
+	transcoder      *services.Transcoder
+	cache           *services.SegmentCache
+	remuxer         *services.Remuxer
+	renditions      *services.RenditionCache
+	channels        *services.ChannelService
+	assets          *services.AssetService
+	thumbnailer     *services.Thumbnailer
+	keys            *services.KeyService
+	tokens          *services.TokenService
 }
 
-func NewHandlers(vs *services.VideoService, seg *services.Segmenter, ms *services.ManifestService) *Handlers {
+func NewHandlers(vs *services.VideoService, seg *services.Segmenter, ms *services.ManifestService, tc *services.Transcoder, cache *services.SegmentCache, rm *services.Remuxer, rc *services.RenditionCache, chs *services.ChannelService, as *services.AssetService, th *services.Thumbnailer, ks *services.KeyService, ts *services.TokenService) *Handlers {
 	return &Handlers{
 		videoService:    vs,
 		segmenter:       seg,
 		manifestService: ms,
+		transcoder:      tc,
+		cache:           cache,
+		remuxer:         rm,
+		renditions:      rc,
+		channels:        chs,
+		assets:          as,
+		thumbnailer:     th,
+		keys:            ks,
+		tokens:          ts,
 	}
 }
 
@@ -49,9 +69,16 @@ func (h *Handlers) GetVideoInfo(c *gin.Context) {
 		return
 	}
 	info.Name = name
+	info.Subtitles = h.videoService.SubtitleLanguages(name)
+	info.Remux = h.remuxer.Status(videoPath)
 	c.JSON(http.StatusOK, info)
 }
 
+// GetCacheStats returns hit/miss counters of the segment cache
+func (h *Handlers) GetCacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, h.cache.Stats())
+}
+
 // GetHLSMasterPlaylist returns HLS master playlist (generated on the fly)
 func (h *Handlers) GetHLSMasterPlaylist(c *gin.Context) {
 	name := c.Param("name")
@@ -62,24 +89,19 @@ func (h *Handlers) GetHLSMasterPlaylist(c *gin.Context) {
 		return
 	}
 
-	vf, err := h.segmenter.OpenVideo(videoPath)
+	vf, err := h.openMaster(c, videoPath)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		openVideoError(c, err)
 		return
 	}
 
 	durationSec := h.segmenter.GetDurationSec(vf)
-	params := services.VideoParams{
-		Codec:     vf.VideoCodec,
-		Width:     vf.Width,
-		Height:    vf.Height,
-		Timescale: vf.Timescale,
-	}
+	params := h.videoParams(c, name, vf)
 	playlist := h.manifestService.GenerateHLSMasterPlaylist(name, durationSec, params)
 
 	c.Header("Content-Type", "application/vnd.apple.mpegurl")
 	c.Header("Cache-Control", "no-cache")
-	c.String(http.StatusOK, playlist)
+	serveManifest(c, playlist)
 }
 
 // GetHLSMediaPlaylist returns HLS media playlist (generated on the fly)
@@ -92,19 +114,147 @@ func (h *Handlers) GetHLSMediaPlaylist(c *gin.Context) {
 		return
 	}
 
-	vf, err := h.segmenter.OpenVideo(videoPath)
+	vf, err := h.openSource(c, videoPath)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		openVideoError(c, err)
 		return
 	}
 
-	durationSec := h.segmenter.GetDurationSec(vf)
-	segmentCount := h.segmenter.GetSegmentCount(vf)
-	playlist := h.manifestService.GenerateHLSMediaPlaylist(name, durationSec, segmentCount)
+	if vf = h.awaitPlaylist(c, videoPath, vf, false); vf == nil {
+		return
+	}
+
+	live := liveParams(vf)
+	if live != nil {
+		live.LowLatency = h.segmenter.LowLatency(vf, false)
+	}
+	playlist := h.manifestService.GenerateHLSMediaPlaylist(name, vf.Segments, vf.Timescale, live, h.encryptionParams(c, vf), services.ViewQuery(vf))
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.Header("Cache-Control", "no-cache")
+	serveManifest(c, playlist)
+}
+
+// GetHLSIFramePlaylist returns HLS I-frame playlist for trick play
+func (h *Handlers) GetHLSIFramePlaylist(c *gin.Context) {
+	name := c.Param("name")
+
+	videoPath, err := h.videoService.GetVideoPath(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "video not found"})
+		return
+	}
+
+	vf, err := h.openSource(c, videoPath)
+	if err != nil {
+		openVideoError(c, err)
+		return
+	}
+	if rejectEncrypted(c, vf) {
+		return
+	}
+
+	frames := make([][]services.IFrame, len(vf.Segments))
+	for n := range vf.Segments {
+		frames[n] = h.segmenter.IFrames(vf, n)
+	}
+	playlist := h.manifestService.GenerateHLSIFramePlaylist(name, frames, vf.Timescale, liveParams(vf), services.ViewQuery(vf))
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.Header("Cache-Control", "no-cache")
+	serveManifest(c, playlist)
+}
+
+// GetHLSTSMasterPlaylist returns master playlist of the MPEG-TS variant
+func (h *Handlers) GetHLSTSMasterPlaylist(c *gin.Context) {
+	name := c.Param("name")
+
+	videoPath, err := h.videoService.GetVideoPath(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "video not found"})
+		return
+	}
+
+	vf, err := h.openSource(c, videoPath)
+	if err != nil {
+		openVideoError(c, err)
+		return
+	}
+	if rejectEncrypted(c, vf) {
+		return
+	}
+
+	params := h.videoParams(c, name, vf)
+	if params.Audio != nil {
+		params.Query = params.Audio.Query
+	}
+	playlist := h.manifestService.GenerateHLSTSMasterPlaylist(name, params)
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.Header("Cache-Control", "no-cache")
+	serveManifest(c, playlist)
+}
+
+// GetHLSTSPlaylist returns media playlist with MPEG-TS segments
+func (h *Handlers) GetHLSTSPlaylist(c *gin.Context) {
+	name := c.Param("name")
+
+	videoPath, err := h.videoService.GetVideoPath(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "video not found"})
+		return
+	}
+
+	vf, err := h.openSource(c, videoPath)
+	if err != nil {
+		openVideoError(c, err)
+		return
+	}
+	if rejectEncrypted(c, vf) {
+		return
+	}
+
+	// Audio is muxed into the segments, so they keep the track selection
+	playlist := h.manifestService.GenerateHLSTSPlaylist(name, vf.Segments, vf.Timescale, liveParams(vf), services.AudioQuery(vf, vf.AudioSelected))
 
 	c.Header("Content-Type", "application/vnd.apple.mpegurl")
 	c.Header("Cache-Control", "no-cache")
-	c.String(http.StatusOK, playlist)
+	serveManifest(c, playlist)
+}
+
+// GetHLSAudioPlaylist returns HLS media playlist of the audio rendition
+func (h *Handlers) GetHLSAudioPlaylist(c *gin.Context) {
+	name := c.Param("name")
+
+	videoPath, err := h.videoService.GetVideoPath(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "video not found"})
+		return
+	}
+
+	vf, err := h.openSource(c, videoPath)
+	if err != nil {
+		openVideoError(c, err)
+		return
+	}
+
+	if vf.AudioTrack == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "video has no audio track"})
+		return
+	}
+	if vf = h.awaitPlaylist(c, videoPath, vf, true); vf == nil {
+		return
+	}
+
+	params := h.videoParams(c, name, vf)
+	if params.Live != nil {
+		params.Live.LowLatency = h.segmenter.LowLatency(vf, true)
+	}
+	playlist := h.manifestService.GenerateHLSAudioPlaylist(name, *params.Audio, params.Live, params.Encryption, params.Audio.Query)
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.Header("Cache-Control", "no-cache")
+	serveManifest(c, playlist)
 }
 
 // GetHLSInitSegment returns HLS init segment (generated on the fly)
@@ -117,21 +267,45 @@ func (h *Handlers) GetHLSInitSegment(c *gin.Context) {
 		return
 	}
 
-	vf, err := h.segmenter.OpenVideo(videoPath)
+	vf, err := h.openSource(c, videoPath)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		openVideoError(c, err)
 		return
 	}
 
-	data, err := h.segmenter.GenerateInitSegment(vf)
+	key := segmentKey(vf, "video", "", -1, "fmp4")
+	generate := h.protectInit(c, vf, func() ([]byte, error) {
+		return h.segmenter.GenerateInitSegment(vf)
+	})
+	h.serveSegment(c, vf, key, "video/mp4", generate)
+}
+
+// GetHLSAudioInitSegment returns init segment of the audio rendition
+func (h *Handlers) GetHLSAudioInitSegment(c *gin.Context) {
+	name := c.Param("name")
+
+	videoPath, err := h.videoService.GetVideoPath(name)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusNotFound, gin.H{"error": "video not found"})
+		return
+	}
+
+	vf, err := h.openSource(c, videoPath)
+	if err != nil {
+		openVideoError(c, err)
+		return
+	}
+
+	if vf.AudioTrack == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "video has no audio track"})
 		return
 	}
 
-	c.Header("Content-Type", "video/mp4")
-	c.Header("Cache-Control", "max-age=31536000")
-	c.Data(http.StatusOK, "video/mp4", data)
+	key := segmentKey(vf, "audio", "", -1, "fmp4")
+	generate := h.protectInit(c, vf, func() ([]byte, error) {
+		return h.segmenter.GenerateAudioInitSegment(vf)
+	})
+	h.serveSegment(c, vf, key, "audio/mp4", generate)
 }
 
 // GetHLSSegment returns HLS media segment (generated on the fly)
@@ -139,14 +313,84 @@ func (h *Handlers) GetHLSSegment(c *gin.Context) {
 	name := c.Param("name")
 	segment := c.Param("segment")
 
-	// Parse segment number from segment_N.m4s
-	segmentNum := 0
-	if strings.HasPrefix(segment, "segment_") && strings.HasSuffix(segment, ".m4s") {
-		numStr := strings.TrimSuffix(strings.TrimPrefix(segment, "segment_"), ".m4s")
-		if n, err := strconv.Atoi(numStr); err == nil {
-			segmentNum = n
+	// Parse segment number from segment_N.m4s, audio_segment_N.m4s,
+	// iframes_N.m4s or segment_N.ts
+	audioNum, isAudio := parseSegmentNumber(segment, "audio_segment_", ".m4s")
+	iframeNum, isIFrame := parseSegmentNumber(segment, "iframes_", ".m4s")
+	tsNum, isTS := parseSegmentNumber(segment, "segment_", ".ts")
+	segmentNum, _ := parseSegmentNumber(segment, "segment_", ".m4s")
+
+	videoPath, err := h.videoService.GetVideoPath(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "video not found"})
+		return
+	}
+
+	vf, err := h.openSource(c, videoPath)
+	if err != nil {
+		openVideoError(c, err)
+		return
+	}
+
+	if n, ok := parseSegmentNumber(segment, "thumbnails_", ".jpg"); ok {
+		h.serveThumbnailSheet(c, vf, n)
+		return
+	}
+	if h.serveSubtitleFile(c, vf, segment) {
+		return
+	}
+
+	// LL-HLS parts: part_N.P.m4s, audio_part_N.P.m4s
+	if n, p, ok := parsePartNumber(segment, "part_", ".m4s"); ok {
+		h.serveLivePart(c, videoPath, vf, n, p, false)
+		return
+	}
+	if n, p, ok := parsePartNumber(segment, "audio_part_", ".m4s"); ok {
+		h.serveLivePart(c, videoPath, vf, n, p, true)
+		return
+	}
+
+	var generate func() ([]byte, error)
+	var key services.SegmentKey
+	contentType := "video/mp4"
+	switch {
+	case isAudio:
+		key = segmentKey(vf, "audio", "", audioNum, "fmp4")
+		generate = h.protectAudio(c, vf, func() ([]byte, error) {
+			return h.segmenter.GenerateAudioMediaSegment(vf, audioNum)
+		})
+	case isIFrame && rejectEncrypted(c, vf):
+		return
+	case isIFrame:
+		key = segmentKey(vf, "iframes", "", iframeNum, "fmp4")
+		generate = func() ([]byte, error) {
+			return h.segmenter.GenerateIFrameSegment(vf, iframeNum)
+		}
+	case isTS && rejectEncrypted(c, vf):
+		return
+	case isTS:
+		key = segmentKey(vf, "video", "", tsNum, "ts")
+		generate = func() ([]byte, error) {
+			return h.segmenter.GenerateTSSegment(vf, tsNum)
 		}
+		contentType = "video/mp2t"
+	default:
+		key = segmentKey(vf, "video", "", segmentNum, "fmp4")
+		generate = h.protectVideo(c, vf, func() ([]byte, error) {
+			return h.segmenter.GenerateMediaSegment(vf, segmentNum)
+		})
 	}
+	h.serveSegment(c, vf, key, contentType, generate)
+}
+
+// GetQualityFile serves playlist, init and media segments of a ladder rung:
+// /:quality/media.m3u8, /:quality/init.mp4, /:quality/segment_N.m4s.
+// Pre-encoded renditions are remuxed, other rungs are transcoded
+func (h *Handlers) GetQualityFile(c *gin.Context) {
+	name := c.Param("name")
+	// gin allows one wildcard name per path level, so :segment holds quality
+	qualityName := c.Param("segment")
+	file := c.Param("file")
 
 	videoPath, err := h.videoService.GetVideoPath(name)
 	if err != nil {
@@ -154,21 +398,78 @@ func (h *Handlers) GetHLSSegment(c *gin.Context) {
 		return
 	}
 
-	vf, err := h.segmenter.OpenVideo(videoPath)
+	vf, err := h.openSource(c, videoPath)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		openVideoError(c, err)
 		return
 	}
 
-	data, err := h.segmenter.GenerateMediaSegment(vf, segmentNum)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	var rendition *services.VideoFile
+	for _, r := range h.renditions.Open(name, vf) {
+		if r.Name == qualityName {
+			rendition = r.Video
+			break
+		}
+	}
+
+	quality, ok := h.transcoder.FindQuality(vf, qualityName)
+	if rendition == nil && !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "quality not found"})
 		return
 	}
 
-	c.Header("Content-Type", "video/mp4")
-	c.Header("Cache-Control", "max-age=31536000")
-	c.Data(http.StatusOK, "video/mp4", data)
+	if file == "media.m3u8" {
+		var playlist string
+		if rendition != nil {
+			playlist = h.manifestService.GenerateHLSMediaPlaylist(name, rendition.Segments, rendition.Timescale, liveParams(rendition), h.encryptionParams(c, vf), services.ViewQuery(vf))
+		} else {
+			playlist = h.manifestService.GenerateHLSMediaPlaylist(name, vf.Segments, vf.Timescale, liveParams(vf), h.encryptionParams(c, vf), services.ViewQuery(vf))
+		}
+
+		c.Header("Content-Type", "application/vnd.apple.mpegurl")
+		c.Header("Cache-Control", "no-cache")
+		serveManifest(c, playlist)
+		return
+	}
+
+	var generate func() ([]byte, error)
+	var key services.SegmentKey
+	segmentNum, isSegment := parseSegmentNumber(file, "segment_", ".m4s")
+	switch {
+	case file == "init.mp4" && rendition != nil:
+		key = segmentKey(rendition, "video", qualityName, -1, "fmp4")
+		generate = h.protectInit(c, rendition, func() ([]byte, error) {
+			return h.segmenter.GenerateInitSegment(rendition)
+		})
+	case file == "init.mp4":
+		key = segmentKey(vf, "video", qualityName, -1, "fmp4")
+		generate = h.protectInit(c, vf, func() ([]byte, error) {
+			return h.transcoder.GenerateInitSegment(vf, quality)
+		})
+	case isSegment && rendition != nil:
+		key = segmentKey(rendition, "video", qualityName, segmentNum, "fmp4")
+		generate = h.protect(c, rendition, segmentKey(rendition, "video", qualityName, -1, "fmp4"), func() ([]byte, error) {
+			return h.segmenter.GenerateInitSegment(rendition)
+		}, func() ([]byte, error) {
+			return h.segmenter.GenerateMediaSegment(rendition, segmentNum)
+		})
+	case isSegment:
+		key = segmentKey(vf, "video", qualityName, segmentNum, "fmp4")
+		generate = h.protect(c, vf, segmentKey(vf, "video", qualityName, -1, "fmp4"), func() ([]byte, error) {
+			return h.transcoder.GenerateInitSegment(vf, quality)
+		}, func() ([]byte, error) {
+			return h.transcoder.GenerateMediaSegment(vf, quality, segmentNum)
+		})
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	src := vf
+	if rendition != nil {
+		src = rendition
+	}
+	h.serveSegment(c, src, key, "video/mp4", generate)
 }
 
 // GetDASHManifest returns DASH MPD manifest (generated on the fly)
@@ -181,21 +482,15 @@ func (h *Handlers) GetDASHManifest(c *gin.Context) {
 		return
 	}
 
-	vf, err := h.segmenter.OpenVideo(videoPath)
+	vf, err := h.openMaster(c, videoPath)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		openVideoError(c, err)
 		return
 	}
 
 	durationSec := h.segmenter.GetDurationSec(vf)
-	segmentCount := h.segmenter.GetSegmentCount(vf)
-	params := services.VideoParams{
-		Codec:     vf.VideoCodec,
-		Width:     vf.Width,
-		Height:    vf.Height,
-		Timescale: vf.Timescale,
-	}
-	mpd, err := h.manifestService.GenerateDASHMPD(name, durationSec, segmentCount, params)
+	params := h.videoParams(c, name, vf)
+	mpd, err := h.manifestService.GenerateDASHMPD(name, durationSec, vf.Segments, params)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -203,7 +498,7 @@ func (h *Handlers) GetDASHManifest(c *gin.Context) {
 
 	c.Header("Content-Type", "application/dash+xml")
 	c.Header("Cache-Control", "no-cache")
-	c.String(http.StatusOK, mpd)
+	serveManifest(c, mpd)
 }
 
 // GetDASHInitSegment returns DASH init segment (generated on the fly)
@@ -221,35 +516,301 @@ func (h *Handlers) GetDASHSegment(c *gin.Context) {
 		h.GetDASHInitSegment(c)
 		return
 	}
-
-	// Parse segment number from segment_N.m4s
-	segmentNum := 0
-	if strings.HasPrefix(segment, "segment_") && strings.HasSuffix(segment, ".m4s") {
-		numStr := strings.TrimSuffix(strings.TrimPrefix(segment, "segment_"), ".m4s")
-		if n, err := strconv.Atoi(numStr); err == nil {
-			segmentNum = n
-		}
+	if segment == "audio_init.mp4" {
+		h.GetHLSAudioInitSegment(c)
+		return
 	}
 
+	// Parse segment number from segment_N.m4s, audio_segment_N.m4s or
+	// iframes_N.m4s
+	audioNum, isAudio := parseSegmentNumber(segment, "audio_segment_", ".m4s")
+	iframeNum, isIFrame := parseSegmentNumber(segment, "iframes_", ".m4s")
+	segmentNum, _ := parseSegmentNumber(segment, "segment_", ".m4s")
+
 	videoPath, err := h.videoService.GetVideoPath(name)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "video not found"})
 		return
 	}
 
-	vf, err := h.segmenter.OpenVideo(videoPath)
+	vf, err := h.openSource(c, videoPath)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		openVideoError(c, err)
+		return
+	}
+
+	if n, ok := parseSegmentNumber(segment, "thumbnails_", ".jpg"); ok {
+		h.serveThumbnailSheet(c, vf, n)
+		return
+	}
+	if h.serveSubtitleFile(c, vf, segment) {
+		return
+	}
+
+	var generate func() ([]byte, error)
+	var key services.SegmentKey
+	switch {
+	case isAudio:
+		key = segmentKey(vf, "audio", "", audioNum, "fmp4")
+		generate = h.protectAudio(c, vf, func() ([]byte, error) {
+			return h.segmenter.GenerateAudioMediaSegment(vf, audioNum)
+		})
+	case isIFrame && rejectEncrypted(c, vf):
 		return
+	case isIFrame:
+		key = segmentKey(vf, "iframes", "", iframeNum, "fmp4")
+		generate = func() ([]byte, error) {
+			return h.segmenter.GenerateIFrameSegment(vf, iframeNum)
+		}
+	default:
+		key = segmentKey(vf, "video", "", segmentNum, "fmp4")
+		generate = h.protectVideo(c, vf, func() ([]byte, error) {
+			return h.segmenter.GenerateMediaSegment(vf, segmentNum)
+		})
+	}
+	h.serveSegment(c, vf, key, "video/mp4", generate)
+}
+
+// openVideo opens the source for segmenting. MKV, AVI and MOV sources are
+// opened from their remuxed MP4, services.ErrRemuxPending is returned until
+// it is written
+func (h *Handlers) openVideo(path string) (*services.VideoFile, error) {
+	src, err := h.remuxer.Source(path)
+	if err != nil {
+		return nil, err
 	}
+	return h.segmenter.OpenVideo(src)
+}
+
+// openSource opens the source of a request. start and end query parameters
+// limit it to a sub-clip, audio selects the audio track by number or
+// language and encryption the scheme segments are encrypted with. The
+// playback token of the request is carried onto manifest URIs
+func (h *Handlers) openSource(c *gin.Context, path string) (*services.VideoFile, error) {
+	return h.openView(c, path, "")
+}
+
+// openMaster opens the source of an fMP4 master playlist or MPD like
+// openSource, falling back to the default encryption scheme. URIs of the
+// manifest carry it, while segments referenced without it, e.g. by channel
+// and asset manifests, stay clear
+func (h *Handlers) openMaster(c *gin.Context, path string) (*services.VideoFile, error) {
+	return h.openView(c, path, h.keys.DefaultScheme())
+}
 
-	data, err := h.segmenter.GenerateMediaSegment(vf, segmentNum)
+func (h *Handlers) openView(c *gin.Context, path string, defaultScheme string) (*services.VideoFile, error) {
+	clip, err := services.ParseClip(c.Query("start"), c.Query("end"))
+	if err != nil {
+		return nil, err
+	}
+	scheme, err := h.keys.Scheme(c.Query("encryption"))
 	if err != nil {
+		return nil, err
+	}
+	if scheme == "" {
+		scheme = defaultScheme
+	}
+	if scheme != "" {
+		// Manifests and segments then agree on the key from the start
+		if _, err := h.keys.Key(c.Param("name")); err != nil {
+			return nil, err
+		}
+	}
+	vf, err := h.openVideo(path)
+	if err != nil {
+		return nil, err
+	}
+	if audio := c.Query("audio"); audio != "" {
+		n, err := services.FindAudio(vf, audio)
+		if err != nil {
+			return nil, err
+		}
+		if vf, err = h.segmenter.SelectAudio(vf, n); err != nil {
+			return nil, err
+		}
+	}
+	if clip != nil {
+		if vf, err = h.segmenter.ClipVideo(vf, clip); err != nil {
+			return nil, err
+		}
+	}
+	vf = h.segmenter.EncryptVideo(vf, scheme)
+	return h.segmenter.SignVideo(vf, requestToken(c)), nil
+}
+
+// openVideoError responds to a failed openVideo. Pending remux is reported
+// as temporarily unavailable so players retry
+func openVideoError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrRemuxPending):
+		c.Header("Retry-After", "5")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidClip), errors.Is(err, services.ErrInvalidEncryption):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrAudioNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	}
+}
+
+// videoParams collects stream parameters used by manifest generation. The
+// ladder comes from pre-encoded renditions when there are any, otherwise
+// it is transcoded from the source
+func (h *Handlers) videoParams(c *gin.Context, name string, vf *services.VideoFile) services.VideoParams {
+	params := services.VideoParams{
+		Codec:        vf.VideoCodec,
+		Width:        vf.Width,
+		Height:       vf.Height,
+		Timescale:    vf.Timescale,
+		Bandwidth:    vf.Bandwidth,
+		AvgBandwidth: vf.AvgBitrate,
+		Live:         liveParams(vf),
+		Query:        services.ViewQuery(vf),
+	}
+	params.Encryption = h.encryptionParams(c, vf)
+	// I-frame byte ranges are computed for clear segments
+	if vf.VideoIndex != nil && len(vf.VideoIndex.Keyframes) > 0 && vf.Encryption == "" {
+		params.TrickPlay = &services.TrickPlayParams{
+			Bandwidth:      h.segmenter.IFrameBandwidth(vf),
+			MaxPlayoutRate: h.segmenter.MaxPlayoutRate(vf),
+		}
+	}
+	params.Thumbnails = h.thumbnailer.Params(vf)
+	if subtitles, err := h.videoService.GetSubtitles(name); err == nil {
+		for _, sub := range subtitles {
+			params.Subtitles = append(params.Subtitles, services.SubtitleParams{Language: sub.Language})
+		}
 	}
 
-	c.Header("Content-Type", "video/mp4")
-	c.Header("Cache-Control", "max-age=31536000")
-	c.Data(http.StatusOK, "video/mp4", data)
+	renditions := h.renditions.Open(name, vf)
+	for _, r := range renditions {
+		params.Variants = append(params.Variants, services.VariantParams{
+			Name:         r.Name,
+			Codec:        r.Video.VideoCodec,
+			Width:        r.Video.Width,
+			Height:       r.Video.Height,
+			Bandwidth:    r.Video.Bandwidth,
+			AvgBandwidth: r.Video.AvgBitrate,
+			Timescale:    r.Video.Timescale,
+			Segments:     r.Video.Segments,
+		})
+	}
+
+	if len(renditions) == 0 {
+		for _, q := range h.transcoder.GetQualities(vf) {
+			params.Variants = append(params.Variants, services.VariantParams{
+				Name:      q.Name,
+				Codec:     h.transcoder.Codec(q),
+				Width:     h.transcoder.ScaledWidth(vf, q),
+				Height:    uint32(q.Height),
+				Bandwidth: uint32(q.Bandwidth),
+			})
+		}
+	}
+	if vf.AudioTrack != nil {
+		params.Audio = h.audioParams(vf, vf.AudioSelected)
+	}
+	if len(vf.AudioTracks) > 1 {
+		for n := range vf.AudioTracks {
+			track, err := h.segmenter.SelectAudio(vf, n)
+			if err != nil {
+				log.Printf("Skipping audio track %d of %s: %v", n, vf.Path, err)
+				continue
+			}
+			if track.AudioTrack != nil {
+				params.AudioTracks = append(params.AudioTracks, *h.audioParams(track, vf.AudioSelected))
+			}
+		}
+	}
+	return params
+}
+
+// audioParams describes the selected audio track of vf. Track def is the
+// default of the audio group
+func (h *Handlers) audioParams(vf *services.VideoFile, def int) *services.AudioParams {
+	bandwidth := vf.AudioBandwidth
+	if bandwidth == 0 {
+		bandwidth = vf.AudioBitrate
+	}
+	if bandwidth == 0 {
+		bandwidth = 128000
+	}
+	track := vf.AudioTracks[vf.AudioSelected]
+	audio := &services.AudioParams{
+		Codec:       vf.AudioCodec,
+		Channels:    vf.AudioChannels,
+		Bandwidth:   bandwidth,
+		Timescale:   vf.AudioTimescale,
+		SampleRate:  vf.AudioSampleRate,
+		DurationSec: h.segmenter.GetAudioDurationSec(vf),
+		Segments:    vf.AudioSegments,
+		Track:       vf.AudioSelected,
+		Language:    track.Language,
+		Name:        track.Name,
+		Default:     vf.AudioSelected == def,
+		Query:       services.AudioQuery(vf, vf.AudioSelected),
+	}
+	// Roles tell tracks of a group apart, a single one goes without
+	if len(vf.AudioTracks) > 1 {
+		switch {
+		case track.Role != "":
+			audio.Role = track.Role
+		case audio.Default:
+			audio.Role = "main"
+		default:
+			audio.Role = "alternate"
+		}
+	}
+	return audio
+}
+
+// liveParams returns live state of a source opened while it was recorded
+func liveParams(vf *services.VideoFile) *services.LiveParams {
+	if !vf.Event {
+		return nil
+	}
+	return &services.LiveParams{Ended: !vf.Live, StartTime: vf.LiveStart}
+}
+
+// segmentKey builds cache key of a segment generated from vf. index is -1
+// for init segments
+func segmentKey(vf *services.VideoFile, track, quality string, index int, format string) services.SegmentKey {
+	clip := ""
+	if vf.Clip != nil {
+		clip = vf.Clip.String()
+	}
+	audio := 0
+	if (track == "audio" || format == "ts") && vf.AudioSelected != vf.AudioDefault {
+		audio = vf.AudioSelected + 1
+	}
+	// Subtitles, thumbnails and I-frames stay clear in encrypted views
+	encryption := ""
+	if (track == "video" || track == "audio") && format == "fmp4" {
+		encryption = vf.Encryption
+	}
+	return services.SegmentKey{
+		Video:   vf.Path,
+		Clip:    clip,
+		Offset:  vf.Offset,
+		Track:   track,
+		Audio:   audio,
+		Quality: quality,
+		Index:   index,
+		Format:  format,
+
+		Encryption: encryption,
+	}
+}
+
+// parseSegmentNumber parses N from names like <prefix>N<ext>
+func parseSegmentNumber(segment, prefix, ext string) (int, bool) {
+	if !strings.HasPrefix(segment, prefix) || !strings.HasSuffix(segment, ext) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(segment, prefix), ext))
+	if err != nil {
+		return 0, false
+	}
+	return n, true
 }
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"amka.ru/jit-streamer/services"
+)
+
+// livePollInterval is how often a blocked request looks for new fragments
+const livePollInterval = 50 * time.Millisecond
+
+// blockingReload is a blocking playlist request: _HLS_msn=N waits for
+// segment N, adding _HLS_part=P waits for part P of it
+type blockingReload struct {
+	msn  int
+	part int // -1 waits for the whole segment
+}
+
+// parseBlockingReload returns nil for a plain playlist request
+func parseBlockingReload(c *gin.Context) (*blockingReload, bool) {
+	msnStr, hasMSN := c.GetQuery("_HLS_msn")
+	partStr, hasPart := c.GetQuery("_HLS_part")
+	if !hasMSN {
+		return nil, !hasPart
+	}
+	req := &blockingReload{part: -1}
+	var err error
+	if req.msn, err = strconv.Atoi(msnStr); err != nil || req.msn < 0 {
+		return nil, false
+	}
+	if hasPart {
+		if req.part, err = strconv.Atoi(partStr); err != nil || req.part < 0 {
+			return nil, false
+		}
+	}
+	return req, true
+}
+
+// awaitPlaylist serves a blocking playlist request. It responds with an
+// error and returns nil when the segment is too far ahead or does not show
+// up within three target durations
+func (h *Handlers) awaitPlaylist(c *gin.Context, videoPath string, vf *services.VideoFile, audio bool) *services.VideoFile {
+	req, ok := parseBlockingReload(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid _HLS_msn or _HLS_part"})
+		return nil
+	}
+	if req == nil || !vf.Live {
+		return vf
+	}
+
+	segmentCount := func(vf *services.VideoFile) int {
+		if audio {
+			return len(vf.AudioSegments)
+		}
+		return len(vf.Segments)
+	}
+	if req.msn > segmentCount(vf)+2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "_HLS_msn too far ahead"})
+		return nil
+	}
+	ready := func(vf *services.VideoFile) bool {
+		n := segmentCount(vf)
+		if req.msn < n {
+			return true
+		}
+		return req.msn == n && req.part >= 0 && req.part < len(h.parts(vf, n, audio))
+	}
+
+	vf = h.awaitLive(c, videoPath, vf, ready)
+	if !ready(vf) && vf.Live {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "segment not available yet"})
+		return nil
+	}
+	return vf
+}
+
+// awaitLive reopens a live source until ready reports true, the source
+// ends, the client goes away or three target durations pass
+func (h *Handlers) awaitLive(c *gin.Context, videoPath string, vf *services.VideoFile, ready func(*services.VideoFile) bool) *services.VideoFile {
+	timeout := time.NewTimer(3 * h.segmenter.SegmentDuration())
+	defer timeout.Stop()
+	ticker := time.NewTicker(livePollInterval)
+	defer ticker.Stop()
+
+	for vf.Live && !ready(vf) {
+		select {
+		case <-c.Request.Context().Done():
+			return vf
+		case <-timeout.C:
+			return vf
+		case <-ticker.C:
+		}
+		next, err := h.openSource(c, videoPath)
+		if err != nil {
+			return vf
+		}
+		vf = next
+	}
+	return vf
+}
+
+// serveLivePart serves part_N.P.m4s or audio_part_N.P.m4s. A part announced
+// by a preload hint is awaited like a blocking playlist reload
+func (h *Handlers) serveLivePart(c *gin.Context, videoPath string, vf *services.VideoFile, segmentNum, partNum int, audio bool) {
+	vf = h.awaitLive(c, videoPath, vf, func(vf *services.VideoFile) bool {
+		return partNum < len(h.parts(vf, segmentNum, audio))
+	})
+	if partNum >= len(h.parts(vf, segmentNum, audio)) {
+		if vf.Live {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "part not available yet"})
+		} else {
+			c.JSON(http.StatusNotFound, gin.H{"error": "part not found"})
+		}
+		return
+	}
+
+	track, contentType := "video", "video/mp4"
+	if audio {
+		track, contentType = "audio", "audio/mp4"
+	}
+	key := segmentKey(vf, track, "", segmentNum, "fmp4")
+	key.Part = partNum + 1
+	protect := h.protectVideo
+	if audio {
+		protect = h.protectAudio
+	}
+	generate := protect(c, vf, func() ([]byte, error) {
+		if audio {
+			return h.segmenter.GenerateAudioPart(vf, segmentNum, partNum)
+		}
+		return h.segmenter.GenerateVideoPart(vf, segmentNum, partNum)
+	})
+	h.serveSegment(c, vf, key, contentType, generate)
+}
+
+func (h *Handlers) parts(vf *services.VideoFile, segmentNum int, audio bool) []services.Part {
+	if audio {
+		return h.segmenter.AudioParts(vf, segmentNum)
+	}
+	return h.segmenter.VideoParts(vf, segmentNum)
+}
+
+// parsePartNumber parses N and P from names like <prefix>N.P<ext>
+func parsePartNumber(name, prefix, ext string) (int, int, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+		return 0, 0, false
+	}
+	segment, part, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext), ".")
+	if !ok {
+		return 0, 0, false
+	}
+	n, err1 := strconv.Atoi(segment)
+	p, err2 := strconv.Atoi(part)
+	if err1 != nil || err2 != nil || n < 0 || p < 0 {
+		return 0, 0, false
+	}
+	return n, p, true
+}
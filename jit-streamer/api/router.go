@@ -6,15 +6,15 @@ import (
 	"amka.ru/jit-streamer/services"
 )
 
-func SetupRouter(vs *services.VideoService, seg *services.Segmenter, ms *services.ManifestService) *gin.Engine {
+func SetupRouter(vs *services.VideoService, seg *services.Segmenter, ms *services.ManifestService, tc *services.Transcoder, cache *services.SegmentCache, rm *services.Remuxer, rc *services.RenditionCache, chs *services.ChannelService, as *services.AssetService, th *services.Thumbnailer, ks *services.KeyService, ts *services.TokenService) *gin.Engine {
 	r := gin.Default()
 
 	// CORS middleware
 	r.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Range")
-		c.Header("Access-Control-Expose-Headers", "Content-Length, Content-Range")
+		c.Header("Access-Control-Expose-Headers", "Content-Length, Content-Range, ETag")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -23,7 +23,7 @@ func SetupRouter(vs *services.VideoService, seg *services.Segmenter, ms *service
 		c.Next()
 	})
 
-	handlers := NewHandlers(vs, seg, ms)
+	handlers := NewHandlers(vs, seg, ms, tc, cache, rm, rc, chs, as, th, ks, ts)
 
 	// API routes
 	api := r.Group("/api/v1")
@@ -31,25 +31,87 @@ func SetupRouter(vs *services.VideoService, seg *services.Segmenter, ms *service
 		// Videos management
 		api.GET("/videos", handlers.ListVideos)
 		api.GET("/videos/:name", handlers.GetVideoInfo)
+
+		// Linear channels
+		api.GET("/channels", handlers.ListChannels)
+		api.GET("/channels/:name", handlers.GetChannel)
+
+		// Virtual assets concatenating videos
+		api.GET("/assets", handlers.ListAssets)
+		api.GET("/assets/:name", handlers.GetAsset)
+
+		// Schedules and assets, written with the admin key when tokens are
+		// enabled
+		admin := api.Group("", handlers.RequireAdmin())
+		admin.PUT("/channels/:name", handlers.PutChannel)
+		admin.DELETE("/channels/:name", handlers.DeleteChannel)
+		admin.PUT("/assets/:name", handlers.PutAsset)
+		admin.DELETE("/assets/:name", handlers.DeleteAsset)
+
+		// Signed playback URLs, authorized by the admin key
+		api.POST("/tokens", handlers.PostToken)
+
+		// Generated segments cache counters
+		api.GET("/cache/stats", handlers.GetCacheStats)
 	}
 
 	// HLS streaming routes (JIT - all generated on the fly)
-	hls := r.Group("/hls/:name")
+	hls := r.Group("/hls/:name", handlers.RequireToken(services.ScopeVideo))
 	{
 		hls.GET("/master.m3u8", handlers.GetHLSMasterPlaylist)
 		hls.GET("/media.m3u8", handlers.GetHLSMediaPlaylist)
+		hls.GET("/audio.m3u8", handlers.GetHLSAudioPlaylist)
+		// Trick play: I-frames of segment N by byte range in iframes_N.m4s
+		hls.GET("/iframes.m3u8", handlers.GetHLSIFramePlaylist)
+		// Seek-bar previews: sprite sheets thumbnails_N.jpg
+		hls.GET("/thumbnails.m3u8", handlers.GetThumbnailPlaylist)
+		hls.GET("/thumbnails.vtt", handlers.GetThumbnailVTT)
+		// MPEG-TS variant for clients without fMP4 support: segment_N.ts
+		hls.GET("/master_ts.m3u8", handlers.GetHLSTSMasterPlaylist)
+		hls.GET("/media_ts.m3u8", handlers.GetHLSTSPlaylist)
 		hls.GET("/init.mp4", handlers.GetHLSInitSegment)
+		hls.GET("/audio_init.mp4", handlers.GetHLSAudioInitSegment)
+		// Sidecar subtitles: subtitles_<lang>.m3u8 and WebVTT segments
+		// subtitles_<lang>_N.vtt
 		hls.GET("/:segment", handlers.GetHLSSegment)
+		// Transcoded ABR ladder: /hls/:name/:quality/...
+		hls.GET("/:segment/:file", handlers.GetQualityFile)
 	}
 
 	// DASH streaming routes (JIT - all generated on the fly)
-	dash := r.Group("/dash/:name")
+	dash := r.Group("/dash/:name", handlers.RequireToken(services.ScopeVideo))
 	{
 		dash.GET("/stream.mpd", handlers.GetDASHManifest)
 		dash.GET("/init.mp4", handlers.GetDASHInitSegment)
+		dash.GET("/thumbnails.vtt", handlers.GetThumbnailVTT)
+		// Sidecar subtitles: wvtt segments subtitles_<lang>_N.m4s
 		dash.GET("/:segment", handlers.GetDASHSegment)
+		// Transcoded ABR ladder: /dash/:name/:quality/...
+		dash.GET("/:segment/:file", handlers.GetQualityFile)
+	}
+
+	// Linear channel routes, segments are served by the VOD routes above
+	channels := r.Group("/channels/:name", handlers.RequireToken(services.ScopeChannel))
+	{
+		channels.GET("/master.m3u8", handlers.GetChannelMasterPlaylist)
+		channels.GET("/media.m3u8", handlers.GetChannelMediaPlaylist)
+		channels.GET("/audio.m3u8", handlers.GetChannelAudioPlaylist)
+		channels.GET("/stream.mpd", handlers.GetChannelDASHManifest)
+	}
+
+	// Virtual asset routes, segments of video N are served as /assets/:name/N/...
+	assets := r.Group("/assets/:name", handlers.RequireToken(services.ScopeAsset))
+	{
+		assets.GET("/master.m3u8", handlers.GetAssetMasterPlaylist)
+		assets.GET("/media.m3u8", handlers.GetAssetMediaPlaylist)
+		assets.GET("/audio.m3u8", handlers.GetAssetAudioPlaylist)
+		assets.GET("/stream.mpd", handlers.GetAssetDASHManifest)
+		assets.GET("/:part/:file", handlers.GetAssetFile)
 	}
 
+	// ClearKey license server for encrypted streams
+	r.POST("/clearkey/license", handlers.PostClearKeyLicense)
+
 	// Health check
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
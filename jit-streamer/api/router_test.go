@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"amka.ru/jit-streamer/config"
+	"amka.ru/jit-streamer/services"
+)
+
+// TestAdminWrites checks that with tokens enabled schedules and assets are
+// written with the admin key only, a playback token does not do
+func TestAdminWrites(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	vs := services.NewVideoService(&config.Config{VideosPath: dir})
+	seg := services.NewSegmenter(1, 0, 0)
+	t.Cleanup(seg.Close)
+	rm := services.NewRemuxer(filepath.Join(dir, "remux"), seg)
+	chs, err := services.NewChannelService(vs, seg, rm, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	as, err := services.NewAssetService(vs, seg, rm, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := services.NewTokenService("secret", "admin")
+	token, err := ts.Sign(services.TokenClaims{Scope: services.Scope(services.ScopeChannel, "news"), Expires: 1 << 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := SetupRouter(vs, seg, nil, nil, nil, rm, nil, chs, as, nil, nil, ts)
+
+	request := func(method, path, auth string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"videos": ["secret_movie"]}`))
+		req.Header.Set("Content-Type", "application/json")
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, path := range []string{"/api/v1/channels/news", "/api/v1/assets/news"} {
+		for _, method := range []string{http.MethodPut, http.MethodDelete} {
+			for _, auth := range []string{"", token, "wrong"} {
+				if code := request(method, path, auth); code != http.StatusUnauthorized {
+					t.Errorf("%s %s with %q = %d, want 401", method, path, auth, code)
+				}
+			}
+			if code := request(method, path, "admin"); code == http.StatusUnauthorized {
+				t.Errorf("%s %s with the admin key rejected", method, path)
+			}
+		}
+	}
+}
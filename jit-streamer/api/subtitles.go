@@ -0,0 +1,113 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"amka.ru/jit-streamer/services"
+)
+
+// serveSubtitleFile serves files of subtitle renditions next to segments:
+// subtitles_<lang>.m3u8, subtitles_<lang>.vtt with the whole track, WebVTT
+// segments subtitles_<lang>_N.vtt and wvtt segments subtitles_<lang>_init.mp4
+// and subtitles_<lang>_N.m4s. It returns false for other files
+func (h *Handlers) serveSubtitleFile(c *gin.Context, vf *services.VideoFile, file string) bool {
+	if !strings.HasPrefix(file, "subtitles_") {
+		return false
+	}
+	lang, n, format, ok := parseSubtitleFile(file)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return true
+	}
+	sub, err := h.videoService.GetSubtitle(c.Param("name"), lang)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "subtitles not found"})
+		return true
+	}
+
+	if format == "m3u8" {
+		playlist := h.manifestService.GenerateHLSSubtitlePlaylist(c.Param("name"), lang, vf.Segments, vf.Timescale, liveParams(vf), services.ViewQuery(vf))
+
+		c.Header("Content-Type", "application/vnd.apple.mpegurl")
+		c.Header("Cache-Control", "no-cache")
+		serveManifest(c, playlist)
+		return true
+	}
+
+	key := segmentKey(vf, "subtitles", lang, n, format)
+	generate := func() ([]byte, error) {
+		if format == "fmp4" && n < 0 {
+			return h.segmenter.GenerateSubtitleInitSegment(vf, lang)
+		}
+		cues, err := services.LoadSubtitles(sub.Path)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case format == "fmp4":
+			return h.segmenter.GenerateSubtitleMediaSegment(vf, cues, n)
+		case n < 0:
+			return h.segmenter.GenerateWebVTT(vf, cues), nil
+		default:
+			return h.segmenter.GenerateWebVTTSegment(vf, cues, n)
+		}
+	}
+
+	if vf.Live && n < 0 && format == "vtt" {
+		// Whole track of a live source grows with it, so it is tagged by
+		// content like playlists
+		data, err := h.cache.GetOrGenerate(c.Request.Context(), key, generate)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return true
+		}
+		c.Header("Content-Type", "text/vtt")
+		c.Header("Cache-Control", "no-cache")
+		serveManifest(c, string(data))
+		return true
+	}
+	contentType := "text/vtt"
+	if format == "fmp4" {
+		contentType = "application/mp4"
+	}
+	h.serveSegment(c, vf, key, contentType, generate)
+	return true
+}
+
+// parseSubtitleFile parses language, segment number and format of a
+// subtitle file name. Number is -1 for playlists, whole tracks and init
+// segments. Languages never contain underscores, so the last one separates
+// the number
+func parseSubtitleFile(file string) (string, int, string, bool) {
+	var ext, format string
+	switch {
+	case strings.HasSuffix(file, ".m3u8"):
+		ext, format = ".m3u8", "m3u8"
+	case strings.HasSuffix(file, ".vtt"):
+		ext, format = ".vtt", "vtt"
+	case strings.HasSuffix(file, "_init.mp4"):
+		ext, format = "_init.mp4", "fmp4"
+	case strings.HasSuffix(file, ".m4s"):
+		ext, format = ".m4s", "fmp4"
+	default:
+		return "", 0, "", false
+	}
+	lang := strings.TrimSuffix(strings.TrimPrefix(file, "subtitles_"), ext)
+	n := -1
+	if i := strings.LastIndex(lang, "_"); i >= 0 {
+		var err error
+		if n, err = strconv.Atoi(lang[i+1:]); err != nil || n < 0 {
+			return "", 0, "", false
+		}
+		lang = lang[:i]
+	}
+	switch {
+	case n >= 0 && (ext == ".m3u8" || ext == "_init.mp4"), n < 0 && ext == ".m4s", lang == "":
+		return "", 0, "", false
+	}
+	return lang, n, format, true
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"amka.ru/jit-streamer/services"
+)
+
+// GetThumbnailPlaylist returns HLS image playlist of thumbnail sprite sheets
+func (h *Handlers) GetThumbnailPlaylist(c *gin.Context) {
+	vf, thumbnails := h.openThumbnails(c)
+	if vf == nil {
+		return
+	}
+
+	playlist := h.manifestService.GenerateHLSImagePlaylist(c.Param("name"), *thumbnails, h.segmenter.GetDurationSec(vf), services.ViewQuery(vf))
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.Header("Cache-Control", "no-cache")
+	serveManifest(c, playlist)
+}
+
+// GetThumbnailVTT returns WebVTT thumbnail track, cues point into sprite
+// sheets with #xywh
+func (h *Handlers) GetThumbnailVTT(c *gin.Context) {
+	vf, thumbnails := h.openThumbnails(c)
+	if vf == nil {
+		return
+	}
+
+	vtt := h.manifestService.GenerateThumbnailVTT(*thumbnails, h.segmenter.GetDurationSec(vf), services.ViewQuery(vf))
+
+	c.Header("Content-Type", "text/vtt")
+	c.Header("Cache-Control", "no-cache")
+	serveManifest(c, vtt)
+}
+
+// openThumbnails opens the source of a thumbnail track request. It responds
+// with an error and returns nil when the source has no thumbnails
+func (h *Handlers) openThumbnails(c *gin.Context) (*services.VideoFile, *services.ThumbnailParams) {
+	videoPath, err := h.videoService.GetVideoPath(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "video not found"})
+		return nil, nil
+	}
+
+	vf, err := h.openSource(c, videoPath)
+	if err != nil {
+		openVideoError(c, err)
+		return nil, nil
+	}
+
+	thumbnails := h.thumbnailer.Params(vf)
+	if thumbnails == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "video has no thumbnails"})
+		return nil, nil
+	}
+	return vf, thumbnails
+}
+
+// serveThumbnailSheet serves thumbnails_N.jpg, rendered once and cached
+// like segments
+func (h *Handlers) serveThumbnailSheet(c *gin.Context, vf *services.VideoFile, n int) {
+	thumbnails := h.thumbnailer.Params(vf)
+	if thumbnails == nil || n < 0 || n >= thumbnails.Sheets() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "thumbnail sheet not found"})
+		return
+	}
+
+	key := segmentKey(vf, "thumbnails", "", n, "jpeg")
+	generate := func() ([]byte, error) {
+		return h.thumbnailer.GenerateSheet(vf, n)
+	}
+	h.serveSegment(c, vf, key, "image/jpeg", generate)
+}
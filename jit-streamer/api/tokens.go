@@ -0,0 +1,153 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"amka.ru/jit-streamer/services"
+)
+
+// defaultTokenTTL is the lifetime of minted tokens that do not ask for one
+const defaultTokenTTL = time.Hour
+
+// tokenClaimsKey keeps claims of the verified token in the request context
+const tokenClaimsKey = "tokenClaims"
+
+// RequireToken rejects requests for a stream of kind without a valid
+// playback token for it. Every request passes when tokens are disabled
+func (h *Handlers) RequireToken(kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !h.tokens.Enabled() {
+			c.Next()
+			return
+		}
+		claims, err := h.tokens.Verify(c.Query("token"), time.Now())
+		if err == nil {
+			err = claims.Allows(services.Scope(kind, c.Param("name")), c.ClientIP())
+		}
+		if err != nil {
+			tokenError(c, err)
+			c.Abort()
+			return
+		}
+		c.Set(tokenClaimsKey, claims)
+		c.Next()
+	}
+}
+
+// RequireAdmin rejects API writes without the admin key when tokens are
+// enabled, since schedules and assets decide which videos their tokens
+// grant. Every request passes when tokens are disabled
+func (h *Handlers) RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if h.tokens.Enabled() && !h.authorized(c) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid admin key"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// authorized reports whether the request carries the admin key as a bearer
+// token
+func (h *Handlers) authorized(c *gin.Context) bool {
+	key, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return h.tokens.Authorize(key)
+}
+
+// requestToken returns the verified playback token of the request, empty
+// when tokens are disabled
+func requestToken(c *gin.Context) string {
+	if _, ok := c.Get(tokenClaimsKey); !ok {
+		return ""
+	}
+	return c.Query("token")
+}
+
+// tokenQuery returns the query carrying a playback token for the stream of
+// kind called name, like the token of the request but limited to it. Empty
+// when tokens are disabled
+func (h *Handlers) tokenQuery(c *gin.Context, kind, name string) string {
+	scope := services.Scope(kind, name)
+	v, ok := c.Get(tokenClaimsKey)
+	if !ok {
+		return ""
+	}
+	claims := v.(services.TokenClaims)
+	token := c.Query("token")
+	if claims.Scope != scope {
+		var err error
+		if token, err = h.tokens.Derive(claims, scope); err != nil {
+			log.Printf("Failed to derive token for %s: %v", scope, err)
+			return ""
+		}
+	}
+	return "?" + url.Values{"token": {token}}.Encode()
+}
+
+// PostToken mints a playback token: {"scope": "...", "ttl": seconds,
+// "ip": "..."}. Scope is video:, asset: or channel: followed by the name, a
+// trailing * matches a prefix of names. The admin key is sent as a bearer
+// token
+func (h *Handlers) PostToken(c *gin.Context) {
+	if !h.tokens.Enabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "playback tokens are disabled"})
+		return
+	}
+	if !h.authorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid admin key"})
+		return
+	}
+
+	var req struct {
+		Scope string `json:"scope"`
+		TTL   int    `json:"ttl"`
+		IP    string `json:"ip"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !services.ValidScope(req.Scope) || req.TTL < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be video:, asset: or channel: followed by a name and ttl must not be negative"})
+		return
+	}
+	if req.IP != "" {
+		ip := net.ParseIP(req.IP)
+		if ip == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ip"})
+			return
+		}
+		req.IP = ip.String()
+	}
+	ttl := defaultTokenTTL
+	if req.TTL > 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	token, err := h.tokens.Sign(services.TokenClaims{Scope: req.Scope, Expires: expires.Unix(), IP: req.IP})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"token": token, "expires": expires.UTC()})
+}
+
+// tokenError responds to a rejected playback token
+func tokenError(c *gin.Context, err error) {
+	if errors.Is(err, services.ErrTokenRequired) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+}
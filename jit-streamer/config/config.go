@@ -2,13 +2,61 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
 	Port            string
 	VideosPath      string
 	SegmentDuration int // seconds
+
+	// Fragmented sources modified within this many seconds are served live,
+	// 0 serves everything as VOD
+	LiveIdleTimeout int
+
+	// LL-HLS part duration of live sources in milliseconds, 0 disables parts
+	PartDuration int
+
+	// Seconds between seek-bar thumbnails, 0 disables thumbnail tracks
+	ThumbnailInterval int
+
+	// Generated segments cache. Disk tier is disabled when CacheDir is empty
+	CacheMaxBytes     int
+	CacheDir          string
+	CacheDiskMaxBytes int
+
+	// Intermediate MP4 files of MKV, AVI and MOV sources
+	RemuxDir string
+
+	// Linear channel schedules are saved to this JSON file, they are kept in
+	// memory only when it is empty
+	ChannelsFile string
+
+	// Virtual assets are saved to this JSON file, they are kept in memory
+	// only when it is empty
+	AssetsFile string
+
+	// Common Encryption scheme, "cenc" or "cbcs", of fMP4 master playlists
+	// and MPDs requested without one. Empty serves them clear
+	EncryptionScheme string
+
+	// Content keys are saved to this JSON file, they are kept in memory only
+	// when it is empty
+	KeysFile string
+
+	// Playback tokens are signed with this secret and required by stream
+	// routes. Empty disables them
+	TokenSecret string
+
+	// Authorizes minting playback tokens and, while tokens are enabled,
+	// writing channels and assets through the API. Empty disables both
+	AdminKey string
+
+	// Addresses or CIDRs of proxies whose X-Forwarded-For is trusted for
+	// the client address tokens are bound to. Empty trusts none
+	TrustedProxies []string
 }
 
 func Load() *Config {
@@ -16,6 +64,26 @@ func Load() *Config {
 		Port:            getEnv("PORT", "8080"),
 		VideosPath:      getEnv("VIDEOS_PATH", "../packager/.videos"),
 		SegmentDuration: getEnvInt("SEGMENT_DURATION", 4),
+		LiveIdleTimeout: getEnvInt("LIVE_IDLE_TIMEOUT", 10),
+		PartDuration:    getEnvInt("PART_DURATION_MS", 1000),
+
+		ThumbnailInterval: getEnvInt("THUMBNAIL_INTERVAL", 10),
+
+		CacheMaxBytes:     getEnvInt("CACHE_MAX_BYTES", 256<<20),
+		CacheDir:          getEnv("CACHE_DIR", ""),
+		CacheDiskMaxBytes: getEnvInt("CACHE_DISK_MAX_BYTES", 2<<30),
+
+		RemuxDir: getEnv("REMUX_DIR", filepath.Join(os.TempDir(), "jit-streamer-remux")),
+
+		ChannelsFile: getEnv("CHANNELS_FILE", ""),
+		AssetsFile:   getEnv("ASSETS_FILE", ""),
+
+		EncryptionScheme: getEnv("ENCRYPTION_SCHEME", ""),
+		KeysFile:         getEnv("KEYS_FILE", ""),
+
+		TokenSecret:    getEnv("TOKEN_SECRET", ""),
+		AdminKey:       getEnv("ADMIN_KEY", ""),
+		TrustedProxies: getEnvList("TRUSTED_PROXIES"),
 	}
 }
 
@@ -34,3 +102,14 @@ func getEnvInt(key string, defaultVal int) int {
 	}
 	return defaultVal
 }
+
+// getEnvList returns comma separated values of key
+func getEnvList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
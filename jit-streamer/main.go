@@ -14,14 +14,59 @@ func main() {
 	log.Printf("Starting JIT Streamer on port %s", cfg.Port)
 	log.Printf("Videos path: %s", cfg.VideosPath)
 	log.Printf("Segment duration: %d seconds", cfg.SegmentDuration)
+	log.Printf("Live idle timeout: %d seconds", cfg.LiveIdleTimeout)
+	log.Printf("LL-HLS part duration: %d ms", cfg.PartDuration)
+	log.Printf("Thumbnail interval: %d seconds", cfg.ThumbnailInterval)
+	log.Printf("Segment cache: %d bytes in memory", cfg.CacheMaxBytes)
+	if cfg.CacheDir != "" {
+		log.Printf("Segment disk cache: %s (%d bytes)", cfg.CacheDir, cfg.CacheDiskMaxBytes)
+	}
+	log.Printf("Remux directory: %s", cfg.RemuxDir)
+	if cfg.ChannelsFile != "" {
+		log.Printf("Channels file: %s", cfg.ChannelsFile)
+	}
+	if cfg.AssetsFile != "" {
+		log.Printf("Assets file: %s", cfg.AssetsFile)
+	}
+	if cfg.EncryptionScheme != "" {
+		log.Printf("Encryption scheme: %s", cfg.EncryptionScheme)
+	}
+	if cfg.KeysFile != "" {
+		log.Printf("Keys file: %s", cfg.KeysFile)
+	}
+	if cfg.TokenSecret != "" {
+		log.Printf("Playback tokens required")
+	}
 
 	videoService := services.NewVideoService(cfg)
-	segmenter := services.NewSegmenter(cfg.SegmentDuration)
+	segmenter := services.NewSegmenter(cfg.SegmentDuration, cfg.LiveIdleTimeout, cfg.PartDuration)
 	manifestService := services.NewManifestService(cfg.SegmentDuration)
+	transcoder := services.NewTranscoder(segmenter)
+	thumbnailer := services.NewThumbnailer(segmenter, cfg.ThumbnailInterval)
+	cache := services.NewSegmentCache(int64(cfg.CacheMaxBytes), cfg.CacheDir, int64(cfg.CacheDiskMaxBytes))
+	remuxer := services.NewRemuxer(cfg.RemuxDir, segmenter)
+	renditions := services.NewRenditionCache(videoService, segmenter, remuxer)
+	channelService, err := services.NewChannelService(videoService, segmenter, remuxer, cfg.ChannelsFile)
+	if err != nil {
+		log.Fatalf("Failed to load channels: %v", err)
+	}
+	assetService, err := services.NewAssetService(videoService, segmenter, remuxer, cfg.AssetsFile)
+	if err != nil {
+		log.Fatalf("Failed to load assets: %v", err)
+	}
+	keyService, err := services.NewKeyService(cfg.EncryptionScheme, cfg.KeysFile)
+	if err != nil {
+		log.Fatalf("Failed to load keys: %v", err)
+	}
+
+	tokenService := services.NewTokenService(cfg.TokenSecret, cfg.AdminKey)
 
 	defer segmenter.Close()
 
-	router := api.SetupRouter(videoService, segmenter, manifestService)
+	router := api.SetupRouter(videoService, segmenter, manifestService, transcoder, cache, remuxer, renditions, channelService, assetService, thumbnailer, keyService, tokenService)
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
 
 	if err := router.Run(":" + cfg.Port); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
@@ -0,0 +1,8 @@
+package models
+
+// Asset is a virtual VOD asset playing its videos one after another as a
+// single stream, such as intro, episode and outro
+type Asset struct {
+	Name   string   `json:"name"`
+	Videos []string `json:"videos"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Channel is a linear stream looping an ordered list of videos on the wall
+// clock. Schedule edits take effect at the next segment boundary, earlier
+// schedules are kept while their segments are in the live window
+type Channel struct {
+	Name      string            `json:"name"`
+	Videos    []string          `json:"videos"`  // current schedule
+	Created   time.Time         `json:"created"` // time zero of the channel timeline
+	Schedules []ChannelSchedule `json:"schedules"`
+}
+
+// ChannelSchedule is a list of videos played in a loop from Start until the
+// next schedule starts
+type ChannelSchedule struct {
+	Videos             []string  `json:"videos"`
+	Start              time.Time `json:"start"`
+	FirstSequence      uint64    `json:"first_sequence"`      // media sequence number of the first segment
+	FirstDiscontinuity uint64    `json:"first_discontinuity"` // number of the first video occurrence
+}
@@ -0,0 +1,9 @@
+package models
+
+// ContentKey is the AES-128 key a video is encrypted with. Values are hex
+type ContentKey struct {
+	Video string `json:"video"`
+	KID   string `json:"kid"`
+	Key   string `json:"key"`
+	IV    string `json:"iv"` // constant IV of cbcs, seed of cenc IVs
+}
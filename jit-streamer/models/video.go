@@ -11,6 +11,22 @@ type VideoInfo struct {
 	Bitrate   int64         `json:"bitrate"`
 	Codec     string        `json:"codec"`
 	FrameRate float64       `json:"frame_rate"`
+	Subtitles []string      `json:"subtitles,omitempty"` // languages of sidecar subtitles
+
+	// Set for containers remuxed to MP4 before streaming
+	Remux *RemuxStatus `json:"remux,omitempty"`
+}
+
+// Remux states of non-MP4 sources
+const (
+	RemuxPending = "pending"
+	RemuxReady   = "ready"
+	RemuxFailed  = "failed"
+)
+
+type RemuxStatus struct {
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
 }
 
 type StreamInfo struct {
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"amka.ru/jit-streamer/models"
+)
+
+var (
+	ErrAssetNotFound = errors.New("asset not found")
+	ErrInvalidAsset  = errors.New("invalid asset")
+)
+
+// AssetService keeps virtual assets. Every video of an asset plays its VOD
+// segments shifted to start where the previous video ends, so the asset
+// timeline keeps increasing across joins
+type AssetService struct {
+	videoService *VideoService
+	segmenter    *Segmenter
+	remuxer      *Remuxer
+	file         string // assets are saved to this JSON file, empty keeps them in memory
+
+	mu     sync.Mutex
+	assets map[string]*models.Asset
+}
+
+func NewAssetService(vs *VideoService, seg *Segmenter, rm *Remuxer, file string) (*AssetService, error) {
+	s := &AssetService{
+		videoService: vs,
+		segmenter:    seg,
+		remuxer:      rm,
+		file:         file,
+		assets:       make(map[string]*models.Asset),
+	}
+	if file == "" {
+		return s, nil
+	}
+	var assets []*models.Asset
+	if err := loadJSON(file, &assets); err != nil {
+		return nil, fmt.Errorf("failed to load assets: %w", err)
+	}
+	for _, a := range assets {
+		s.assets[a.Name] = a
+	}
+	return s, nil
+}
+
+// List returns all assets sorted by name
+func (s *AssetService) List() []models.Asset {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	assets := make([]models.Asset, 0, len(s.assets))
+	for _, a := range s.assets {
+		assets = append(assets, copyAsset(a))
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i].Name < assets[j].Name })
+	return assets
+}
+
+func (s *AssetService) Get(name string) (models.Asset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.assets[name]
+	if !ok {
+		return models.Asset{}, ErrAssetNotFound
+	}
+	return copyAsset(a), nil
+}
+
+// Put creates the asset or replaces its videos
+func (s *AssetService) Put(name string, videos []string) (models.Asset, error) {
+	if len(videos) == 0 {
+		return models.Asset{}, fmt.Errorf("%w: no videos", ErrInvalidAsset)
+	}
+	for _, video := range videos {
+		if _, err := openListed(s.videoService, s.remuxer, s.segmenter, video, ErrInvalidAsset); err != nil {
+			return models.Asset{}, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := &models.Asset{Name: name, Videos: append([]string{}, videos...)}
+	s.assets[name] = a
+	if err := s.save(); err != nil {
+		return models.Asset{}, err
+	}
+	return copyAsset(a), nil
+}
+
+func (s *AssetService) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.assets[name]; !ok {
+		return ErrAssetNotFound
+	}
+	delete(s.assets, name)
+	return s.save()
+}
+
+// Timeline opens the videos of the asset and places them one after another
+func (s *AssetService) Timeline(name string) (*AssetTimeline, error) {
+	a, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	tl := &AssetTimeline{Asset: a, Audio: true}
+	var offset time.Duration
+	for _, video := range a.Videos {
+		vf, err := openListed(s.videoService, s.remuxer, s.segmenter, video, ErrInvalidAsset)
+		if err != nil {
+			return nil, err
+		}
+		count := playedSegmentCount(vf)
+		last := vf.Segments[count-1]
+		// Rounded up like shifts, so the next part never overlaps this one
+		ts := time.Duration(vf.Timescale)
+		end := (time.Duration(last.StartTime+last.Duration)*time.Second + ts - 1) / ts
+
+		tl.Audio = tl.Audio && vf.AudioTrack != nil
+		tl.Parts = append(tl.Parts, AssetPart{
+			Video:        video,
+			VideoFile:    s.segmenter.ShiftVideo(vf, offset),
+			Start:        offset,
+			SegmentCount: count,
+		})
+		offset += end
+	}
+	tl.Duration = offset
+	return tl, nil
+}
+
+// save writes assets to the file
+func (s *AssetService) save() error {
+	if s.file == "" {
+		return nil
+	}
+	assets := make([]*models.Asset, 0, len(s.assets))
+	for _, a := range s.assets {
+		assets = append(assets, a)
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i].Name < assets[j].Name })
+	if err := saveJSON(s.file, assets); err != nil {
+		return fmt.Errorf("failed to save assets: %w", err)
+	}
+	return nil
+}
+
+func copyAsset(a *models.Asset) models.Asset {
+	c := *a
+	c.Videos = append([]string{}, a.Videos...)
+	return c
+}
+
+// AssetTimeline is an asset with its videos opened
+type AssetTimeline struct {
+	Asset    models.Asset
+	Audio    bool // every video has audio, audio rendition is left out otherwise
+	Parts    []AssetPart
+	Duration time.Duration
+}
+
+// AssetPart is a video of an asset. Its segments are served under the part
+// number with their own init segment, codecs and timescales may differ
+type AssetPart struct {
+	Video        string
+	VideoFile    *VideoFile // shifted to Start
+	Start        time.Duration
+	SegmentCount int // segments played, audio covers all of them
+}
+
+// Part returns part n, nil when out of range
+func (t *AssetTimeline) Part(n int) *AssetPart {
+	if n < 0 || n >= len(t.Parts) {
+		return nil
+	}
+	return &t.Parts[n]
+}
+
+// Params returns stream parameters covering every video of the asset
+func (t *AssetTimeline) Params() VideoParams {
+	vfs := make([]*VideoFile, 0, len(t.Parts))
+	for _, p := range t.Parts {
+		vfs = append(vfs, p.VideoFile)
+	}
+	return mergeParams(vfs, t.Audio)
+}
+
+// ShiftVideo returns a view of vf whose timeline starts at offset. Segments
+// stay cut at the same samples, only their decode times move
+func (s *Segmenter) ShiftVideo(vf *VideoFile, offset time.Duration) *VideoFile {
+	if offset == 0 {
+		return vf
+	}
+	c := *vf
+	c.Offset = offset
+	c.VideoIndex, c.Segments = shiftTrack(vf.VideoIndex, vf.Segments, shiftTime(offset, vf.Timescale))
+	c.AudioTracks = make([]AudioTrack, len(vf.AudioTracks))
+	for n, t := range vf.AudioTracks {
+		if t.Index != nil {
+			t.Index, _ = shiftTrack(t.Index, nil, shiftTime(offset, t.Timescale))
+		}
+		c.AudioTracks[n] = t
+	}
+	if vf.AudioIndex != nil {
+		c.AudioIndex, c.AudioSegments = shiftTrack(vf.AudioIndex, vf.AudioSegments, shiftTime(offset, vf.AudioTimescale))
+	}
+	return &c
+}
+
+// shiftTime converts offset to timescale rounding up, so a shifted track
+// never starts before the previous one ends
+func shiftTime(offset time.Duration, timescale uint32) uint64 {
+	return (uint64(offset)*uint64(timescale) + uint64(time.Second) - 1) / uint64(time.Second)
+}
+
+func shiftTrack(idx *SampleIndex, segments []Segment, shift uint64) (*SampleIndex, []Segment) {
+	shifted := *idx
+	shifted.TimeShift += shift
+	moved := make([]Segment, len(segments))
+	for i, seg := range segments {
+		seg.StartTime += shift
+		moved[i] = seg
+	}
+	return &shifted, moved
+}
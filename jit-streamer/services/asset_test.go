@@ -0,0 +1,94 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"amka.ru/jit-streamer/config"
+)
+
+// TestAssetTimeline joins videos of different timescales and checks that
+// decode times keep increasing across joins
+func TestAssetTimeline(t *testing.T) {
+	videos := t.TempDir()
+	other := fixtureVideo()
+	other.timescale, other.sampleDur, other.sampleCount = 90000, 3600, 100
+	otherAudio := fixtureAudio()
+	otherAudio.timescale, otherAudio.sampleDur, otherAudio.sampleCount = 44100, 1024, 173
+	for name, tracks := range map[string][]fixtureTrack{
+		"intro":   {other, otherAudio},
+		"episode": {fixtureVideo(), fixtureAudio()},
+	} {
+		data, err := os.ReadFile(writeFixture(t, tracks...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(videos, name+".mp4"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seg := NewSegmenter(1, 0, 0)
+	t.Cleanup(seg.Close)
+	s, err := NewAssetService(NewVideoService(&config.Config{VideosPath: videos}), seg, NewRemuxer(t.TempDir(), seg), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put("show", []string{"intro", "missing"}); err == nil {
+		t.Error("asset with missing video accepted")
+	}
+	if _, err := s.Put("show", []string{"intro", "episode", "intro"}); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := s.Timeline("show")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tl.Parts) != 3 || !tl.Audio || tl.Duration != 14*time.Second {
+		t.Fatalf("%d parts of %v, audio %v", len(tl.Parts), tl.Duration, tl.Audio)
+	}
+
+	// Every segment starts where the previous one ends, in seconds
+	var videoEnd, audioEnd float64
+	for n, p := range tl.Parts {
+		vf := p.VideoFile
+		for i, sg := range vf.Segments[:p.SegmentCount] {
+			start := float64(sg.StartTime) / float64(vf.Timescale)
+			if start < videoEnd-1e-6 || start > videoEnd+1e-3 {
+				t.Errorf("video segment %d.%d starts at %.6f, previous ends at %.6f", n, i, start, videoEnd)
+			}
+			videoEnd = float64(sg.StartTime+sg.Duration) / float64(vf.Timescale)
+
+			data, err := seg.GenerateMediaSegment(vf, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tfdt := decodeFragment(t, data).Tfdt.BaseMediaDecodeTime(); tfdt != sg.StartTime {
+				t.Errorf("video segment %d.%d tfdt %d, want %d", n, i, tfdt, sg.StartTime)
+			}
+		}
+		for i, sg := range vf.AudioSegments[:p.SegmentCount] {
+			start := float64(sg.StartTime) / float64(vf.AudioTimescale)
+			// Audio frames do not end exactly at video joins
+			if start < audioEnd-0.03 || start > audioEnd+0.03 {
+				t.Errorf("audio segment %d.%d starts at %.6f, previous ends at %.6f", n, i, start, audioEnd)
+			}
+			audioEnd = float64(sg.StartTime+sg.Duration) / float64(vf.AudioTimescale)
+
+			data, err := seg.GenerateAudioMediaSegment(vf, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tfdt := decodeFragment(t, data).Tfdt.BaseMediaDecodeTime(); tfdt != sg.StartTime {
+				t.Errorf("audio segment %d.%d tfdt %d, want %d", n, i, tfdt, sg.StartTime)
+			}
+		}
+	}
+
+	// The same video twice in one asset plays different decode times
+	if tl.Parts[0].VideoFile.Segments[0].StartTime == tl.Parts[2].VideoFile.Segments[0].StartTime {
+		t.Error("repeated video is not shifted")
+	}
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// Sources may carry several audio tracks: the original, dubs, audio
+// description. All of them are indexed when the file is opened and clip and
+// shift views carry all of them. The Audio fields of VideoFile describe the
+// selected track, SelectAudio returns a view with another one selected and
+// audio segments cut for it at the video segment boundaries
+
+// ErrAudioNotFound is returned when a requested audio track does not exist
+var ErrAudioNotFound = errors.New("audio track not found")
+
+// AudioTrack is an audio track of the source
+type AudioTrack struct {
+	Trak       *mp4.TrakBox
+	Language   string // elng tag or mdhd code, empty when undetermined
+	Name       string // from udta, empty when unset
+	Role       string // "description", "commentary" or "dub" guessed from the name
+	Codec      string
+	Channels   uint16
+	Bitrate    uint32
+	Timescale  uint32
+	SampleRate uint32 // from the sample entry, Timescale when it has none
+	Duration   uint64
+	Index      *SampleIndex // nil when the track cannot be indexed
+}
+
+func newAudioTrack(trak *mp4.TrakBox) AudioTrack {
+	t := AudioTrack{Trak: trak, Name: trackName(trak)}
+	if mdhd := trak.Mdia.Mdhd; mdhd != nil {
+		t.Timescale = mdhd.Timescale
+		t.Duration = mdhd.Duration
+		t.Language = mdhd.GetLanguage()
+	}
+	if elng := trak.Mdia.Elng; elng != nil && elng.Language != "" {
+		t.Language = elng.Language
+	}
+	if t.Language == "und" {
+		t.Language = ""
+	}
+	t.Codec, t.Channels, t.Bitrate = extractAudioParams(trak)
+	t.SampleRate = audioSampleRate(trak, t.Timescale)
+
+	name := strings.ToLower(t.Name)
+	switch {
+	case strings.Contains(name, "descri"):
+		t.Role = "description"
+	case strings.Contains(name, "comment"):
+		t.Role = "commentary"
+	case strings.Contains(name, "dub"):
+		t.Role = "dub"
+	}
+	return t
+}
+
+// trackName returns the name box of the track user data
+func trackName(trak *mp4.TrakBox) string {
+	for _, child := range trak.Children {
+		udta, ok := child.(*mp4.UdtaBox)
+		if !ok {
+			continue
+		}
+		for _, box := range udta.Children {
+			if box.Type() != "name" {
+				continue
+			}
+			// Not decoded by mp4ff, the payload follows the box header
+			var buf bytes.Buffer
+			if err := box.Encode(&buf); err != nil || buf.Len() < 8 {
+				continue
+			}
+			return strings.TrimRight(string(buf.Bytes()[8:]), "\x00")
+		}
+	}
+	return ""
+}
+
+// defaultAudio returns the first enabled track, or the first one if all are
+// disabled
+func defaultAudio(tracks []AudioTrack) int {
+	for n, t := range tracks {
+		if t.Trak.Tkhd != nil && t.Trak.Tkhd.Flags&1 != 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// useAudio points the Audio fields of vf at track n. Audio segments are
+// left for the caller to build
+func (vf *VideoFile) useAudio(n int) {
+	t := vf.AudioTracks[n]
+	vf.AudioSelected = n
+	vf.AudioTrack, vf.AudioIndex = t.Trak, t.Index
+	vf.AudioTimescale, vf.AudioSampleRate, vf.AudioDuration = t.Timescale, t.SampleRate, t.Duration
+	vf.AudioCodec, vf.AudioChannels, vf.AudioBitrate = t.Codec, t.Channels, t.Bitrate
+}
+
+// audioSampleRate returns sampling rate of the audio sample entry of trak,
+// timescale when there is none. Sources muxed with a 90 kHz or other
+// timescale still play at the rate of the entry
+func audioSampleRate(trak *mp4.TrakBox, timescale uint32) uint32 {
+	if trak.Mdia.Minf == nil || trak.Mdia.Minf.Stbl == nil || trak.Mdia.Minf.Stbl.Stsd == nil {
+		return timescale
+	}
+	stsd := trak.Mdia.Minf.Stbl.Stsd
+	for _, entry := range []*mp4.AudioSampleEntryBox{stsd.Mp4a, stsd.AC3, stsd.EC3, stsd.Opus} {
+		if entry != nil && entry.SampleRate != 0 {
+			return uint32(entry.SampleRate)
+		}
+	}
+	return timescale
+}
+
+// SelectAudio returns a view of vf with audio track n selected
+func (s *Segmenter) SelectAudio(vf *VideoFile, n int) (*VideoFile, error) {
+	if n < 0 || n >= len(vf.AudioTracks) {
+		return nil, fmt.Errorf("%w: %d", ErrAudioNotFound, n)
+	}
+	if n == vf.AudioSelected {
+		return vf, nil
+	}
+	c := *vf
+	c.useAudio(n)
+	c.AudioSegments, c.AudioBandwidth = nil, 0
+	if c.AudioIndex == nil {
+		// Nothing of the track is left in a clip
+		c.AudioTrack = nil
+		return &c, nil
+	}
+	if err := s.buildAudioSegments(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// FindAudio returns the track selected by a track number or a language
+func FindAudio(vf *VideoFile, selection string) (int, error) {
+	if n, err := strconv.Atoi(selection); err == nil {
+		if n < 0 || n >= len(vf.AudioTracks) {
+			return 0, fmt.Errorf("%w: %d", ErrAudioNotFound, n)
+		}
+		return n, nil
+	}
+	for n, t := range vf.AudioTracks {
+		if strings.EqualFold(t.Language, selection) {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrAudioNotFound, selection)
+}
+
+// AudioQuery returns query string of URIs of audio track n: the view query
+// plus the track selection, which the default track goes without
+func AudioQuery(vf *VideoFile, n int) string {
+	q := viewValues(vf)
+	if n != vf.AudioDefault {
+		q.Set("audio", strconv.Itoa(n))
+	}
+	return encodeQuery(q)
+}
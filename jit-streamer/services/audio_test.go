@@ -0,0 +1,150 @@
+package services
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// TestAudioTracks checks that every audio track is kept, selected by number
+// or language and that selection commutes with clipping
+func TestAudioTracks(t *testing.T) {
+	eng, swe := fixtureAudio(), fixtureAudio()
+	eng.language, swe.language = "eng", "swe"
+	s, vf := openFixture(t, fixtureVideo(), eng, swe)
+
+	if len(vf.AudioTracks) != 2 || vf.AudioTracks[0].Language != "eng" || vf.AudioTracks[1].Language != "swe" {
+		t.Fatalf("audio tracks %+v", vf.AudioTracks)
+	}
+	if vf.AudioSelected != 0 || vf.AudioDefault != 0 || vf.AudioTrack != vf.AudioTracks[0].Trak {
+		t.Fatalf("first track is not selected by default")
+	}
+	if n, err := FindAudio(vf, "SWE"); err != nil || n != 1 {
+		t.Errorf("FindAudio(swe) = %d, %v", n, err)
+	}
+	for _, sel := range []string{"2", "fin"} {
+		if _, err := FindAudio(vf, sel); err == nil {
+			t.Errorf("FindAudio(%s) found a track", sel)
+		}
+	}
+
+	second, err := s.SelectAudio(vf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.AudioIndex != vf.AudioTracks[1].Index || second.VideoIndex != vf.VideoIndex {
+		t.Fatal("selected view does not use the second track")
+	}
+	if !reflect.DeepEqual(second.Segments, vf.Segments) || len(second.AudioSegments) != len(vf.AudioSegments) {
+		t.Errorf("selection changed segmenting")
+	}
+	first, err := s.GenerateAudioMediaSegment(vf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.GenerateAudioMediaSegment(second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, data) {
+		t.Error("audio segments of both tracks are the same")
+	}
+	if q := AudioQuery(second, 1); q != "?audio=1" {
+		t.Errorf("query of the second track %q", q)
+	}
+	if q := AudioQuery(second, 0); q != "" {
+		t.Errorf("query of the default track %q", q)
+	}
+
+	clip := &Clip{Start: 2 * time.Second}
+	clipped, err := s.ClipVideo(vf, clip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selectThenClip, err := s.ClipVideo(second, clip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clipThenSelect, err := s.SelectAudio(clipped, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(selectThenClip.AudioSegments, clipThenSelect.AudioSegments) {
+		t.Errorf("clip of selection %+v, selection of clip %+v", selectThenClip.AudioSegments, clipThenSelect.AudioSegments)
+	}
+	if q := AudioQuery(clipThenSelect, 1); q != "?audio=1&start=2" {
+		t.Errorf("query of the second track of clip %q", q)
+	}
+}
+
+// TestAudioRendition checks that audio init and media segments carry the
+// audio track alone, cut where video segments start, and that sampling rate
+// comes from the sample entry of a track muxed with a 90 kHz timescale
+func TestAudioRendition(t *testing.T) {
+	audio := fixtureAudio()
+	audio.timescale, audio.sampleDur, audio.sampleRate = 90000, 1920, 48000
+	s, vf := openFixture(t, fixtureVideo(), audio)
+
+	if vf.AudioTimescale != 90000 || vf.AudioSampleRate != 48000 {
+		t.Fatalf("audio timescale %d at %d Hz, want 90000 at 48000 Hz", vf.AudioTimescale, vf.AudioSampleRate)
+	}
+	params := VideoParams{Codec: vf.VideoCodec, Width: vf.Width, Height: vf.Height, Timescale: vf.Timescale, Bandwidth: vf.Bandwidth, Audio: periodAudio(vf)}
+	mpd, err := NewManifestService(1).GenerateDASHMPD("movie", 6, vf.Segments, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(mpd, `audioSamplingRate="48000"`) {
+		t.Error("MPD does not publish the sampling rate of the sample entry")
+	}
+
+	data, err := s.GenerateAudioInitSegment(vf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	init, err := mp4.DecodeFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	traks := init.Init.Moov.Traks
+	if len(traks) != 1 || traks[0].Mdia.Hdlr.HandlerType != "soun" {
+		t.Fatalf("audio init segment has %d tracks", len(traks))
+	}
+	trackID := traks[0].Tkhd.TrackID
+
+	if len(vf.AudioSegments) != len(vf.Segments) {
+		t.Fatalf("%d audio segments for %d video segments", len(vf.AudioSegments), len(vf.Segments))
+	}
+	for i, seg := range vf.AudioSegments {
+		// Audio starts with the first frame at or after the video segment
+		cut := rescaleTime(vf.Segments[i].StartTime, vf.Timescale, vf.AudioTimescale)
+		if seg.StartTime < cut || seg.StartTime-cut >= uint64(audio.sampleDur) {
+			t.Errorf("audio segment %d starts at %d, video at %d", i, seg.StartTime, cut)
+		}
+
+		data, err := s.GenerateAudioMediaSegment(vf, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := mp4.DecodeFile(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(f.Segments) != 1 || len(f.Segments[0].Fragments) != 1 {
+			t.Fatalf("audio segment %d is not a single fragment", i)
+		}
+		moof := f.Segments[0].Fragments[0].Moof
+		if len(moof.Trafs) != 1 || moof.Traf.Tfhd.TrackID != trackID {
+			t.Fatalf("audio segment %d has %d tracks", i, len(moof.Trafs))
+		}
+		if tfdt := moof.Traf.Tfdt.BaseMediaDecodeTime(); tfdt != seg.StartTime {
+			t.Errorf("audio segment %d tfdt %d, want %d", i, tfdt, seg.StartTime)
+		}
+		if n := moof.Traf.Trun.SampleCount(); n != seg.EndSample-seg.StartSample {
+			t.Errorf("audio segment %d has %d samples, want %d", i, n, seg.EndSample-seg.StartSample)
+		}
+	}
+}
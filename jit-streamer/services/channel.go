@@ -0,0 +1,395 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"amka.ru/jit-streamer/models"
+)
+
+// ChannelWindow is how far back channel playlists reach
+const ChannelWindow = time.Minute
+
+var (
+	ErrChannelNotFound = errors.New("channel not found")
+	ErrInvalidSchedule = errors.New("invalid schedule")
+)
+
+// ChannelService keeps schedules of linear channels. A channel plays its
+// videos in a loop driven by wall clock, segments are the VOD segments of
+// the videos, so they are cached and generated like any other
+type ChannelService struct {
+	videoService *VideoService
+	segmenter    *Segmenter
+	remuxer      *Remuxer
+	file         string // channels are saved to this JSON file, empty keeps them in memory
+	now          func() time.Time
+
+	mu       sync.Mutex
+	channels map[string]*models.Channel
+}
+
+func NewChannelService(vs *VideoService, seg *Segmenter, rm *Remuxer, file string) (*ChannelService, error) {
+	s := &ChannelService{
+		videoService: vs,
+		segmenter:    seg,
+		remuxer:      rm,
+		file:         file,
+		now:          time.Now,
+		channels:     make(map[string]*models.Channel),
+	}
+	if file == "" {
+		return s, nil
+	}
+	var channels []*models.Channel
+	if err := loadJSON(file, &channels); err != nil {
+		return nil, fmt.Errorf("failed to load channels: %w", err)
+	}
+	for _, ch := range channels {
+		s.channels[ch.Name] = ch
+	}
+	return s, nil
+}
+
+// List returns all channels sorted by name
+func (s *ChannelService) List() []models.Channel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := make([]models.Channel, 0, len(s.channels))
+	for _, ch := range s.channels {
+		channels = append(channels, copyChannel(ch))
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	return channels
+}
+
+func (s *ChannelService) Get(name string) (models.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch, ok := s.channels[name]
+	if !ok {
+		return models.Channel{}, ErrChannelNotFound
+	}
+	return copyChannel(ch), nil
+}
+
+// Put creates the channel or replaces its schedule. A new channel starts
+// one window in the past, so its playlists are full at once. A new schedule
+// of a running channel starts after the segment playing now, segments
+// already published never change
+func (s *ChannelService) Put(name string, videos []string) (models.Channel, error) {
+	if len(videos) == 0 {
+		return models.Channel{}, fmt.Errorf("%w: no videos", ErrInvalidSchedule)
+	}
+	for _, video := range videos {
+		if _, err := s.openScheduled(video); err != nil {
+			return models.Channel{}, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	ch, ok := s.channels[name]
+	if !ok {
+		created := now.Add(-ChannelWindow).Truncate(time.Second)
+		ch = &models.Channel{
+			Name:      name,
+			Created:   created,
+			Schedules: []models.ChannelSchedule{{Start: created}},
+		}
+	} else {
+		ch = &models.Channel{Name: ch.Name, Created: ch.Created, Schedules: append([]models.ChannelSchedule{}, ch.Schedules...)}
+		tl, err := s.timeline(*ch)
+		if err != nil {
+			return models.Channel{}, err
+		}
+		current := tl.loops[len(tl.loops)-1]
+		if !now.Before(current.Start) {
+			seg := current.segment(current.slotAt(now))
+			ch.Schedules = append(ch.Schedules, models.ChannelSchedule{
+				Start:              seg.Start.Add(seg.Duration),
+				FirstSequence:      seg.Sequence + 1,
+				FirstDiscontinuity: seg.Occurrence + 1,
+			})
+		}
+		// Otherwise the last edit has not started yet and is replaced
+
+		// Schedules that ended before the window are not needed anymore
+		from := now.Add(-ChannelWindow)
+		for len(ch.Schedules) > 1 && !ch.Schedules[1].Start.After(from) {
+			ch.Schedules = ch.Schedules[1:]
+		}
+	}
+	ch.Videos = append([]string{}, videos...)
+	ch.Schedules[len(ch.Schedules)-1].Videos = ch.Videos
+
+	s.channels[name] = ch
+	if err := s.save(); err != nil {
+		return models.Channel{}, err
+	}
+	return copyChannel(ch), nil
+}
+
+func (s *ChannelService) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.channels[name]; !ok {
+		return ErrChannelNotFound
+	}
+	delete(s.channels, name)
+	return s.save()
+}
+
+// Timeline opens the scheduled videos of the channel
+func (s *ChannelService) Timeline(name string) (*ChannelTimeline, error) {
+	ch, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.timeline(ch)
+}
+
+func (s *ChannelService) timeline(ch models.Channel) (*ChannelTimeline, error) {
+	tl := &ChannelTimeline{Channel: ch, Audio: true}
+	for i, sched := range ch.Schedules {
+		loop := &channelLoop{ChannelSchedule: sched}
+		if i+1 < len(ch.Schedules) {
+			loop.end = ch.Schedules[i+1].Start
+		}
+		for v, name := range sched.Videos {
+			vf, err := s.openScheduled(name)
+			if err != nil {
+				return nil, err
+			}
+			tl.Audio = tl.Audio && vf.AudioTrack != nil
+			loop.videos = append(loop.videos, channelVideo{name: name, vf: vf, offset: loop.length})
+			for seg := 0; seg < playedSegmentCount(vf); seg++ {
+				dur := time.Duration(vf.Segments[seg].Duration) * time.Second / time.Duration(vf.Timescale)
+				loop.slots = append(loop.slots, channelSlot{video: v, segment: seg, offset: loop.length, duration: dur})
+				loop.length += dur
+			}
+		}
+		if loop.length <= 0 {
+			return nil, fmt.Errorf("%w: schedule of channel %s is empty", ErrInvalidSchedule, ch.Name)
+		}
+		tl.loops = append(tl.loops, loop)
+	}
+	return tl, nil
+}
+
+// openScheduled opens a video of a schedule. Live sources cannot be looped,
+// their segments are not known in advance
+func (s *ChannelService) openScheduled(name string) (*VideoFile, error) {
+	return openListed(s.videoService, s.remuxer, s.segmenter, name, ErrInvalidSchedule)
+}
+
+// openListed opens a video listed by a channel or an asset by name. Errors
+// of the list itself wrap invalid
+func openListed(vs *VideoService, rm *Remuxer, seg *Segmenter, name string, invalid error) (*VideoFile, error) {
+	path, err := vs.GetVideoPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", invalid, err)
+	}
+	src, err := rm.Source(path)
+	if err != nil {
+		return nil, err
+	}
+	vf, err := seg.OpenVideo(src)
+	if err != nil {
+		return nil, err
+	}
+	if vf.Live {
+		return nil, fmt.Errorf("%w: video %s is live", invalid, name)
+	}
+	if playedSegmentCount(vf) == 0 || vf.Timescale == 0 {
+		return nil, fmt.Errorf("%w: video %s has no segments", invalid, name)
+	}
+	return vf, nil
+}
+
+// playedSegmentCount returns number of segments a video plays for. Audio
+// has to cover every played segment
+func playedSegmentCount(vf *VideoFile) int {
+	if vf.AudioTrack != nil && len(vf.AudioSegments) < len(vf.Segments) {
+		return len(vf.AudioSegments)
+	}
+	return len(vf.Segments)
+}
+
+// save writes channels to the file
+func (s *ChannelService) save() error {
+	if s.file == "" {
+		return nil
+	}
+	channels := make([]*models.Channel, 0, len(s.channels))
+	for _, ch := range s.channels {
+		channels = append(channels, ch)
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	if err := saveJSON(s.file, channels); err != nil {
+		return fmt.Errorf("failed to save channels: %w", err)
+	}
+	return nil
+}
+
+func copyChannel(ch *models.Channel) models.Channel {
+	c := *ch
+	c.Videos = append([]string{}, ch.Videos...)
+	c.Schedules = append([]models.ChannelSchedule{}, ch.Schedules...)
+	return c
+}
+
+// ChannelTimeline maps wall clock onto segments of the scheduled videos
+type ChannelTimeline struct {
+	Channel models.Channel
+	Audio   bool // every scheduled video has audio, audio rendition is left out otherwise
+	loops   []*channelLoop
+}
+
+// ChannelSegment is one segment of the channel, a segment of a scheduled video
+type ChannelSegment struct {
+	Video      string // name of the scheduled video
+	VideoFile  *VideoFile
+	Index      int    // segment number in the video
+	Sequence   uint64 // media sequence number in the channel
+	Occurrence uint64 // number of the video occurrence, grows at every video boundary
+	Start      time.Time
+	Duration   time.Duration
+	VideoStart time.Time // wall clock time of the first segment of the occurrence
+}
+
+// channelLoop is a schedule with its videos opened
+type channelLoop struct {
+	models.ChannelSchedule
+	end    time.Time // start of the next schedule, zero for the current one
+	videos []channelVideo
+	slots  []channelSlot
+	length time.Duration
+}
+
+type channelVideo struct {
+	name   string
+	vf     *VideoFile
+	offset time.Duration // start in the loop
+}
+
+type channelSlot struct {
+	video    int
+	segment  int
+	offset   time.Duration // start in the loop
+	duration time.Duration
+}
+
+// slotAt returns number of the slot playing at t, counted from the start
+// of the schedule
+func (l *channelLoop) slotAt(t time.Time) uint64 {
+	elapsed := t.Sub(l.Start)
+	if elapsed < 0 {
+		return 0
+	}
+	loop := uint64(elapsed / l.length)
+	pos := elapsed % l.length
+	s := sort.Search(len(l.slots), func(i int) bool { return l.slots[i].offset > pos }) - 1
+	return loop*uint64(len(l.slots)) + uint64(s)
+}
+
+func (l *channelLoop) segment(k uint64) ChannelSegment {
+	loop, s := k/uint64(len(l.slots)), k%uint64(len(l.slots))
+	slot := l.slots[s]
+	video := l.videos[slot.video]
+	loopStart := l.Start.Add(time.Duration(loop) * l.length)
+	return ChannelSegment{
+		Video:      video.name,
+		VideoFile:  video.vf,
+		Index:      slot.segment,
+		Sequence:   l.FirstSequence + k,
+		Occurrence: l.FirstDiscontinuity + loop*uint64(len(l.videos)) + uint64(slot.video),
+		Start:      loopStart.Add(slot.offset),
+		Duration:   slot.duration,
+		VideoStart: loopStart.Add(video.offset),
+	}
+}
+
+// Window returns segments that ended by now and not before the window
+func (t *ChannelTimeline) Window(now time.Time) []ChannelSegment {
+	from := now.Add(-ChannelWindow)
+	var segments []ChannelSegment
+	for _, l := range t.loops {
+		start, end := from, now
+		if start.Before(l.Start) {
+			start = l.Start
+		}
+		if !l.end.IsZero() && l.end.Before(end) {
+			end = l.end
+		}
+		if !start.Before(end) {
+			continue
+		}
+		// Slot at end is still playing or belongs to the next schedule
+		for k, last := l.slotAt(start), l.slotAt(end); k < last; k++ {
+			segments = append(segments, l.segment(k))
+		}
+	}
+	return segments
+}
+
+// TargetDuration returns the longest segment of all schedules in seconds
+func (t *ChannelTimeline) TargetDuration() int {
+	var longest time.Duration
+	for _, l := range t.loops {
+		for _, slot := range l.slots {
+			longest = max(longest, slot.duration)
+		}
+	}
+	return int((longest + time.Second - 1) / time.Second)
+}
+
+// Params returns stream parameters covering every video of the current
+// schedule
+func (t *ChannelTimeline) Params() VideoParams {
+	current := t.loops[len(t.loops)-1]
+	vfs := make([]*VideoFile, 0, len(current.videos))
+	for _, video := range current.videos {
+		vfs = append(vfs, video.vf)
+	}
+	return mergeParams(vfs, t.Audio)
+}
+
+// mergeParams returns stream parameters covering videos played one after
+// another: all codecs, the largest picture and the highest bitrate
+func mergeParams(vfs []*VideoFile, audio bool) VideoParams {
+	var params VideoParams
+	seen := make(map[string]bool)
+	for _, vf := range vfs {
+		if !seen[vf.VideoCodec] {
+			seen[vf.VideoCodec] = true
+			if params.Codec != "" {
+				params.Codec += ","
+			}
+			params.Codec += vf.VideoCodec
+		}
+		params.Width = max(params.Width, vf.Width)
+		params.Height = max(params.Height, vf.Height)
+		params.Bandwidth = max(params.Bandwidth, vf.Bandwidth)
+		if !audio {
+			continue
+		}
+		if params.Audio == nil {
+			params.Audio = &AudioParams{Codec: vf.AudioCodec, Timescale: vf.AudioTimescale, SampleRate: vf.AudioSampleRate}
+		}
+		params.Audio.Channels = max(params.Audio.Channels, vf.AudioChannels)
+		params.Audio.Bandwidth = max(params.Audio.Bandwidth, vf.AudioBandwidth, vf.AudioBitrate)
+	}
+	if params.Audio != nil && params.Audio.Bandwidth == 0 {
+		params.Audio.Bandwidth = 128000
+	}
+	return params
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"amka.ru/jit-streamer/config"
+)
+
+// checkChannelWindow checks that segments follow each other without gaps
+// and that a new occurrence starts exactly at the first segment of a video
+func checkChannelWindow(t *testing.T, segments []ChannelSegment) {
+	t.Helper()
+	if len(segments) == 0 {
+		t.Fatal("empty window")
+	}
+	for i := 1; i < len(segments); i++ {
+		prev, seg := segments[i-1], segments[i]
+		if seg.Sequence != prev.Sequence+1 {
+			t.Errorf("sequence %d follows %d", seg.Sequence, prev.Sequence)
+		}
+		if !seg.Start.Equal(prev.Start.Add(prev.Duration)) {
+			t.Errorf("segment %d starts at %v, previous ends at %v", seg.Sequence, seg.Start, prev.Start.Add(prev.Duration))
+		}
+		newVideo := seg.Occurrence != prev.Occurrence
+		if newVideo && (seg.Occurrence != prev.Occurrence+1 || seg.Index != 0 || !seg.VideoStart.Equal(seg.Start)) {
+			t.Errorf("segment %d starts occurrence %d at index %d", seg.Sequence, seg.Occurrence, seg.Index)
+		}
+		if !newVideo && (seg.Video != prev.Video || seg.Index != prev.Index+1) {
+			t.Errorf("segment %d continues %s/%d with %s/%d", seg.Sequence, prev.Video, prev.Index, seg.Video, seg.Index)
+		}
+	}
+}
+
+func TestChannelSchedule(t *testing.T) {
+	videos := t.TempDir()
+	short := fixtureVideo()
+	short.sampleCount = 100
+	shortAudio := fixtureAudio()
+	shortAudio.sampleCount = 188
+	for name, tracks := range map[string][]fixtureTrack{
+		"a": {fixtureVideo(), fixtureAudio()},
+		"b": {short, shortAudio},
+	} {
+		data, err := os.ReadFile(writeFixture(t, tracks...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(videos, name+".mp4"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vs := NewVideoService(&config.Config{VideosPath: videos})
+	seg := NewSegmenter(1, 0, 0)
+	t.Cleanup(seg.Close)
+	file := filepath.Join(t.TempDir(), "channels.json")
+	s, err := NewChannelService(vs, seg, NewRemuxer(t.TempDir(), seg), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	if _, err := s.Put("news", []string{"a", "missing"}); err == nil {
+		t.Error("schedule with missing video accepted")
+	}
+	if _, err := s.Put("news", []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := s.Timeline("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tl.Audio {
+		t.Error("channel has no audio")
+	}
+	before := tl.Window(now)
+	checkChannelWindow(t, before)
+	if before[0].Sequence != 0 || before[0].Occurrence != 0 {
+		t.Errorf("new channel starts at sequence %d, occurrence %d", before[0].Sequence, before[0].Occurrence)
+	}
+	// a plays 6 segments and b 4 in a 10 s loop, the window is 6 loops
+	if len(before) != 60 || before[6].Video != "b" || before[10].Occurrence != 2 {
+		t.Errorf("window of %d segments, segment 6 from %s, segment 10 in occurrence %d",
+			len(before), before[6].Video, before[10].Occurrence)
+	}
+
+	// Edit in the middle of a segment takes effect after it
+	now = now.Add(2500 * time.Millisecond)
+	if _, err := s.Put("news", []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	ch, _ := s.Get("news")
+	next := ch.Schedules[len(ch.Schedules)-1]
+	if want := time.Date(2026, 1, 1, 12, 0, 3, 0, time.UTC); !next.Start.Equal(want) {
+		t.Errorf("new schedule starts at %v, want %v", next.Start, want)
+	}
+
+	now = now.Add(20 * time.Second)
+	if tl, err = s.Timeline("news"); err != nil {
+		t.Fatal(err)
+	}
+	after := tl.Window(now)
+	checkChannelWindow(t, after)
+
+	// Published segments stay the same, the new schedule plays b only
+	published := make(map[uint64]ChannelSegment)
+	for _, seg := range before {
+		published[seg.Sequence] = seg
+	}
+	switched := false
+	for _, seg := range after {
+		if old, ok := published[seg.Sequence]; ok && !reflect.DeepEqual(old, seg) {
+			t.Errorf("segment %d changed from %+v to %+v", seg.Sequence, old, seg)
+		}
+		if seg.Start.Before(next.Start) {
+			continue
+		}
+		if !switched && (seg.Sequence != next.FirstSequence || seg.Occurrence != next.FirstDiscontinuity || seg.Index != 0) {
+			t.Errorf("new schedule starts with segment %d of occurrence %d, want %d of %d",
+				seg.Sequence, seg.Occurrence, next.FirstSequence, next.FirstDiscontinuity)
+		}
+		switched = true
+		if seg.Video != "b" {
+			t.Errorf("segment %d of new schedule from %s", seg.Sequence, seg.Video)
+		}
+	}
+	if !switched {
+		t.Error("new schedule not in window")
+	}
+
+	// Schedules survive restart
+	reloaded, err := NewChannelService(vs, seg, NewRemuxer(t.TempDir(), seg), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := reloaded.Get("news"); err != nil || !reflect.DeepEqual(got, ch) {
+		t.Errorf("reloaded channel %+v (%v), want %+v", got, err, ch)
+	}
+}
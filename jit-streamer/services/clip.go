@@ -0,0 +1,303 @@
+package services
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxClipViews bounds the number of clip views kept between requests
+const maxClipViews = 256
+
+// ErrInvalidClip is returned for clip ranges that cannot be parsed or lie
+// outside of the video
+var ErrInvalidClip = errors.New("invalid clip")
+
+// Clip is a time range of a source served as a stream of its own. It starts
+// at the keyframe at or before Start and times are rebased to zero, so its
+// segments differ from the segments of the whole file
+type Clip struct {
+	Start time.Duration
+	End   time.Duration // 0 runs to the end of the video
+}
+
+// ParseClip parses start and end given as seconds (750, 750.5) or clock
+// time (12:30, 00:12:30.5). It returns nil when both are empty
+func ParseClip(start, end string) (*Clip, error) {
+	if start == "" && end == "" {
+		return nil, nil
+	}
+	clip := &Clip{}
+	var err error
+	if start != "" {
+		if clip.Start, err = parseClipTime(start); err != nil {
+			return nil, err
+		}
+	}
+	if end != "" {
+		if clip.End, err = parseClipTime(end); err != nil {
+			return nil, err
+		}
+		if clip.End <= clip.Start {
+			return nil, fmt.Errorf("%w: end %s is not after start %s", ErrInvalidClip, end, start)
+		}
+	}
+	return clip, nil
+}
+
+func parseClipTime(s string) (time.Duration, error) {
+	var total float64
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("%w: bad time %q", ErrInvalidClip, s)
+	}
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 || (i > 0 && v >= 60) || (i < len(parts)-1 && strings.Contains(part, ".")) {
+			return 0, fmt.Errorf("%w: bad time %q", ErrInvalidClip, s)
+		}
+		total = total*60 + v
+	}
+	return time.Duration(total * float64(time.Second)), nil
+}
+
+// String identifies the clip in cache keys
+func (c *Clip) String() string {
+	return fmt.Sprintf("%s-%s", formatClipTime(c.Start), formatClipTime(c.End))
+}
+
+// Query returns the query string that selects the clip, manifests append
+// it to every URI
+func (c *Clip) Query() string {
+	return "?" + c.values().Encode()
+}
+
+func (c *Clip) values() url.Values {
+	q := url.Values{}
+	q.Set("start", formatClipTime(c.Start))
+	if c.End > 0 {
+		q.Set("end", formatClipTime(c.End))
+	}
+	return q
+}
+
+// ViewQuery returns query string of URIs in manifests of vf: sub-clip and
+// encryption scheme of the view
+func ViewQuery(vf *VideoFile) string {
+	return encodeQuery(viewValues(vf))
+}
+
+func viewValues(vf *VideoFile) url.Values {
+	q := url.Values{}
+	if vf.Clip != nil {
+		q = vf.Clip.values()
+	}
+	if vf.Encryption != "" {
+		q.Set("encryption", vf.Encryption)
+	}
+	if vf.Token != "" {
+		q.Set("token", vf.Token)
+	}
+	return q
+}
+
+func encodeQuery(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	return "?" + q.Encode()
+}
+
+func formatClipTime(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// ClipVideo returns a view of vf limited to the clip. The view shares sample
+// data with vf. Building it takes time linear in the samples of vf, so views
+// are kept for later requests of the same clip of the same source
+func (s *Segmenter) ClipVideo(vf *VideoFile, clip *Clip) (*VideoFile, error) {
+	if vf.Live {
+		return nil, fmt.Errorf("%w: clips of live sources are not supported", ErrInvalidClip)
+	}
+	key := clipViewKey{vf.Path, vf.ModTime.UnixNano(), vf.Size, vf.AudioSelected, clip.String()}
+	if c, ok := s.clips.get(key); ok {
+		return withView(c, vf), nil
+	}
+	c, err := s.clipVideo(vf, clip)
+	if err != nil {
+		return nil, err
+	}
+	s.clips.add(key, c)
+	return c, nil
+}
+
+// withView returns c with offset, encryption and token of the view vf
+func withView(c, vf *VideoFile) *VideoFile {
+	if c.Offset == vf.Offset && c.Encryption == vf.Encryption && c.Token == vf.Token {
+		return c
+	}
+	v := *c
+	v.Offset, v.Encryption, v.Token = vf.Offset, vf.Encryption, vf.Token
+	return &v
+}
+
+func (s *Segmenter) clipVideo(vf *VideoFile, clip *Clip) (*VideoFile, error) {
+	idx := vf.VideoIndex
+	count := uint32(idx.SampleCount())
+
+	startTime := uint64(clip.Start) * uint64(vf.Timescale) / uint64(time.Second)
+	if startTime >= idx.Time(count+1) {
+		return nil, fmt.Errorf("%w: %s is outside of the video", ErrInvalidClip, clip)
+	}
+	first := uint32(1)
+	if k := idx.KeyframeAt(startTime + 1); k > 0 {
+		// Last keyframe at or before start
+		first = idx.Keyframes[k-1]
+	}
+	end := count + 1
+	if clip.End > 0 {
+		end = idx.SampleAt(uint64(clip.End) * uint64(vf.Timescale) / uint64(time.Second))
+	}
+	if first >= end || first > count {
+		return nil, fmt.Errorf("%w: %s is outside of the video", ErrInvalidClip, clip)
+	}
+
+	c := *vf
+	c.Clip = clip
+	origin := idx.Time(first)
+	c.ClipOrigin = origin
+	c.VideoIndex = idx.slice(first, end, origin)
+	c.Duration = c.VideoIndex.Time(end - first + 1)
+	c.AudioTracks = make([]AudioTrack, len(vf.AudioTracks))
+	for n, t := range vf.AudioTracks {
+		if t.Index != nil {
+			// Audio keeps its position relative to video
+			track := *vf
+			track.useAudio(n)
+			t.Index, t.Duration = clipAudio(&track, first, end, origin)
+		}
+		c.AudioTracks[n] = t
+	}
+	if len(c.AudioTracks) > 0 {
+		c.useAudio(vf.AudioSelected)
+		if c.AudioIndex == nil {
+			c.AudioTrack, c.AudioSegments = nil, nil
+		}
+	}
+	if err := s.buildSegments(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// clipViewKey identifies a clip of a source file as it was opened, with the
+// audio track selected
+type clipViewKey struct {
+	path    string
+	modTime int64
+	size    int64
+	audio   int
+	clip    string
+}
+
+// clipViews keeps clip views, least recently used first out
+type clipViews struct {
+	mu    sync.Mutex
+	ll    *list.List
+	items map[clipViewKey]*list.Element
+}
+
+type clipViewEntry struct {
+	key clipViewKey
+	vf  *VideoFile
+}
+
+func newClipViews() *clipViews {
+	return &clipViews{ll: list.New(), items: make(map[clipViewKey]*list.Element)}
+}
+
+func (v *clipViews) get(key clipViewKey) (*VideoFile, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	el, ok := v.items[key]
+	if !ok {
+		return nil, false
+	}
+	v.ll.MoveToFront(el)
+	return el.Value.(*clipViewEntry).vf, true
+}
+
+func (v *clipViews) add(key clipViewKey, vf *VideoFile) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if el, ok := v.items[key]; ok {
+		v.ll.MoveToFront(el)
+		return
+	}
+	v.items[key] = v.ll.PushFront(&clipViewEntry{key, vf})
+	for v.ll.Len() > maxClipViews {
+		el := v.ll.Back()
+		v.ll.Remove(el)
+		delete(v.items, el.Value.(*clipViewEntry).key)
+	}
+}
+
+// remove drops views of the source at path
+func (v *clipViews) remove(path string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key, el := range v.items {
+		if key.path == path {
+			v.ll.Remove(el)
+			delete(v.items, key)
+		}
+	}
+}
+
+// clipAudio returns index of the selected audio track of vf cut where video
+// samples [first, end) are presented and its duration. The index is nil
+// when no audio is left
+func clipAudio(vf *VideoFile, first, end uint32, origin uint64) (*SampleIndex, uint64) {
+	idx := vf.AudioIndex
+	audioFirst := idx.SampleAt(audioCutTime(vf, first))
+	audioEnd := uint32(idx.SampleCount() + 1)
+	if int(end) <= vf.VideoIndex.SampleCount() {
+		audioEnd = idx.SampleAt(audioCutTime(vf, end))
+	}
+	if audioFirst >= audioEnd {
+		return nil, 0
+	}
+	sub := idx.slice(audioFirst, audioEnd, rescaleTime(origin, vf.Timescale, vf.AudioTimescale))
+	return sub, sub.Time(audioEnd - audioFirst + 1)
+}
+
+// slice returns index of samples [start, end) on a timeline starting at
+// origin. Sample tables are shared with idx
+func (idx *SampleIndex) slice(start, end uint32, origin uint64) *SampleIndex {
+	sub := &SampleIndex{
+		DecodeTimes: make([]uint64, 0, end-start+1),
+		Offsets:     idx.Offsets[start-1 : end-1],
+		Sizes:       idx.Sizes[start-1 : end-1],
+		CTOShift:    idx.CTOShift,
+	}
+	base := idx.DecodeTimes[start-1]
+	for _, t := range idx.DecodeTimes[start-1 : end] {
+		sub.DecodeTimes = append(sub.DecodeTimes, t-base)
+	}
+	if t := idx.Time(start); t > origin {
+		sub.TimeShift = t - origin
+	}
+	if idx.CTOs != nil {
+		sub.CTOs = idx.CTOs[start-1 : end-1]
+	}
+	if idx.Sync != nil {
+		sub.Sync = idx.Sync[start-1 : end-1]
+	}
+	sub.indexKeyframes()
+	return sub
+}
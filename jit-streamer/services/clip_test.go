@@ -0,0 +1,99 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseClip(t *testing.T) {
+	for _, tc := range []struct {
+		start, end string
+		want       *Clip
+	}{
+		{"", "", nil},
+		{"750", "", &Clip{Start: 750 * time.Second}},
+		{"12:30", "00:12:30.5", &Clip{Start: 750 * time.Second, End: 750500 * time.Millisecond}},
+		{"", "1:00:00", &Clip{End: time.Hour}},
+	} {
+		got, err := ParseClip(tc.start, tc.end)
+		if err != nil || (got == nil) != (tc.want == nil) || (got != nil && *got != *tc.want) {
+			t.Errorf("ParseClip(%q, %q) = %+v, %v, want %+v", tc.start, tc.end, got, err, tc.want)
+		}
+	}
+	for _, tc := range [][2]string{{"x", ""}, {"-1", ""}, {"1:60", ""}, {"1.5:00", ""}, {"1:2:3:4", ""}, {"10", "5"}, {"10", "10"}} {
+		if _, err := ParseClip(tc[0], tc[1]); !errors.Is(err, ErrInvalidClip) {
+			t.Errorf("ParseClip(%q, %q) error %v, want ErrInvalidClip", tc[0], tc[1], err)
+		}
+	}
+}
+
+// TestClipVideo checks that a clip starts at the keyframe before its start,
+// is rebased to zero and carries the same samples as the whole file
+func TestClipVideo(t *testing.T) {
+	s, vf := openFixture(t, fixtureVideo(), fixtureAudio())
+
+	clip := &Clip{Start: 2500 * time.Millisecond, End: 4500 * time.Millisecond}
+	c, err := s.ClipVideo(vf, clip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keyframe at 2 s is sample 51, sample 114 is the first at or after 4.5 s
+	const first, end = 51, 114
+	if n := c.VideoIndex.SampleCount(); n != end-first {
+		t.Fatalf("clip has %d video samples, want %d", n, end-first)
+	}
+	if len(c.Segments) == 0 || c.Segments[0].StartTime != 0 || !c.VideoIndex.IsSync(1) {
+		t.Fatalf("clip does not start with a keyframe at 0: %+v", c.Segments)
+	}
+	if want := vf.VideoIndex.Time(end) - vf.VideoIndex.Time(first); c.VideoIndex.Time(end-first+1) != want {
+		t.Errorf("clip video ends at %d, want %d", c.VideoIndex.Time(end-first+1), want)
+	}
+
+	last := c.Segments[len(c.Segments)-1]
+	_, data, err := s.readSamples(c, c.VideoIndex, 1, last.EndSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, want, err := s.readSamples(vf, vf.VideoIndex, first, first+last.EndSample-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Error("clip video samples differ from the source")
+	}
+
+	// Audio starts with the video and ends with it
+	audioStart := c.AudioIndex.Time(1) * uint64(vf.Timescale) / uint64(vf.AudioTimescale)
+	if audioStart > uint64(vf.Timescale)/10 {
+		t.Errorf("clip audio starts at %d, video at 0", audioStart)
+	}
+	if len(c.AudioSegments) != len(c.Segments) {
+		t.Errorf("%d audio segments for %d video segments", len(c.AudioSegments), len(c.Segments))
+	}
+	audioEnd := c.AudioIndex.Time(uint32(c.AudioIndex.SampleCount()+1)) * uint64(vf.Timescale) / uint64(vf.AudioTimescale)
+	videoEnd := c.VideoIndex.Time(end - first + 1)
+	if diff := int64(audioEnd) - int64(videoEnd); diff < -int64(vf.Timescale)/20 || diff > int64(vf.Timescale)/20 {
+		t.Errorf("clip audio ends at %d, video at %d", audioEnd, videoEnd)
+	}
+
+	// The view is built once per source and clip, views of the same clip
+	// share it
+	again, err := s.ClipVideo(vf, &Clip{Start: 2500 * time.Millisecond, End: 4500 * time.Millisecond})
+	if err != nil || again != c {
+		t.Errorf("clip view built again: %v", err)
+	}
+	signed, err := s.ClipVideo(s.SignVideo(vf, "token"), clip)
+	if err != nil || signed.Token != "token" || signed.VideoIndex != c.VideoIndex || c.Token != "" {
+		t.Errorf("signed clip view %+v, %v", signed, err)
+	}
+	other, err := s.ClipVideo(vf, &Clip{Start: 2500 * time.Millisecond})
+	if err != nil || other.VideoIndex == c.VideoIndex {
+		t.Errorf("clips to different ends share a view: %v", err)
+	}
+
+	if _, err := s.ClipVideo(vf, &Clip{Start: time.Minute}); !errors.Is(err, ErrInvalidClip) {
+		t.Errorf("clip past the end: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// hevcCodecString builds codec string like hvc1.1.6.L93.B0 as defined in
+// ISO/IEC 14496-15 Annex E
+func hevcCodecString(sampleEntry string, hvcC *mp4.HvcCBox) string {
+	profileSpace := []string{"", "A", "B", "C"}[hvcC.GeneralProfileSpace&0x03]
+
+	tier := "L"
+	if hvcC.GeneralTierFlag {
+		tier = "H"
+	}
+
+	// Six constraint bytes, trailing zero bytes are omitted but one is kept
+	constraints := hvcC.GeneralConstraintIndicatorFlags
+	nrBytes := 6
+	for nrBytes > 1 && constraints&0xff == 0 {
+		constraints >>= 8
+		nrBytes--
+	}
+	var constraintPart strings.Builder
+	for i := nrBytes - 1; i >= 0; i-- {
+		constraintPart.WriteString(fmt.Sprintf(".%X", (constraints>>(8*i))&0xff))
+	}
+
+	return fmt.Sprintf("%s.%s%d.%X.%s%d%s", sampleEntry,
+		profileSpace, hvcC.GeneralProfileIDC,
+		bits.Reverse32(hvcC.GeneralProfileCompatibilityFlags),
+		tier, hvcC.GeneralLevelIDC,
+		constraintPart.String())
+}
+
+// av1CodecString builds codec string like av01.0.08M.08 as defined in the AV1
+// ISOBMFF binding. Optional colour fields are left out, their defaults apply
+func av1CodecString(av1C *mp4.Av1CBox) string {
+	tier := "M"
+	if av1C.SeqTier0 != 0 {
+		tier = "H"
+	}
+	bitDepth := 8
+	if av1C.HighBitdepth != 0 {
+		bitDepth = 10
+		if av1C.SeqProfile == 2 && av1C.TwelveBit != 0 {
+			bitDepth = 12
+		}
+	}
+	return fmt.Sprintf("av01.%d.%02d%s.%02d", av1C.SeqProfile, av1C.SeqLevelIdx0, tier, bitDepth)
+}
+
+// vpCodecString builds codec string like vp09.00.31.08.01.01.01.01.00 as
+// defined in the VP codec ISOBMFF binding
+func vpCodecString(sampleEntry string, vpcC *mp4.VppCBox) string {
+	return fmt.Sprintf("%s.%02d.%02d.%02d.%02d.%02d.%02d.%02d.%02d", sampleEntry,
+		vpcC.Profile, vpcC.Level, vpcC.BitDepth, vpcC.ChromaSubsampling,
+		vpcC.ColourPrimaries, vpcC.TransferCharacteristics, vpcC.MatrixCoefficients,
+		vpcC.VideoFullRangeFlag)
+}
+
+// videoBrands returns ftyp compatible brands of video init segments. iso6
+// covers signed composition offsets in trun, the codec brand is added where
+// the codec binding defines one
+func videoBrands(codec string) []string {
+	brands := []string{"isom", "iso2", "iso6"}
+	switch {
+	case strings.HasPrefix(codec, "avc"):
+		brands = append(brands, "avc1")
+	case strings.HasPrefix(codec, "av01"):
+		brands = append(brands, "av01")
+	}
+	return append(brands, "mp41")
+}
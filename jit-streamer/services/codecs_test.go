@@ -0,0 +1,79 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/Eyevinn/mp4ff/av1"
+	"github.com/Eyevinn/mp4ff/hevc"
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+func TestHEVCCodecString(t *testing.T) {
+	tests := []struct {
+		entry string
+		rec   hevc.DecConfRec
+		want  string
+	}{
+		{"hvc1", hevc.DecConfRec{
+			GeneralProfileIDC:                1,
+			GeneralProfileCompatibilityFlags: 0x60000000,
+			GeneralConstraintIndicatorFlags:  0xb00000000000,
+			GeneralLevelIDC:                  93,
+		}, "hvc1.1.6.L93.B0"},
+		{"hev1", hevc.DecConfRec{
+			GeneralProfileIDC:                2,
+			GeneralTierFlag:                  true,
+			GeneralProfileCompatibilityFlags: 0x20000000,
+			GeneralConstraintIndicatorFlags:  0xb00000000000,
+			GeneralLevelIDC:                  153,
+		}, "hev1.2.4.H153.B0"},
+		{"hvc1", hevc.DecConfRec{
+			GeneralProfileSpace:              1,
+			GeneralProfileIDC:                4,
+			GeneralProfileCompatibilityFlags: 0x08000000,
+			GeneralConstraintIndicatorFlags:  0x9c0880000000,
+			GeneralLevelIDC:                  120,
+		}, "hvc1.A4.10.L120.9C.8.80"},
+		{"hvc1", hevc.DecConfRec{
+			GeneralProfileIDC:                1,
+			GeneralProfileCompatibilityFlags: 0x60000000,
+			GeneralLevelIDC:                  90,
+		}, "hvc1.1.6.L90.0"},
+	}
+	for _, tt := range tests {
+		if got := hevcCodecString(tt.entry, &mp4.HvcCBox{DecConfRec: tt.rec}); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestAV1CodecString(t *testing.T) {
+	tests := []struct {
+		rec  av1.CodecConfRec
+		want string
+	}{
+		{av1.CodecConfRec{SeqLevelIdx0: 8}, "av01.0.08M.08"},
+		{av1.CodecConfRec{SeqLevelIdx0: 13, HighBitdepth: 1}, "av01.0.13M.10"},
+		{av1.CodecConfRec{SeqProfile: 2, SeqLevelIdx0: 16, SeqTier0: 1, HighBitdepth: 1, TwelveBit: 1}, "av01.2.16H.12"},
+	}
+	for _, tt := range tests {
+		if got := av1CodecString(&mp4.Av1CBox{CodecConfRec: tt.rec}); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestVPCodecString(t *testing.T) {
+	vpcC := &mp4.VppCBox{
+		Profile:                 2,
+		Level:                   41,
+		BitDepth:                10,
+		ChromaSubsampling:       1,
+		ColourPrimaries:         9,
+		TransferCharacteristics: 16,
+		MatrixCoefficients:      9,
+	}
+	if got, want := vpCodecString("vp09", vpcC), "vp09.02.41.10.01.09.16.09.00"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,311 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+
+	"amka.ru/jit-streamer/models"
+)
+
+// Common Encryption of generated fMP4 segments. Init segments get sinf with
+// tenc in the sample entry and a ClearKey pssh, media segments get their
+// samples encrypted with senc, saiz and saio describing them. Every video
+// has its own key, created on first use and kept by KeyService, which also
+// answers ClearKey license requests. MPEG-TS segments and I-frame segments,
+// whose byte ranges are computed without reading samples, stay clear and
+// are not offered for encrypted views
+
+var (
+	ErrInvalidEncryption = errors.New("invalid encryption scheme")
+	ErrKeyNotFound       = errors.New("content key not found")
+)
+
+// ClearKeySystemID is the DRM system ID of W3C ClearKey
+const ClearKeySystemID = "e2719d58-a985-b3c9-781a-b030af78d30e"
+
+// EncryptVideo returns a view of vf served encrypted with scheme, clear
+// when it is empty
+func (s *Segmenter) EncryptVideo(vf *VideoFile, scheme string) *VideoFile {
+	if vf.Encryption == scheme {
+		return vf
+	}
+	c := *vf
+	c.Encryption = scheme
+	return &c
+}
+
+// KeyService keeps content keys of encrypted videos
+type KeyService struct {
+	scheme string // applied to masters and MPDs that do not ask for one, empty serves them clear
+	file   string // keys are saved to this JSON file, empty keeps them in memory
+
+	mu   sync.Mutex
+	keys map[string]*models.ContentKey // by video name
+}
+
+func NewKeyService(scheme, file string) (*KeyService, error) {
+	if scheme != "" && scheme != "cenc" && scheme != "cbcs" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidEncryption, scheme)
+	}
+	s := &KeyService{
+		scheme: scheme,
+		file:   file,
+		keys:   make(map[string]*models.ContentKey),
+	}
+	if file == "" {
+		return s, nil
+	}
+	var keys []*models.ContentKey
+	if err := loadJSON(file, &keys); err != nil {
+		return nil, fmt.Errorf("failed to load keys: %w", err)
+	}
+	for _, k := range keys {
+		if _, err := decodeContentKey(*k); err != nil {
+			return nil, fmt.Errorf("invalid key of %s: %w", k.Video, err)
+		}
+		s.keys[k.Video] = k
+	}
+	return s, nil
+}
+
+// Scheme returns the encryption scheme of a request asking for requested.
+// Empty result serves it clear
+func (s *KeyService) Scheme(requested string) (string, error) {
+	switch requested {
+	case "", "cenc", "cbcs":
+		return requested, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidEncryption, requested)
+}
+
+// DefaultScheme returns the scheme of fMP4 master playlists and MPDs that
+// do not ask for one. They carry it onto every URI, so playlists and
+// segments ask for it explicitly
+func (s *KeyService) DefaultScheme() string {
+	return s.scheme
+}
+
+// Key returns the content key of a video, creating it on first use
+func (s *KeyService) Key(video string) (models.ContentKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k, ok := s.keys[video]; ok {
+		return *k, nil
+	}
+	buf := make([]byte, 48)
+	if _, err := rand.Read(buf); err != nil {
+		return models.ContentKey{}, err
+	}
+	k := &models.ContentKey{
+		Video: video,
+		KID:   hex.EncodeToString(buf[:16]),
+		Key:   hex.EncodeToString(buf[16:32]),
+		IV:    hex.EncodeToString(buf[32:]),
+	}
+	s.keys[video] = k
+	if err := s.save(); err != nil {
+		delete(s.keys, video)
+		return models.ContentKey{}, err
+	}
+	return *k, nil
+}
+
+// Lookup returns the content key with key ID kid
+func (s *KeyService) Lookup(kid []byte) (models.ContentKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := hex.EncodeToString(kid)
+	for _, k := range s.keys {
+		if strings.EqualFold(k.KID, id) {
+			return *k, nil
+		}
+	}
+	return models.ContentKey{}, ErrKeyNotFound
+}
+
+// save writes keys to the file. Caller holds mu
+func (s *KeyService) save() error {
+	if s.file == "" {
+		return nil
+	}
+	keys := make([]*models.ContentKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Video < keys[j].Video })
+	return saveJSON(s.file, keys)
+}
+
+// ClearKeyLicense is the JSON Web Key Set answering a ClearKey license
+// request
+type ClearKeyLicense struct {
+	Keys []ClearKeyJWK `json:"keys"`
+	Type string        `json:"type"`
+}
+
+// ClearKeyJWK is a content key in a ClearKey license, values are base64url
+// without padding
+type ClearKeyJWK struct {
+	Kty string `json:"kty"`
+	KID string `json:"kid"`
+	K   string `json:"k"`
+}
+
+// License returns keys of the requested key IDs, given as base64url like
+// in ClearKey license requests. Unknown ones and keys of videos allowed
+// rejects are left out
+func (s *KeyService) License(kids []string, sessionType string, allowed func(video string) bool) (ClearKeyLicense, error) {
+	if sessionType == "" {
+		sessionType = "temporary"
+	}
+	license := ClearKeyLicense{Keys: []ClearKeyJWK{}, Type: sessionType}
+	for _, kid := range kids {
+		id, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(kid, "="))
+		if err != nil {
+			return ClearKeyLicense{}, fmt.Errorf("%w: key ID %q", ErrKeyNotFound, kid)
+		}
+		k, err := s.Lookup(id)
+		if err != nil || !allowed(k.Video) {
+			continue
+		}
+		ck, _ := decodeContentKey(k)
+		license.Keys = append(license.Keys, ClearKeyJWK{
+			Kty: "oct",
+			KID: base64.RawURLEncoding.EncodeToString(ck.kid),
+			K:   base64.RawURLEncoding.EncodeToString(ck.key),
+		})
+	}
+	if len(license.Keys) == 0 {
+		return ClearKeyLicense{}, ErrKeyNotFound
+	}
+	return license, nil
+}
+
+// contentKey is a decoded models.ContentKey
+type contentKey struct {
+	kid, key, iv []byte
+}
+
+func decodeContentKey(k models.ContentKey) (contentKey, error) {
+	var ck contentKey
+	var err error
+	if ck.kid, err = decodeKeyHex("kid", k.KID); err != nil {
+		return contentKey{}, err
+	}
+	if ck.key, err = decodeKeyHex("key", k.Key); err != nil {
+		return contentKey{}, err
+	}
+	if ck.iv, err = decodeKeyHex("iv", k.IV); err != nil {
+		return contentKey{}, err
+	}
+	return ck, nil
+}
+
+func decodeKeyHex(name, value string) ([]byte, error) {
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) != 16 {
+		return nil, fmt.Errorf("%s is not 16 bytes of hex", name)
+	}
+	return b, nil
+}
+
+// ClearKeyPSSH returns the ClearKey pssh box of a content key
+func ClearKeyPSSH(k models.ContentKey) (*mp4.PsshBox, error) {
+	return mp4.NewPsshBox(ClearKeySystemID, []string{k.KID}, nil)
+}
+
+// EncryptInit adds protection of scheme to a single track init segment
+func EncryptInit(init []byte, scheme string, k models.ContentKey) ([]byte, error) {
+	ck, err := decodeContentKey(k)
+	if err != nil {
+		return nil, err
+	}
+	pssh, err := ClearKeyPSSH(k)
+	if err != nil {
+		return nil, err
+	}
+	f, err := mp4.DecodeFile(bytes.NewReader(init))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode init segment: %w", err)
+	}
+	if f.Init == nil {
+		return nil, fmt.Errorf("no init segment to encrypt")
+	}
+	if _, err := mp4.InitProtect(f.Init, ck.key, ck.iv, scheme, ck.kid, []*mp4.PsshBox{pssh}); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := f.Init.Encode(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncryptSegment encrypts samples of every fragment of a media segment.
+// init is the clear init segment of its track. cenc IVs are derived from
+// track and the decode time of the fragment, so track must tell apart
+// everything encrypted with the key: renditions, audio tracks, clips
+func EncryptSegment(init, segment []byte, scheme string, k models.ContentKey, track string) ([]byte, error) {
+	ck, err := decodeContentKey(k)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := mp4.DecodeFile(bytes.NewReader(init))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode init segment: %w", err)
+	}
+	if fi.Init == nil {
+		return nil, fmt.Errorf("no init segment of the track")
+	}
+	ipd, err := mp4.InitProtect(fi.Init, ck.key, ck.iv, scheme, ck.kid, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := mp4.DecodeFile(bytes.NewReader(segment))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode media segment: %w", err)
+	}
+	var buf bytes.Buffer
+	for _, seg := range f.Segments {
+		for _, frag := range seg.Fragments {
+			iv := ck.iv
+			if scheme == "cenc" {
+				iv = fragmentIV(ck.iv, track, frag.Moof.Traf.Tfdt.BaseMediaDecodeTime())
+			}
+			if err := mp4.EncryptFragment(frag, ck.key, iv, ipd); err != nil {
+				return nil, err
+			}
+		}
+		if err := seg.Encode(&buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// fragmentIV returns the first cenc IV of a fragment. The upper half is
+// unique per track and decode time, the lower half counts AES blocks of
+// the fragment from zero
+func fragmentIV(seed []byte, track string, baseTime uint64) []byte {
+	h := sha256.New()
+	h.Write(seed)
+	h.Write([]byte(track))
+	h.Write(binary.BigEndian.AppendUint64(nil, baseTime))
+	iv := make([]byte, 16)
+	copy(iv, h.Sum(nil)[:8])
+	return iv
+}
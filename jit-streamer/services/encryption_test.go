@@ -0,0 +1,95 @@
+package services
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// TestEncryptSegments checks that encrypted segments decrypt back to the
+// clear ones with both schemes and that cenc IVs differ between tracks
+func TestEncryptSegments(t *testing.T) {
+	s, vf := openFixture(t, fixtureVideo(), fixtureAudio())
+	keys, err := NewKeyService("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := keys.Key("fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks := []struct {
+		name     string
+		init     func(*VideoFile) ([]byte, error)
+		generate func(*VideoFile, int) ([]byte, error)
+	}{
+		{"video", s.GenerateInitSegment, s.GenerateMediaSegment},
+		{"audio", s.GenerateAudioInitSegment, s.GenerateAudioMediaSegment},
+	}
+	for _, scheme := range []string{"cenc", "cbcs"} {
+		for _, tr := range tracks {
+			init, err := tr.init(vf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clear, err := tr.generate(vf, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encInit, err := EncryptInit(init, scheme, key)
+			if err != nil {
+				t.Fatalf("%s %s init: %v", scheme, tr.name, err)
+			}
+			enc, err := EncryptSegment(init, clear, scheme, key, tr.name)
+			if err != nil {
+				t.Fatalf("%s %s segment: %v", scheme, tr.name, err)
+			}
+			want, err := mp4.DecodeFile(bytes.NewReader(clear))
+			if err != nil {
+				t.Fatal(err)
+			}
+			clearSamples := want.Segments[0].Fragments[0].Mdat.Data
+
+			f, err := mp4.DecodeFile(bytes.NewReader(append(encInit, enc...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(f.Segments[0].Fragments[0].Mdat.Data, clearSamples) {
+				t.Errorf("%s %s samples are clear", scheme, tr.name)
+			}
+			if len(f.Init.Moov.Psshs) != 1 {
+				t.Errorf("%s %s init has %d pssh boxes", scheme, tr.name, len(f.Init.Moov.Psshs))
+			}
+			info, err := mp4.DecryptInit(f.Init)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ck, _ := decodeContentKey(key)
+			if err := mp4.DecryptSegment(f.Segments[0], info, ck.key); err != nil {
+				t.Fatalf("%s %s decrypt: %v", scheme, tr.name, err)
+			}
+			if !bytes.Equal(f.Segments[0].Fragments[0].Mdat.Data, clearSamples) {
+				t.Errorf("%s %s samples do not decrypt to clear ones", scheme, tr.name)
+			}
+		}
+	}
+
+	if bytes.Equal(fragmentIV([]byte("seed"), "video", 0), fragmentIV([]byte("seed"), "audio", 0)) {
+		t.Error("video and audio share cenc IVs")
+	}
+	if _, err := keys.Scheme("aes"); err == nil {
+		t.Error("unknown scheme accepted")
+	}
+
+	// Default scheme applies to master playlists and MPDs only, requests
+	// without a scheme are served clear
+	keys, err = NewKeyService("cbcs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheme, err := keys.Scheme(""); scheme != "" || err != nil || keys.DefaultScheme() != "cbcs" {
+		t.Errorf("Scheme(\"\") = %q, %v with default %q", scheme, err, keys.DefaultScheme())
+	}
+}
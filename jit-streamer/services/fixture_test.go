@@ -0,0 +1,283 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Eyevinn/mp4ff/aac"
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// Parameter sets of a 640x360 High profile stream, taken from mp4ff tests
+const (
+	fixtureSPS = "6764001eacd940a02ff9610000030001000003003c8f162d96"
+	fixturePPS = "68ebecb22c"
+)
+
+// fixtureTrack describes a synthetic track of a progressive test file
+type fixtureTrack struct {
+	handler         string // "video" or "audio"
+	timescale       uint32
+	sampleDur       uint32
+	sampleCount     int
+	keyframeEvery   int // video only, every sample is sync when 0
+	samplesPerChunk int
+	cto             []int32         // per-sample composition offsets, no ctts when nil
+	edits           []mp4.ElstEntry // durations in movie timescale, no edts when nil
+	language        string          // mdhd language, "und" when empty
+	sampleRate      int             // audio sample entry rate, timescale when 0
+}
+
+// fixtureVideo is 6 s of 25 fps video with a keyframe every second
+func fixtureVideo() fixtureTrack {
+	return fixtureTrack{
+		handler:         "video",
+		timescale:       12800,
+		sampleDur:       512,
+		sampleCount:     150,
+		keyframeEvery:   25,
+		samplesPerChunk: 5,
+	}
+}
+
+// fixtureAudio is 6 s of 48 kHz AAC
+func fixtureAudio() fixtureTrack {
+	return fixtureTrack{
+		handler:         "audio",
+		timescale:       48000,
+		sampleDur:       1024,
+		sampleCount:     282,
+		samplesPerChunk: 10,
+	}
+}
+
+// fixtureSampleData returns deterministic payload of a sample, distinct for
+// every track and sample. Video samples are length-prefixed NAL units
+func fixtureSampleData(trackIdx int, sampleNr int, keyframe bool, isVideo bool) []byte {
+	size := 40 + (sampleNr*37+trackIdx*11)%160
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(sampleNr*7 + trackIdx*101 + i)
+	}
+	if !isVideo {
+		return payload
+	}
+	payload[0] = 0x41 // non-IDR slice
+	if keyframe {
+		payload[0] = 0x65 // IDR slice
+	}
+	// Slice header starts with first_mb_in_slice, slice_type and
+	// pic_parameter_set_id of 0, so it refers to fixturePPS
+	payload[1] |= 0xe0
+	return append(binary.BigEndian.AppendUint32(nil, uint32(size)), payload...)
+}
+
+// writeFixture writes progressive MP4 with the given tracks. Chunks of the
+// tracks are interleaved in mdat like in muxed files
+func writeFixture(t testing.TB, tracks ...fixtureTrack) string {
+	t.Helper()
+
+	moov := mp4.NewMoovBox()
+	mvhd := mp4.CreateMvhd()
+	mvhd.NextTrackID = uint32(len(tracks) + 1)
+	moov.AddChild(mvhd)
+
+	traks := make([]*mp4.TrakBox, len(tracks))
+	chunks := make([][][]byte, len(tracks)) // sample data per chunk per track
+	for i, ft := range tracks {
+		lang := ft.language
+		if lang == "" {
+			lang = "und"
+		}
+		trak := mp4.CreateEmptyTrak(uint32(i+1), ft.timescale, ft.handler, lang)
+		switch ft.handler {
+		case "video":
+			sps, _ := hex.DecodeString(fixtureSPS)
+			pps, _ := hex.DecodeString(fixturePPS)
+			if err := trak.SetAVCDescriptor("avc1", [][]byte{sps}, [][]byte{pps}, true); err != nil {
+				t.Fatal(err)
+			}
+		case "audio":
+			rate := int(ft.timescale)
+			if ft.sampleRate != 0 {
+				rate = ft.sampleRate
+			}
+			if err := trak.SetAACDescriptor(aac.AAClc, rate); err != nil {
+				t.Fatal(err)
+			}
+		}
+		trak.Mdia.Mdhd.Duration = uint64(ft.sampleCount) * uint64(ft.sampleDur)
+		trak.Tkhd.Duration = trak.Mdia.Mdhd.Duration * uint64(mvhd.Timescale) / uint64(ft.timescale)
+
+		stbl := trak.Mdia.Minf.Stbl
+		stbl.Stts.SampleCount = []uint32{uint32(ft.sampleCount)}
+		stbl.Stts.SampleTimeDelta = []uint32{ft.sampleDur}
+		if ft.handler == "video" && ft.keyframeEvery > 0 {
+			stss := &mp4.StssBox{}
+			for nr := 1; nr <= ft.sampleCount; nr += ft.keyframeEvery {
+				stss.SampleNumber = append(stss.SampleNumber, uint32(nr))
+			}
+			stbl.AddChild(stss)
+		}
+		if ft.cto != nil {
+			ctts := &mp4.CttsBox{}
+			counts := make([]uint32, len(ft.cto))
+			for j := range counts {
+				counts[j] = 1
+			}
+			if err := ctts.AddSampleCountsAndOffset(counts, ft.cto); err != nil {
+				t.Fatal(err)
+			}
+			if ft.cto[0] < 0 {
+				ctts.Version = 1
+			}
+			stbl.AddChild(ctts)
+		}
+
+		if ft.edits != nil {
+			edts := &mp4.EdtsBox{}
+			edts.AddChild(&mp4.ElstBox{Entries: ft.edits})
+			trak.AddChild(edts)
+		}
+
+		var chunk [][]byte
+		for nr := 1; nr <= ft.sampleCount; nr++ {
+			keyframe := ft.keyframeEvery == 0 || (nr-1)%ft.keyframeEvery == 0
+			data := fixtureSampleData(i, nr, keyframe, ft.handler == "video")
+			stbl.Stsz.SampleSize = append(stbl.Stsz.SampleSize, uint32(len(data)))
+			chunk = append(chunk, data)
+			if len(chunk) == ft.samplesPerChunk || nr == ft.sampleCount {
+				chunks[i] = append(chunks[i], bytes.Join(chunk, nil))
+				chunk = nil
+			}
+		}
+		stbl.Stsz.SampleNumber = uint32(ft.sampleCount)
+		if err := stbl.Stsc.AddEntry(1, uint32(ft.samplesPerChunk), 1); err != nil {
+			t.Fatal(err)
+		}
+		if rest := ft.sampleCount % ft.samplesPerChunk; rest != 0 {
+			if err := stbl.Stsc.AddEntry(uint32(len(chunks[i])), uint32(rest), 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stbl.Stco.ChunkOffset = make([]uint32, len(chunks[i]))
+
+		moov.AddChild(trak)
+		traks[i] = trak
+	}
+
+	// Chunk offsets do not change box sizes, so mdat position is known now
+	ftyp := mp4.NewFtyp("isom", 0x200, []string{"isom", "iso2", "avc1", "mp41"})
+	offset := ftyp.Size() + moov.Size() + 8
+	var mdat bytes.Buffer
+	for c := 0; ; c++ {
+		written := false
+		for i := range tracks {
+			if c < len(chunks[i]) {
+				traks[i].Mdia.Minf.Stbl.Stco.ChunkOffset[c] = uint32(offset + uint64(mdat.Len()))
+				mdat.Write(chunks[i][c])
+				written = true
+			}
+		}
+		if !written {
+			break
+		}
+	}
+
+	var out bytes.Buffer
+	for _, box := range []mp4.Box{ftyp, moov, &mp4.MdatBox{Data: mdat.Bytes()}} {
+		if err := box.Encode(&out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "fixture.mp4")
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeFragmentedFixture writes the tracks as fragmented MP4 with one moof
+// per fragmentDur seconds holding a traf of every track. Decode times start
+// at originSec like in files cut from a live stream
+func writeFragmentedFixture(t testing.TB, fragmentDur, originSec uint64, tracks ...fixtureTrack) string {
+	t.Helper()
+
+	init := mp4.CreateEmptyInit()
+	trackIDs := make([]uint32, len(tracks))
+	for i, ft := range tracks {
+		init.AddEmptyTrack(ft.timescale, ft.handler, "und")
+		trak := init.Moov.Traks[i]
+		trackIDs[i] = trak.Tkhd.TrackID
+		switch ft.handler {
+		case "video":
+			sps, _ := hex.DecodeString(fixtureSPS)
+			pps, _ := hex.DecodeString(fixturePPS)
+			if err := trak.SetAVCDescriptor("avc1", [][]byte{sps}, [][]byte{pps}, true); err != nil {
+				t.Fatal(err)
+			}
+		case "audio":
+			rate := int(ft.timescale)
+			if ft.sampleRate != 0 {
+				rate = ft.sampleRate
+			}
+			if err := trak.SetAACDescriptor(aac.AAClc, rate); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := init.Encode(&out); err != nil {
+		t.Fatal(err)
+	}
+	next := make([]int, len(tracks)) // next sample number of every track
+	for seqNr := uint32(1); ; seqNr++ {
+		frag, err := mp4.CreateMultiTrackFragment(seqNr, trackIDs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		added := false
+		for i, ft := range tracks {
+			end := fragmentDur * uint64(seqNr) * uint64(ft.timescale)
+			for ; next[i] < ft.sampleCount && uint64(next[i])*uint64(ft.sampleDur) < end; next[i]++ {
+				nr := next[i] + 1
+				keyframe := ft.keyframeEvery == 0 || (nr-1)%ft.keyframeEvery == 0
+				flags := mp4.NonSyncSampleFlags
+				if keyframe {
+					flags = mp4.SyncSampleFlags
+				}
+				var cto int32
+				if ft.cto != nil {
+					cto = ft.cto[nr-1]
+				}
+				data := fixtureSampleData(i, nr, keyframe, ft.handler == "video")
+				sample := mp4.FullSample{
+					Sample:     mp4.NewSample(flags, ft.sampleDur, uint32(len(data)), cto),
+					DecodeTime: originSec*uint64(ft.timescale) + uint64(next[i])*uint64(ft.sampleDur),
+					Data:       data,
+				}
+				if err := frag.AddFullSampleToTrack(sample, trackIDs[i]); err != nil {
+					t.Fatal(err)
+				}
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+		if err := frag.Encode(&out); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "fragmented.mp4")
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
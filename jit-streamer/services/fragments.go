@@ -0,0 +1,204 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// Fragmented sources have empty sample tables in moov, their samples are
+// described by trun boxes of every moof. mp4ff decodes all moof boxes when
+// the file is opened, so the index is built from them directly. sidx only
+// points at fragments and is not needed for that, mfra is used for sync
+// samples when trun flags do not tell them apart
+
+// fragmentOrigin returns the earliest tfdt of all tracks as time and its
+// timescale. Fragments cut from a live stream start far from zero, tracks
+// are moved back by the same amount to keep them in sync
+func fragmentOrigin(f *mp4.File) (uint64, uint32) {
+	var originTime uint64
+	var originTimescale uint32
+	seen := make(map[uint32]bool)
+	for _, seg := range f.Segments {
+		for _, frag := range seg.Fragments {
+			for _, traf := range frag.Moof.Trafs {
+				trackID := traf.Tfhd.TrackID
+				if seen[trackID] || traf.Tfdt == nil {
+					continue
+				}
+				seen[trackID] = true
+				trak := findTrak(f.Moov, trackID)
+				if trak == nil || trak.Mdia == nil || trak.Mdia.Mdhd == nil || trak.Mdia.Mdhd.Timescale == 0 {
+					continue
+				}
+				t, timescale := traf.Tfdt.BaseMediaDecodeTime(), trak.Mdia.Mdhd.Timescale
+				if originTimescale == 0 || rescaleTime(t, timescale, originTimescale) < originTime {
+					originTime, originTimescale = t, timescale
+				}
+			}
+		}
+	}
+	return originTime, originTimescale
+}
+
+func findTrak(moov *mp4.MoovBox, trackID uint32) *mp4.TrakBox {
+	for _, trak := range moov.Traks {
+		if trak.Tkhd != nil && trak.Tkhd.TrackID == trackID {
+			return trak
+		}
+	}
+	return nil
+}
+
+func findTrex(moov *mp4.MoovBox, trackID uint32) *mp4.TrexBox {
+	if moov.Mvex == nil {
+		return nil
+	}
+	for _, trex := range moov.Mvex.Trexs {
+		if trex.TrackID == trackID {
+			return trex
+		}
+	}
+	return nil
+}
+
+// trunKey identifies a trun like tfra entries do, numbers are 1-based
+type trunKey struct {
+	moofOffset uint64
+	trafNr     uint32
+	trunNr     uint32
+}
+
+// buildFragmentedSampleIndex builds the index of a track from trun boxes,
+// filling values missing in trun with tfhd and trex defaults. Decode times
+// come from tfdt and are moved back by origin
+func buildFragmentedSampleIndex(f *mp4.File, trak *mp4.TrakBox, originTime uint64, originTimescale uint32) (*SampleIndex, error) {
+	trackID := trak.Tkhd.TrackID
+	timescale := trak.Mdia.Mdhd.Timescale
+	trex := findTrex(f.Moov, trackID)
+	origin := rescaleTime(originTime, originTimescale, timescale)
+
+	idx := &SampleIndex{}
+	var sync []bool
+	var ctos []int32
+	hasCTO := false
+	allSync := true
+	firstSample := make(map[trunKey]int) // index of first sample of every trun
+	var currentTime uint64
+
+	for _, seg := range f.Segments {
+		for _, frag := range seg.Fragments {
+			moof := frag.Moof
+			// Data of a traf without base offset follows the previous one
+			dataEnd := moof.StartPos
+			for trafNr, traf := range moof.Trafs {
+				tfhd := traf.Tfhd
+				if tfhd.TrackID != trackID {
+					dataEnd = trafDataEnd(f.Moov, traf, moof.StartPos, dataEnd)
+					continue
+				}
+				if traf.Tfdt != nil {
+					t := traf.Tfdt.BaseMediaDecodeTime()
+					if t < origin {
+						t = origin
+					}
+					// Gaps stretch the previous sample, overlaps are ignored
+					if t-origin >= currentTime {
+						currentTime = t - origin
+					}
+				}
+
+				base := trafBase(tfhd, moof.StartPos, dataEnd)
+				pos := base
+				for trunNr, trun := range traf.Truns {
+					trun.AddSampleDefaultValues(tfhd, trex)
+					if trun.HasDataOffset() {
+						pos = uint64(int64(base) + int64(trun.DataOffset))
+					}
+					firstSample[trunKey{moof.StartPos, uint32(trafNr + 1), uint32(trunNr + 1)}] = len(idx.Sizes)
+					if trun.HasSampleCompositionTimeOffset() {
+						hasCTO = true
+					}
+					for _, sample := range trun.Samples {
+						idx.DecodeTimes = append(idx.DecodeTimes, currentTime)
+						idx.Offsets = append(idx.Offsets, pos)
+						idx.Sizes = append(idx.Sizes, sample.Size)
+						ctos = append(ctos, sample.CompositionTimeOffset)
+						isSync := sample.Flags&mp4.NonSyncSampleFlags == 0
+						sync = append(sync, isSync)
+						allSync = allSync && isSync
+						currentTime += uint64(sample.Dur)
+						pos += uint64(sample.Size)
+					}
+				}
+				dataEnd = pos
+			}
+		}
+	}
+	if len(idx.Sizes) == 0 {
+		return nil, fmt.Errorf("no fragments for track %d", trackID)
+	}
+	idx.DecodeTimes = append(idx.DecodeTimes, currentTime)
+
+	// Video with every sample flagged sync has no usable flags, random
+	// access points of mfra are the keyframes then
+	tfra := findTfra(f.Mfra, trackID)
+	if allSync && tfra != nil && trak.Mdia.Hdlr != nil && trak.Mdia.Hdlr.HandlerType == "vide" {
+		sync = make([]bool, len(idx.Sizes))
+		allSync = false
+		for _, entry := range tfra.Entries {
+			first, ok := firstSample[trunKey{entry.MoofOffset, entry.TrafNumber, entry.TrunNumber}]
+			nr := first + int(entry.SampleNumber) - 1
+			if ok && entry.SampleNumber >= 1 && nr < len(sync) {
+				sync[nr] = true
+			}
+		}
+	}
+	if hasCTO {
+		idx.CTOs = ctos
+	}
+	if !allSync {
+		idx.Sync = sync
+	}
+	idx.indexKeyframes()
+	return idx, nil
+}
+
+// trafBase returns base data offset of a traf. Without explicit offset or
+// default-base-is-moof data follows the previous traf of the moof
+func trafBase(tfhd *mp4.TfhdBox, moofPos, dataEnd uint64) uint64 {
+	switch {
+	case tfhd.HasBaseDataOffset():
+		return tfhd.BaseDataOffset
+	case tfhd.DefaultBaseIfMoof():
+		return moofPos
+	}
+	return dataEnd
+}
+
+// trafDataEnd returns end of sample data of a traf of another track
+func trafDataEnd(moov *mp4.MoovBox, traf *mp4.TrafBox, moofPos, dataEnd uint64) uint64 {
+	trex := findTrex(moov, traf.Tfhd.TrackID)
+	base := trafBase(traf.Tfhd, moofPos, dataEnd)
+	pos := base
+	for _, trun := range traf.Truns {
+		trun.AddSampleDefaultValues(traf.Tfhd, trex)
+		if trun.HasDataOffset() {
+			pos = uint64(int64(base) + int64(trun.DataOffset))
+		}
+		pos += trun.SizeOfData()
+	}
+	return pos
+}
+
+func findTfra(mfra *mp4.MfraBox, trackID uint32) *mp4.TfraBox {
+	if mfra == nil {
+		return nil
+	}
+	for _, tfra := range mfra.Tfras {
+		if tfra.TrackID == trackID {
+			return tfra
+		}
+	}
+	return nil
+}
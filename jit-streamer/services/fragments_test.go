@@ -0,0 +1,63 @@
+package services
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestFragmentedSource checks that a fragmented file gives the same segments
+// as the progressive file with identical samples
+func TestFragmentedSource(t *testing.T) {
+	video := fixtureVideo()
+	video.cto = make([]int32, video.sampleCount)
+	for i := range video.cto {
+		video.cto[i] = int32(i%video.keyframeEvery%3) * 512
+	}
+	tracks := []fixtureTrack{video, fixtureAudio()}
+	ref, refVF := openFixture(t, tracks...)
+
+	for _, tc := range []struct {
+		name        string
+		fragmentDur uint64
+		originSec   uint64
+	}{
+		{"2s fragments", 2, 0},
+		{"live capture", 1, 36000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewSegmenter(1, 0, 0)
+			t.Cleanup(s.Close)
+			vf, err := s.OpenVideo(writeFragmentedFixture(t, tc.fragmentDur, tc.originSec, tracks...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(vf.Segments) != len(refVF.Segments) || len(vf.AudioSegments) != len(refVF.AudioSegments) {
+				t.Fatalf("got %d/%d segments, want %d/%d", len(vf.Segments), len(vf.AudioSegments),
+					len(refVF.Segments), len(refVF.AudioSegments))
+			}
+			if vf.Duration != refVF.Duration || vf.AudioDuration != refVF.AudioDuration {
+				t.Errorf("duration %d/%d, want %d/%d", vf.Duration, vf.AudioDuration, refVF.Duration, refVF.AudioDuration)
+			}
+
+			for i := range vf.Segments {
+				got, err := s.GenerateMediaSegment(vf, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, _ := ref.GenerateMediaSegment(refVF, i)
+				if !bytes.Equal(got, want) {
+					t.Errorf("video segment %d differs", i)
+				}
+
+				got, err = s.GenerateAudioMediaSegment(vf, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, _ = ref.GenerateAudioMediaSegment(refVF, i)
+				if !bytes.Equal(got, want) {
+					t.Errorf("audio segment %d differs", i)
+				}
+			}
+		})
+	}
+}
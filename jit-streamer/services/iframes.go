@@ -0,0 +1,119 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// I-frame segments serve trick play. iframes_N.m4s holds the sync samples of
+// video segment N from stss, each in a fragment of its own, so HLS I-frame
+// playlists address them by byte range. A sync sample lasts until the next
+// one, which makes the I-frame segment cover the same time as the segment
+// and lets DASH trick mode reuse its SegmentTimeline
+
+// IFrame is a sync sample in the I-frame segment
+type IFrame struct {
+	Sample    uint32
+	StartTime uint64
+	Duration  uint64 // until the next sync sample or the end of the segment
+	Offset    uint64 // byte range of its fragment in the I-frame segment
+	Length    uint64
+}
+
+// iframeStypSize is the size of styp written before the first fragment
+var iframeStypSize = mp4.NewStyp("msdh", 0, []string{"msdh", "msix"}).Size()
+
+// IFrames returns sync samples of video segment n
+func (s *Segmenter) IFrames(vf *VideoFile, n int) []IFrame {
+	if vf.VideoIndex == nil || n < 0 || n >= len(vf.Segments) {
+		return nil
+	}
+	idx := vf.VideoIndex
+	seg := vf.Segments[n]
+
+	var frames []IFrame
+	offset := iframeStypSize
+	for k := idx.KeyframeAt(idx.Time(seg.StartSample)); k < len(idx.Keyframes) && idx.Keyframes[k] < seg.EndSample; k++ {
+		nr := idx.Keyframes[k]
+		next := seg.EndSample
+		if k+1 < len(idx.Keyframes) && idx.Keyframes[k+1] < next {
+			next = idx.Keyframes[k+1]
+		}
+		frame := IFrame{
+			Sample:    nr,
+			StartTime: idx.Time(nr),
+			Duration:  idx.Time(next) - idx.Time(nr),
+			Offset:    offset,
+		}
+		frame.Length = s.fragmentSize(nr, frame.StartTime, []mp4.Sample{iframeSample(idx, frame)})
+		offset += frame.Length
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// IFrameBandwidth returns peak bitrate of I-frame segments
+func (s *Segmenter) IFrameBandwidth(vf *VideoFile) uint32 {
+	segments := make([]Segment, len(vf.Segments))
+	for n, seg := range vf.Segments {
+		segments[n].Duration = seg.Duration
+		for _, frame := range s.IFrames(vf, n) {
+			segments[n].Size += frame.Length
+		}
+	}
+	peak, _ := segmentBandwidth(segments, vf.Timescale)
+	return peak
+}
+
+// MaxPlayoutRate returns the average number of samples per sync sample, the
+// speed up at which playing I-frame segments shows as many frames per second
+// as normal playback
+func (s *Segmenter) MaxPlayoutRate(vf *VideoFile) int {
+	if vf.VideoIndex == nil || len(vf.VideoIndex.Keyframes) == 0 {
+		return 1
+	}
+	return max(1, vf.VideoIndex.SampleCount()/len(vf.VideoIndex.Keyframes))
+}
+
+// GenerateIFrameSegment writes iframes_N.m4s
+func (s *Segmenter) GenerateIFrameSegment(vf *VideoFile, segmentIndex int) ([]byte, error) {
+	if vf.VideoTrack == nil {
+		return nil, fmt.Errorf("no video track")
+	}
+	if segmentIndex < 0 || segmentIndex >= len(vf.Segments) {
+		return nil, fmt.Errorf("segment %d out of range", segmentIndex)
+	}
+	frames := s.IFrames(vf, segmentIndex)
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("no sync samples in segment %d", segmentIndex)
+	}
+
+	buf := &bytes.Buffer{}
+	styp := mp4.NewStyp("msdh", 0, []string{"msdh", "msix"})
+	if err := styp.Encode(buf); err != nil {
+		return nil, err
+	}
+	for _, frame := range frames {
+		_, data, err := s.readSamples(vf, vf.VideoIndex, frame.Sample, frame.Sample+1)
+		if err != nil {
+			return nil, err
+		}
+		// Fragments are numbered by sample, so they keep increasing
+		if err := s.encodeFragment(buf, frame.Sample, frame.StartTime, []mp4.Sample{iframeSample(vf.VideoIndex, frame)}, data); err != nil {
+			return nil, err
+		}
+		if got := uint64(buf.Len()); got != frame.Offset+frame.Length {
+			return nil, fmt.Errorf("I-frame %d ends at %d, expected %d", frame.Sample, got, frame.Offset+frame.Length)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// iframeSample is the trun entry of a sync sample stretched to the next one
+func iframeSample(idx *SampleIndex, frame IFrame) mp4.Sample {
+	sample := idx.Samples(frame.Sample, frame.Sample+1)[0]
+	sample.Dur = uint32(frame.Duration)
+	return sample
+}
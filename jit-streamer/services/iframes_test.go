@@ -0,0 +1,67 @@
+package services
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// TestIFrameSegments checks that every byte range of an I-frame segment is
+// a fragment of its own holding one sync sample, and that I-frames cover
+// their segment without gaps
+func TestIFrameSegments(t *testing.T) {
+	s := NewSegmenter(3, 0, 0)
+	t.Cleanup(s.Close)
+	vf, err := s.OpenVideo(writeFixture(t, fixtureVideo(), fixtureAudio()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n, seg := range vf.Segments {
+		frames := s.IFrames(vf, n)
+		if len(frames) != 3 {
+			t.Fatalf("segment %d has %d I-frames, want 3", n, len(frames))
+		}
+		data, err := s.GenerateIFrameSegment(vf, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		next := seg.StartTime
+		for _, frame := range frames {
+			if frame.StartTime != next {
+				t.Errorf("I-frame %d starts at %d, previous ends at %d", frame.Sample, frame.StartTime, next)
+			}
+			next = frame.StartTime + frame.Duration
+
+			f, err := mp4.DecodeFile(bytes.NewReader(data[frame.Offset : frame.Offset+frame.Length]))
+			if err != nil {
+				t.Fatalf("I-frame %d: %v", frame.Sample, err)
+			}
+			if len(f.Segments) != 1 || len(f.Segments[0].Fragments) != 1 {
+				t.Fatalf("I-frame %d is not a single fragment", frame.Sample)
+			}
+			frag := f.Segments[0].Fragments[0]
+			if tfdt := frag.Moof.Traf.Tfdt.BaseMediaDecodeTime(); tfdt != frame.StartTime {
+				t.Errorf("I-frame %d tfdt %d, want %d", frame.Sample, tfdt, frame.StartTime)
+			}
+			samples, err := frag.GetFullSamples(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(samples) != 1 || !samples[0].IsSync() || uint64(samples[0].Dur) != frame.Duration {
+				t.Fatalf("I-frame %d fragment has %d samples", frame.Sample, len(samples))
+			}
+			if want := fixtureSampleData(0, int(frame.Sample), true, true); !bytes.Equal(samples[0].Data, want) {
+				t.Errorf("I-frame %d data differs from the source", frame.Sample)
+			}
+		}
+		if end := seg.StartTime + seg.Duration; next != end {
+			t.Errorf("I-frames of segment %d end at %d, segment at %d", n, next, end)
+		}
+		if last := frames[len(frames)-1]; uint64(len(data)) != last.Offset+last.Length {
+			t.Errorf("segment %d is %d bytes, I-frames end at %d", n, len(data), last.Offset+last.Length)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// loadJSON reads v from file. A missing file leaves v as is
+func loadJSON(file string, v any) error {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveJSON writes v to file through a temporary one, so a crash never
+// leaves it half written
+func saveJSON(file string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
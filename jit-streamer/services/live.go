@@ -0,0 +1,101 @@
+package services
+
+import (
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// liveRefreshInterval limits how often a growing file is re-indexed. It is
+// well below part duration, so LL-HLS parts are listed soon after written
+const liveRefreshInterval = 200 * time.Millisecond
+
+// isGrowing reports whether the file may still be written to
+func (s *Segmenter) isGrowing(fi os.FileInfo) bool {
+	return s.liveIdle > 0 && time.Since(fi.ModTime()) < s.liveIdle
+}
+
+func (s *Segmenter) needsRefresh(vf *VideoFile) bool {
+	return vf.Live && time.Since(vf.refreshed) >= liveRefreshInterval
+}
+
+// refreshLive indexes fragments appended since the last refresh and ends
+// live mode once the writer has been idle for liveIdle or wrote mfra. The
+// refreshed file replaces vf in the cache, vf itself is not modified as
+// requests may still be using it. Must be called with s.mu held
+func (s *Segmenter) refreshLive(vf *VideoFile) *VideoFile {
+	next := *vf
+	next.refreshed = time.Now()
+	s.videoCache[vf.Path] = &next
+
+	fi, err := vf.File.Stat()
+	if err != nil {
+		log.Printf("Live refresh of %s failed: %v", vf.Path, err)
+		return &next
+	}
+	if size := uint64(fi.Size()); size > vf.liveEnd {
+		if next.liveEnd, err = decodeCompleteBoxes(vf.File, vf.MP4, vf.liveEnd, size); err != nil {
+			log.Printf("Live refresh of %s failed: %v", vf.Path, err)
+		}
+	}
+	next.Live = s.isGrowing(fi) && vf.MP4.Mfra == nil
+
+	if next.liveEnd == vf.liveEnd && next.Live {
+		return &next
+	}
+	if err := s.buildSegmentMaps(&next); err != nil {
+		// Keep serving the old maps, decoded boxes are already in vf.MP4
+		log.Printf("Live refresh of %s failed: %v", vf.Path, err)
+		stale := *vf
+		stale.refreshed, stale.liveEnd = next.refreshed, next.liveEnd
+		s.videoCache[vf.Path] = &stale
+		return &stale
+	}
+	if !next.Live {
+		log.Printf("Live source %s finalized with %d segments", vf.Path, len(next.Segments))
+	}
+	return &next
+}
+
+// decodeCompleteBoxes decodes top-level boxes in [pos, size) into f and
+// returns end of the last decoded box. Decoding stops at a box that is not
+// completely written yet. moof is only taken together with the following
+// box, so a fragment is never indexed before its mdat is complete
+func decodeCompleteBoxes(file *os.File, f *mp4.File, pos, size uint64) (uint64, error) {
+	for pos < size {
+		hdr, ok := completeBoxHeader(file, pos, size)
+		if !ok {
+			break
+		}
+		end := pos + hdr.Size
+		if hdr.Name == "moof" {
+			if _, ok := completeBoxHeader(file, end, size); !ok {
+				break
+			}
+		}
+
+		box, err := mp4.DecodeBoxLazyMdat(pos, io.NewSectionReader(file, int64(pos), int64(hdr.Size)))
+		if err != nil {
+			return pos, err
+		}
+		f.AddChild(box, pos)
+		pos = end
+	}
+	return pos, nil
+}
+
+// completeBoxHeader returns header of the box at pos if the whole box is
+// below size
+func completeBoxHeader(file *os.File, pos, size uint64) (mp4.BoxHeader, bool) {
+	if pos >= size {
+		return mp4.BoxHeader{}, false
+	}
+	hdr, err := mp4.DecodeHeader(io.NewSectionReader(file, int64(pos), int64(size-pos)))
+	if err != nil || pos+hdr.Size > size {
+		return mp4.BoxHeader{}, false
+	}
+	return hdr, true
+}
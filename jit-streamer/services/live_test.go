@@ -0,0 +1,108 @@
+package services
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestLiveSource grows a fragmented file in steps, cutting it in the middle
+// of boxes, and checks that listed segments only grow and never change
+func TestLiveSource(t *testing.T) {
+	full, err := os.ReadFile(writeFragmentedFixture(t, 1, 0, fixtureVideo(), fixtureAudio()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, refVF := openFixture(t, fixtureVideo(), fixtureAudio())
+
+	path := filepath.Join(t.TempDir(), "live.mp4")
+	if err := os.WriteFile(path, full[:len(full)/3], 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewSegmenter(1, 60, 0)
+	t.Cleanup(s.Close)
+	vf, err := s.OpenVideo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !vf.Live || !vf.Event {
+		t.Fatalf("growing file not opened live")
+	}
+
+	// Listed segments must match the finished file byte for byte
+	checkSegments := func(vf *VideoFile) {
+		t.Helper()
+		if len(vf.Segments) > len(refVF.Segments) || len(vf.AudioSegments) > len(refVF.AudioSegments) {
+			t.Fatalf("%d/%d segments, finished file has %d/%d", len(vf.Segments), len(vf.AudioSegments),
+				len(refVF.Segments), len(refVF.AudioSegments))
+		}
+		for i, seg := range vf.Segments {
+			if seg != refVF.Segments[i] {
+				t.Errorf("video segment %d is %+v, want %+v", i, seg, refVF.Segments[i])
+			}
+			got, err := s.GenerateMediaSegment(vf, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, _ := ref.GenerateMediaSegment(refVF, i); !bytes.Equal(got, want) {
+				t.Errorf("video segment %d differs", i)
+			}
+		}
+		for i, seg := range vf.AudioSegments {
+			if seg != refVF.AudioSegments[i] {
+				t.Errorf("audio segment %d is %+v, want %+v", i, seg, refVF.AudioSegments[i])
+			}
+		}
+	}
+	checkSegments(vf)
+
+	listed := len(vf.Segments)
+	written := len(full) / 3
+	for _, end := range []int{len(full) / 2, len(full)*3/4 + 5, len(full)} {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(full[written:end]); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		written = end
+
+		vf.refreshed = time.Time{}
+		if vf, err = s.OpenVideo(path); err != nil {
+			t.Fatal(err)
+		}
+		if !vf.Live {
+			t.Fatalf("file still written to is not live")
+		}
+		if len(vf.Segments) < listed {
+			t.Errorf("segments went from %d to %d", listed, len(vf.Segments))
+		}
+		listed = len(vf.Segments)
+		checkSegments(vf)
+	}
+	if listed == len(refVF.Segments) {
+		t.Errorf("last segment listed while live")
+	}
+
+	// Writer done: idle for longer than the timeout
+	old := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	vf.refreshed = time.Time{}
+	if vf, err = s.OpenVideo(path); err != nil {
+		t.Fatal(err)
+	}
+	if vf.Live || !vf.Event {
+		t.Errorf("finalized file: live %v event %v", vf.Live, vf.Event)
+	}
+	if len(vf.Segments) != len(refVF.Segments) || len(vf.AudioSegments) != len(refVF.AudioSegments) {
+		t.Errorf("finalized file has %d/%d segments, want %d/%d", len(vf.Segments), len(vf.AudioSegments),
+			len(refVF.Segments), len(refVF.AudioSegments))
+	}
+	checkSegments(vf)
+}
@@ -3,8 +3,11 @@ package services
 import (
 	"bytes"
 	"fmt"
+	"math"
+	"net/url"
 	"strings"
 	"text/template"
+	"time"
 )
 
 type ManifestService struct {
@@ -12,10 +15,126 @@ type ManifestService struct {
 }
 
 type VideoParams struct {
-	Codec     string
-	Width     uint32
-	Height    uint32
+	Codec        string
+	Width        uint32
+	Height       uint32
+	Timescale    uint32
+	Bandwidth    uint32          // measured peak bitrate of the original
+	AvgBandwidth uint32          // measured average bitrate of the original
+	Variants     []VariantParams // transcoded ABR ladder
+	Audio        *AudioParams    // nil when source has no audio
+	AudioTracks  []AudioParams   // every audio track when there are several, Audio is the default
+	Live         *LiveParams     // nil for files that were never live
+	Query        string          // appended to every URI, selects a sub-clip
+	TrickPlay    *TrickPlayParams
+	Thumbnails   *ThumbnailParams  // nil without thumbnail track
+	Subtitles    []SubtitleParams  // sidecar subtitles
+	Encryption   *EncryptionParams // nil when segments are clear
+}
+
+// EncryptionParams describes Common Encryption of video and audio segments
+// with a ClearKey key
+type EncryptionParams struct {
+	Scheme     string // "cenc" or "cbcs"
+	KID        string // hex
+	PSSH       string // base64 of the ClearKey pssh box
+	LicenseURL string
+}
+
+// DefaultKID returns the key ID in UUID form of cenc:default_KID
+func (e *EncryptionParams) DefaultKID() string {
+	k := e.KID
+	if len(k) != 32 {
+		return k
+	}
+	return k[:8] + "-" + k[8:12] + "-" + k[12:16] + "-" + k[16:20] + "-" + k[20:]
+}
+
+// hlsKeyAttrs returns attributes of EXT-X-KEY and EXT-X-SESSION-KEY. The
+// ClearKey pssh goes in a data URI, players get the key from LicenseURL
+func (e *EncryptionParams) hlsKeyAttrs() string {
+	method := "SAMPLE-AES"
+	if e.Scheme == "cenc" {
+		method = "SAMPLE-AES-CTR"
+	}
+	return fmt.Sprintf("METHOD=%s,URI=\"data:text/plain;base64,%s\",KEYID=0x%s,KEYFORMAT=\"urn:uuid:%s\",KEYFORMATVERSIONS=\"1\"",
+		method, e.PSSH, e.KID, ClearKeySystemID)
+}
+
+// SubtitleParams describes a subtitle rendition. Its segments follow the
+// video segments of the original
+type SubtitleParams struct {
+	Language string
+}
+
+// TrickPlayParams describes I-frame segments of the original
+type TrickPlayParams struct {
+	Bandwidth      uint32 // measured peak bitrate of I-frame segments
+	MaxPlayoutRate int
+}
+
+// LiveParams describes a source that is or was being recorded while served
+type LiveParams struct {
+	Ended     bool      // writer is done, playlists get ENDLIST and MPD is static
+	StartTime time.Time // wall clock time of media time zero
+
+	LowLatency *LowLatencyParams // LL-HLS parts, nil while not live and for MPEG-TS
+}
+
+// LowLatencyParams lists LL-HLS parts of the last segments of a playlist
+type LowLatencyParams struct {
+	PartTarget   float64  // seconds
+	FirstSegment int      // segment Parts[0] belongs to
+	Parts        [][]Part // last entry belongs to the segment being written
+}
+
+// VariantParams describes one rung of the ABR ladder, either transcoded or
+// remuxed from a pre-encoded file. Its playlist and segments live in a
+// subdirectory named after the rung
+type VariantParams struct {
+	Name         string
+	Codec        string
+	Width        uint32
+	Height       uint32
+	Bandwidth    uint32
+	AvgBandwidth uint32
+
+	// Own timing of a pre-encoded rendition, nil when it follows the source
 	Timescale uint32
+	Segments  []Segment
+}
+
+// AudioParams describes the separate audio rendition
+type AudioParams struct {
+	Codec       string
+	Channels    uint16
+	Bandwidth   uint32
+	Timescale   uint32
+	SampleRate  uint32 // in Hz
+	DurationSec float64
+	Segments    []Segment
+
+	// Track of a source with several audio tracks
+	Track    int
+	Language string
+	Name     string
+	Role     string // DASH role, empty leaves it out
+	Default  bool
+	Query    string // appended to URIs of the track instead of VideoParams.Query
+}
+
+// audioTracks returns audio renditions of the audio group
+func (params VideoParams) audioTracks() []AudioParams {
+	if len(params.AudioTracks) > 0 {
+		return params.AudioTracks
+	}
+	if params.Audio == nil {
+		return nil
+	}
+	audio := *params.Audio
+	audio.Default = true
+	audio.Query = params.Query
+	return []AudioParams{audio}
 }
 
 func NewManifestService(segmentDurationSec int) *ManifestService {
@@ -29,63 +148,435 @@ func (m *ManifestService) GenerateHLSMasterPlaylist(videoName string, durationSe
 	var buf bytes.Buffer
 	buf.WriteString("#EXTM3U\n")
 	buf.WriteString("#EXT-X-VERSION:6\n")
+	if params.Encryption != nil {
+		// Lets players request the key before loading media playlists
+		buf.WriteString("#EXT-X-SESSION-KEY:" + params.Encryption.hlsKeyAttrs() + "\n")
+	}
 	buf.WriteString("\n")
 
+	variants := m.videoVariants(params)
+
+	audioCodec := ""
+	audioGroup := ""
+	var audioBandwidth uint32
+	if tracks := params.audioTracks(); len(tracks) > 0 {
+		// Audio is a separate rendition referenced from variants by group.
+		// Variants declare codecs and bandwidth of every track in the group
+		names := make(map[string]bool)
+		codecs := make(map[string]bool)
+		for _, a := range tracks {
+			buf.WriteString(fmt.Sprintf("#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",%s,CHANNELS=\"%d\",URI=\"audio.m3u8%s\"\n",
+				audioRenditionAttrs(a, names), a.Channels, a.Query))
+			if !codecs[a.Codec] {
+				codecs[a.Codec] = true
+				audioCodec += "," + a.Codec
+			}
+			audioBandwidth = max(audioBandwidth, a.Bandwidth)
+		}
+		buf.WriteString("\n")
+		audioGroup = ",AUDIO=\"audio\""
+	}
+	if len(params.Subtitles) > 0 {
+		for _, sub := range params.Subtitles {
+			buf.WriteString(fmt.Sprintf("#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"%s\",LANGUAGE=\"%s\",DEFAULT=NO,AUTOSELECT=YES,URI=\"subtitles_%s.m3u8%s\"\n",
+				sub.Language, sub.Language, sub.Language, params.Query))
+		}
+		buf.WriteString("\n")
+		audioGroup += ",SUBTITLES=\"subs\""
+	}
+
+	for _, v := range variants {
+		bandwidth := v.Bandwidth + audioBandwidth
+		uri := "media.m3u8" + params.Query
+		if v.Name != "" {
+			uri = v.Name + "/media.m3u8" + params.Query
+		}
+		averageBandwidth := ""
+		if v.AvgBandwidth > 0 {
+			averageBandwidth = fmt.Sprintf(",AVERAGE-BANDWIDTH=%d", v.AvgBandwidth+audioBandwidth)
+		}
+		buf.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d%s,RESOLUTION=%dx%d,CODECS=\"%s%s\"%s\n",
+			bandwidth, averageBandwidth, v.Width, v.Height, v.Codec, audioCodec, audioGroup))
+		buf.WriteString(uri + "\n")
+	}
+
+	if t := params.TrickPlay; t != nil {
+		buf.WriteString("\n")
+		buf.WriteString(fmt.Sprintf("#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\",URI=\"iframes.m3u8%s\"\n",
+			t.Bandwidth, params.Width, params.Height, variants[len(variants)-1].Codec, params.Query))
+	}
+	if t := params.Thumbnails; t != nil {
+		buf.WriteString(fmt.Sprintf("#EXT-X-IMAGE-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"jpeg\",URI=\"thumbnails.m3u8%s\"\n",
+			t.Bandwidth, t.Width, t.Height, params.Query))
+	}
+
+	return buf.String()
+}
+
+// audioRenditionAttrs returns NAME, LANGUAGE, DEFAULT, AUTOSELECT and
+// CHARACTERISTICS of an audio rendition. Names must be unique in the group,
+// taken ones are passed in names
+func audioRenditionAttrs(a AudioParams, names map[string]bool) string {
+	name := a.Name
+	if name == "" {
+		name = a.Language
+	}
+	if name == "" {
+		name = "default"
+	}
+	if names[name] {
+		name = fmt.Sprintf("%s %d", name, a.Track+1)
+	}
+	names[name] = true
+
+	attrs := fmt.Sprintf("NAME=\"%s\"", strings.ReplaceAll(name, "\"", "'"))
+	if a.Language != "" {
+		attrs += fmt.Sprintf(",LANGUAGE=\"%s\"", a.Language)
+	}
+	if a.Default {
+		attrs += ",DEFAULT=YES"
+	} else {
+		attrs += ",DEFAULT=NO"
+	}
+	attrs += ",AUTOSELECT=YES"
+	if a.Role == "description" {
+		attrs += ",CHARACTERISTICS=\"public.accessibility.describes-video\""
+	}
+	return attrs
+}
+
+// HLS Master Playlist of the MPEG-TS variant. It has a single muxed stream,
+// AAC audio is part of the TS segments
+func (m *ManifestService) GenerateHLSTSMasterPlaylist(videoName string, params VideoParams) string {
+	original := m.videoVariants(VideoParams{
+		Codec:        params.Codec,
+		Width:        params.Width,
+		Height:       params.Height,
+		Bandwidth:    params.Bandwidth,
+		AvgBandwidth: params.AvgBandwidth,
+	})[0]
+
+	codecs := original.Codec
+	bandwidth := original.Bandwidth
+	avgBandwidth := original.AvgBandwidth
+	if params.Audio != nil && strings.HasPrefix(params.Audio.Codec, "mp4a.") {
+		codecs += "," + params.Audio.Codec
+		bandwidth += params.Audio.Bandwidth
+		if avgBandwidth > 0 {
+			avgBandwidth += params.Audio.Bandwidth
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:3\n")
+	buf.WriteString("\n")
+	averageBandwidth := ""
+	if avgBandwidth > 0 {
+		averageBandwidth = fmt.Sprintf(",AVERAGE-BANDWIDTH=%d", avgBandwidth)
+	}
+	buf.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d%s,RESOLUTION=%dx%d,CODECS=\"%s\"\n",
+		bandwidth, averageBandwidth, original.Width, original.Height, codecs))
+	buf.WriteString("media_ts.m3u8" + params.Query + "\n")
+	return buf.String()
+}
+
+// videoVariants returns ladder rungs followed by the original stream, which
+// is listed with an empty name
+func (m *ManifestService) videoVariants(params VideoParams) []VariantParams {
 	codec := params.Codec
 	if codec == "" {
 		codec = "avc1.640028"
 	}
+	bandwidth := params.Bandwidth
+	if bandwidth == 0 {
+		bandwidth = 5000000
+	}
 
-	// Single quality (original) - video only
-	buf.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=%dx%d,CODECS=\"%s\"\n",
-		params.Width, params.Height, codec))
-	buf.WriteString("media.m3u8\n")
-
-	return buf.String()
+	variants := append([]VariantParams{}, params.Variants...)
+	return append(variants, VariantParams{
+		Codec:        codec,
+		Width:        params.Width,
+		Height:       params.Height,
+		Bandwidth:    bandwidth,
+		AvgBandwidth: params.AvgBandwidth,
+	})
 }
 
 // HLS Media Playlist
-func (m *ManifestService) GenerateHLSMediaPlaylist(videoName string, durationSec float64, segmentCount int) string {
+func (m *ManifestService) GenerateHLSMediaPlaylist(videoName string, segments []Segment, timescale uint32, live *LiveParams, encryption *EncryptionParams, query string) string {
+	return m.generateHLSMediaPlaylist("init.mp4", "segment_", ".m4s", segments, timescale, live, encryption, query)
+}
+
+// HLS Media Playlist with MPEG-TS segments for clients without fMP4 support.
+// Audio is muxed into the same segments
+func (m *ManifestService) GenerateHLSTSPlaylist(videoName string, segments []Segment, timescale uint32, live *LiveParams, query string) string {
+	return m.generateHLSMediaPlaylist("", "segment_", ".ts", segments, timescale, live, nil, query)
+}
+
+// HLS Media Playlist of the audio rendition
+func (m *ManifestService) GenerateHLSAudioPlaylist(videoName string, audio AudioParams, live *LiveParams, encryption *EncryptionParams, query string) string {
+	return m.generateHLSMediaPlaylist("audio_init.mp4", "audio_segment_", ".m4s", audio.Segments, audio.Timescale, live, encryption, query)
+}
+
+// HLS Media Playlist of a subtitle rendition with WebVTT segments
+func (m *ManifestService) GenerateHLSSubtitlePlaylist(videoName, lang string, segments []Segment, timescale uint32, live *LiveParams, query string) string {
+	return m.generateHLSMediaPlaylist("", "subtitles_"+lang+"_", ".vtt", segments, timescale, live, nil, query)
+}
+
+// HLS I-frame playlist addressing sync samples of every segment by byte
+// range in iframes_N.m4s
+func (m *ManifestService) GenerateHLSIFramePlaylist(videoName string, frames [][]IFrame, timescale uint32, live *LiveParams, query string) string {
+	targetDuration := 1
+	for _, segment := range frames {
+		for _, frame := range segment {
+			targetDuration = max(targetDuration, int(math.Ceil(float64(frame.Duration)/float64(timescale))))
+		}
+	}
+	if live != nil && m.segmentDuration > targetDuration {
+		targetDuration = m.segmentDuration
+	}
+
 	var buf bytes.Buffer
 	buf.WriteString("#EXTM3U\n")
 	buf.WriteString("#EXT-X-VERSION:6\n")
-	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", m.segmentDuration))
+	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", targetDuration))
+	buf.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	if live != nil {
+		buf.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	} else {
+		buf.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	}
+	buf.WriteString("#EXT-X-I-FRAMES-ONLY\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"init.mp4%s\"\n", query))
+	buf.WriteString("\n")
+
+	for n, segment := range frames {
+		for _, frame := range segment {
+			buf.WriteString(fmt.Sprintf("#EXTINF:%.6f,\n", float64(frame.Duration)/float64(timescale)))
+			buf.WriteString(fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d\n", frame.Length, frame.Offset))
+			buf.WriteString(fmt.Sprintf("iframes_%d.m4s%s\n", n, query))
+		}
+	}
+
+	if live == nil || live.Ended {
+		buf.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return buf.String()
+}
+
+// HLS image playlist of thumbnail sprite sheets
+func (m *ManifestService) GenerateHLSImagePlaylist(videoName string, thumbnails ThumbnailParams, durationSec float64, query string) string {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:7\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(thumbnails.SheetDuration()))))
 	buf.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
 	buf.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
-	buf.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+	buf.WriteString("#EXT-X-IMAGES-ONLY\n")
 	buf.WriteString("\n")
 
-	remainingDuration := durationSec
-	for i := 0; i < segmentCount; i++ {
-		segDur := float64(m.segmentDuration)
-		if remainingDuration < segDur {
-			segDur = remainingDuration
+	for n := 0; n < thumbnails.Sheets(); n++ {
+		start := float64(n) * thumbnails.SheetDuration()
+		buf.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", min(thumbnails.SheetDuration(), durationSec-start)))
+		buf.WriteString(fmt.Sprintf("#EXT-X-TILES:RESOLUTION=%dx%d,LAYOUT=%dx%d,DURATION=%.3f\n",
+			thumbnails.Width, thumbnails.Height, thumbnails.Columns, thumbnails.Rows, thumbnails.Interval))
+		buf.WriteString(fmt.Sprintf("thumbnails_%d.jpg%s\n", n, query))
+	}
+	buf.WriteString("#EXT-X-ENDLIST\n")
+	return buf.String()
+}
+
+// GenerateThumbnailVTT writes WebVTT track with a cue per thumbnail pointing
+// into its sprite sheet by media fragment
+func (m *ManifestService) GenerateThumbnailVTT(thumbnails ThumbnailParams, durationSec float64, query string) string {
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n")
+
+	perSheet := thumbnails.Columns * thumbnails.Rows
+	for i := 0; i < thumbnails.Count; i++ {
+		start := float64(i) * thumbnails.Interval
+		end := min(start+thumbnails.Interval, durationSec)
+		tile := i % perSheet
+		x := uint32(tile%thumbnails.Columns) * thumbnails.Width
+		y := uint32(tile/thumbnails.Columns) * thumbnails.Height
+		buf.WriteString(fmt.Sprintf("\n%s --> %s\n", formatVTTTime(start), formatVTTTime(end)))
+		buf.WriteString(fmt.Sprintf("thumbnails_%d.jpg%s#xywh=%d,%d,%d,%d\n", i/perSheet, query, x, y, thumbnails.Width, thumbnails.Height))
+	}
+	return buf.String()
+}
+
+// formatVTTTime formats seconds as hh:mm:ss.ttt
+func formatVTTTime(sec float64) string {
+	ms := int64(math.Round(sec * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// generateHLSMediaPlaylist writes VOD playlist, or EVENT playlist when live
+// is set. EXT-X-MAP is omitted when initURI is empty, EXT-X-KEY when
+// encryption is nil. query is appended to every URI
+func (m *ManifestService) generateHLSMediaPlaylist(initURI, segmentPrefix, segmentExt string, segments []Segment, timescale uint32, live *LiveParams, encryption *EncryptionParams, query string) string {
+	// Segments are cut at keyframes, so durations vary around the nominal one
+	durations := make([]float64, len(segments))
+	targetDuration := 1
+	for i, seg := range segments {
+		if timescale > 0 {
+			durations[i] = float64(seg.Duration) / float64(timescale)
 		}
+		if d := int(math.Ceil(durations[i])); d > targetDuration {
+			targetDuration = d
+		}
+	}
+	// Target duration must not change while segments are added
+	if live != nil && m.segmentDuration > targetDuration {
+		targetDuration = m.segmentDuration
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:6\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", targetDuration))
+	buf.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	// Playlist type must not change, an EVENT playlist becomes VOD by ENDLIST
+	if live != nil {
+		buf.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	} else {
+		buf.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	}
+	var ll *LowLatencyParams
+	if live != nil && !live.Ended {
+		ll = live.LowLatency
+	}
+	if ll != nil {
+		buf.WriteString(fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*ll.PartTarget))
+		buf.WriteString(fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.3f\n", ll.PartTarget))
+	}
+	if encryption != nil {
+		buf.WriteString("#EXT-X-KEY:" + encryption.hlsKeyAttrs() + "\n")
+	}
+	if initURI != "" {
+		buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s%s\"\n", initURI, query))
+	}
+	buf.WriteString("\n")
+
+	// Parts are named like segments: part_N.P.m4s, audio_part_N.P.m4s
+	partPrefix := strings.TrimSuffix(segmentPrefix, "segment_") + "part_"
+	writeParts := func(n int) {
+		if ll == nil || n < ll.FirstSegment || n-ll.FirstSegment >= len(ll.Parts) {
+			return
+		}
+		for p, part := range ll.Parts[n-ll.FirstSegment] {
+			independent := ""
+			if part.Independent {
+				independent = ",INDEPENDENT=YES"
+			}
+			buf.WriteString(fmt.Sprintf("#EXT-X-PART:DURATION=%.6f,URI=\"%s%d.%d%s%s\"%s\n",
+				float64(part.Duration)/float64(timescale), partPrefix, n, p, segmentExt, query, independent))
+		}
+	}
+
+	for i, segDur := range durations {
+		writeParts(i)
 		buf.WriteString(fmt.Sprintf("#EXTINF:%.6f,\n", segDur))
-		buf.WriteString(fmt.Sprintf("segment_%d.m4s\n", i))
-		remainingDuration -= segDur
+		buf.WriteString(fmt.Sprintf("%s%d%s%s\n", segmentPrefix, i, segmentExt, query))
+	}
+	if ll != nil {
+		// Segment being written, the client asks for its next part ahead
+		n := len(segments)
+		writeParts(n)
+		next := 0
+		if n-ll.FirstSegment < len(ll.Parts) {
+			next = len(ll.Parts[n-ll.FirstSegment])
+		}
+		buf.WriteString(fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s%d.%d%s%s\"\n", partPrefix, n, next, segmentExt, query))
 	}
 
-	buf.WriteString("#EXT-X-ENDLIST\n")
+	if live == nil || live.Ended {
+		buf.WriteString("#EXT-X-ENDLIST\n")
+	}
 	return buf.String()
 }
 
-// DASH MPD Template - video only
+// DASH MPD Template - video and optional audio
 const dashMPDTemplate = `<?xml version="1.0" encoding="UTF-8"?>
 <MPD xmlns="urn:mpeg:dash:schema:mpd:2011"
      xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"
      xsi:schemaLocation="urn:mpeg:dash:schema:mpd:2011 DASH-MPD.xsd"
+{{- if .Encryption}}
+     xmlns:cenc="urn:mpeg:cenc:2013"
+     xmlns:dashif="https://dashif.org/CPS"
+{{- end}}
+{{- if .Dynamic}}
+     type="dynamic"
+     availabilityStartTime="{{.AvailabilityStartTime}}"
+     publishTime="{{.PublishTime}}"
+     minimumUpdatePeriod="PT{{.MinimumUpdatePeriod}}S"
+     minBufferTime="PT2S"
+     profiles="urn:mpeg:dash:profile:isoff-live:2011">
+{{- else}}
      type="static"
      mediaPresentationDuration="PT{{.DurationStr}}"
      minBufferTime="PT2S"
      profiles="urn:mpeg:dash:profile:isoff-on-demand:2011">
+{{- end}}
   <Period id="0" start="PT0S">
-    <AdaptationSet id="0" contentType="video" mimeType="video/mp4" segmentAlignment="true" bitstreamSwitching="true">
-      <Representation id="video" codecs="{{.Codec}}"
-                      bandwidth="5000000" width="{{.Width}}" height="{{.Height}}">
+    <AdaptationSet id="0" contentType="video" mimeType="video/mp4" segmentAlignment="true">
+{{- template "protection" $.Encryption}}
+{{- range .Representations}}
+      <Representation id="{{.ID}}" codecs="{{.Codec}}"
+                      bandwidth="{{.Bandwidth}}" width="{{.Width}}" height="{{.Height}}">
+        <SegmentTemplate timescale="{{.Timescale}}"
+                         initialization="{{.Prefix}}init.mp4{{$.Query}}"
+                         media="{{.Prefix}}segment_$Number$.m4s{{$.Query}}"
+                         startNumber="0">
+          <SegmentTimeline>
+{{.SegmentTimeline}}
+          </SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+{{- end}}
+    </AdaptationSet>
+{{- if .TrickPlay}}
+    <AdaptationSet id="2" contentType="video" mimeType="video/mp4" segmentAlignment="true">
+      <EssentialProperty schemeIdUri="http://dashif.org/guidelines/trickmode" value="0"/>
+      <Representation id="trickplay" codecs="{{.TrickPlay.Codec}}"
+                      bandwidth="{{.TrickPlay.Bandwidth}}" width="{{.TrickPlay.Width}}" height="{{.TrickPlay.Height}}"
+                      maxPlayoutRate="{{.TrickPlay.MaxPlayoutRate}}" codingDependency="false">
+        <SegmentTemplate timescale="{{.TrickPlay.Timescale}}"
+                         initialization="init.mp4{{.Query}}"
+                         media="iframes_$Number$.m4s{{.Query}}"
+                         startNumber="0">
+          <SegmentTimeline>
+{{.TrickPlay.SegmentTimeline}}
+          </SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>
+{{- end}}
+{{- if .Thumbnails}}
+    <AdaptationSet id="3" contentType="image" mimeType="image/jpeg">
+      <SegmentTemplate timescale="1000" duration="{{.Thumbnails.SheetDuration}}"
+                       media="thumbnails_$Number$.jpg{{.Query}}" startNumber="0"/>
+      <Representation id="thumbnails" bandwidth="{{.Thumbnails.Bandwidth}}" width="{{.Thumbnails.Width}}" height="{{.Thumbnails.Height}}">
+        <EssentialProperty schemeIdUri="http://dashif.org/guidelines/thumbnail_tile" value="{{.Thumbnails.Columns}}x{{.Thumbnails.Rows}}"/>
+      </Representation>
+    </AdaptationSet>
+{{- end}}
+{{- range .Audio}}
+    <AdaptationSet id="{{.ID}}" contentType="audio" mimeType="audio/mp4"{{if .Language}} lang="{{.Language}}"{{end}} segmentAlignment="true">
+{{- if .Name}}
+      <Label>{{html .Name}}</Label>
+{{- end}}
+{{- if .Role}}
+      <Role schemeIdUri="urn:mpeg:dash:role:2011" value="{{.Role}}"/>
+{{- end}}
+{{- template "protection" $.Encryption}}
+      <Representation id="{{.RepresentationID}}" codecs="{{.Codec}}"
+                      bandwidth="{{.Bandwidth}}" audioSamplingRate="{{.SampleRate}}">
+        <AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="{{.Channels}}"/>
         <SegmentTemplate timescale="{{.Timescale}}"
-                         initialization="init.mp4"
-                         media="segment_$Number$.m4s"
+                         initialization="audio_init.mp4{{.Query}}"
+                         media="audio_segment_$Number$.m4s{{.Query}}"
                          startNumber="0">
           <SegmentTimeline>
 {{.SegmentTimeline}}
@@ -93,67 +584,413 @@ const dashMPDTemplate = `<?xml version="1.0" encoding="UTF-8"?>
         </SegmentTemplate>
       </Representation>
     </AdaptationSet>
+{{- end}}
+{{- range .Subtitles}}
+    <AdaptationSet id="{{.ID}}" contentType="text" mimeType="application/mp4" lang="{{.Language}}" segmentAlignment="true">
+      <Role schemeIdUri="urn:mpeg:dash:role:2011" value="subtitle"/>
+      <Representation id="subtitles_{{.Language}}" codecs="wvtt" bandwidth="{{.Bandwidth}}">
+        <SegmentTemplate timescale="{{.Timescale}}"
+                         initialization="subtitles_{{.Language}}_init.mp4{{$.Query}}"
+                         media="subtitles_{{.Language}}_$Number$.m4s{{$.Query}}"
+                         startNumber="0">
+          <SegmentTimeline>
+{{.SegmentTimeline}}
+          </SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>
+{{- end}}
   </Period>
-</MPD>`
+</MPD>
+{{- define "protection"}}
+{{- if .}}
+      <ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011" value="{{.Scheme}}" cenc:default_KID="{{.DefaultKID}}"/>
+      <ContentProtection schemeIdUri="urn:uuid:e2719d58-a985-b3c9-781a-b030af78d30e" value="ClearKey1.0">
+        <cenc:pssh>{{.PSSH}}</cenc:pssh>
+        <dashif:Laurl>{{html .LicenseURL}}</dashif:Laurl>
+      </ContentProtection>
+{{- end}}
+{{- end}}`
 
 type DASHMPDData struct {
 	DurationStr     string
-	Timescale       uint32
-	SegmentTimeline string
+	Representations []DASHRepresentation
+
+	// Live source still being written
+	Dynamic               bool
+	AvailabilityStartTime string
+	PublishTime           string
+	MinimumUpdatePeriod   int
+
+	Query string // XML escaped, selects a sub-clip
+
+	Audio []DASHAudio
+
+	TrickPlay  *DASHTrickPlay  // nil without I-frame segments
+	Thumbnails *DASHThumbnails // nil without thumbnail track
+	Subtitles  []DASHSubtitles
+
+	Encryption *EncryptionParams // ContentProtection of video and audio sets, nil when clear
+}
+
+// DASHRepresentation is a video Representation
+type DASHRepresentation struct {
+	ID              string
+	Prefix          string // path of init and media segments relative to MPD
 	Codec           string
+	Bandwidth       uint32
 	Width           uint32
 	Height          uint32
+	Timescale       uint32
+	SegmentTimeline string
 }
 
-func (m *ManifestService) GenerateDASHMPD(videoName string, durationSec float64, segmentCount int, params VideoParams) (string, error) {
-	// Format duration as ISO 8601 duration
+// DASHAudio is an audio AdaptationSet. The default track has id 1, others
+// 100 plus their track number, clear of ids of the other sets. Query is XML
+// escaped
+type DASHAudio struct {
+	AudioParams
+	ID               int
+	RepresentationID string
+	SegmentTimeline  string
+}
+
+// DASHTrickPlay is the trick mode Representation of I-frame segments of the
+// original. It shares the SegmentTimeline of the original
+type DASHTrickPlay struct {
+	DASHRepresentation
+	MaxPlayoutRate int
+}
+
+// DASHThumbnails is the image Representation of thumbnail sprite sheets.
+// Width and height are of a whole sheet, SheetDuration is in milliseconds
+type DASHThumbnails struct {
+	Bandwidth     uint32
+	Width         uint32
+	Height        uint32
+	Columns       int
+	Rows          int
+	SheetDuration int
+}
+
+// DASHSubtitles is a text AdaptationSet of wvtt segments. They share the
+// SegmentTimeline of the original
+type DASHSubtitles struct {
+	ID              int
+	Language        string
+	Bandwidth       uint32
+	Timescale       uint32
+	SegmentTimeline string
+}
+
+// subtitleBandwidth is a rough bitrate of wvtt segments, text is tiny next
+// to video
+const subtitleBandwidth = 1000
+
+func (m *ManifestService) GenerateDASHMPD(videoName string, durationSec float64, segments []Segment, params VideoParams) (string, error) {
+	data := DASHMPDData{
+		DurationStr: formatMPDDuration(durationSec),
+		Query:       template.HTMLEscapeString(params.Query),
+		Encryption:  params.Encryption,
+	}
+	if params.Live != nil && !params.Live.Ended {
+		data.Dynamic = true
+		data.AvailabilityStartTime = params.Live.StartTime.UTC().Format(time.RFC3339)
+		data.PublishTime = time.Now().UTC().Format(time.RFC3339)
+		data.MinimumUpdatePeriod = m.segmentDuration
+	}
+	sourceTimeline := m.generateSegmentTimeline(segments)
+	for _, v := range m.videoVariants(params) {
+		rep := DASHRepresentation{
+			ID:              "video",
+			Codec:           v.Codec,
+			Bandwidth:       v.Bandwidth,
+			Width:           v.Width,
+			Height:          v.Height,
+			Timescale:       params.Timescale,
+			SegmentTimeline: sourceTimeline,
+		}
+		if v.Segments != nil {
+			rep.Timescale = v.Timescale
+			rep.SegmentTimeline = m.generateSegmentTimeline(v.Segments)
+		}
+		if v.Name != "" {
+			rep.ID = v.Name
+			rep.Prefix = v.Name + "/"
+		}
+		data.Representations = append(data.Representations, rep)
+	}
+	if t := params.TrickPlay; t != nil {
+		original := data.Representations[len(data.Representations)-1]
+		original.ID = "trickplay"
+		original.Bandwidth = t.Bandwidth
+		data.TrickPlay = &DASHTrickPlay{DASHRepresentation: original, MaxPlayoutRate: t.MaxPlayoutRate}
+	}
+	if t := params.Thumbnails; t != nil {
+		data.Thumbnails = &DASHThumbnails{
+			Bandwidth:     t.Bandwidth,
+			Width:         t.Width * uint32(t.Columns),
+			Height:        t.Height * uint32(t.Rows),
+			Columns:       t.Columns,
+			Rows:          t.Rows,
+			SheetDuration: int(math.Round(t.SheetDuration() * 1000)),
+		}
+	}
+	for i, sub := range params.Subtitles {
+		// Ids 0-3 are taken by video, audio, trick play and thumbnails
+		data.Subtitles = append(data.Subtitles, DASHSubtitles{
+			ID:              4 + i,
+			Language:        sub.Language,
+			Bandwidth:       subtitleBandwidth,
+			Timescale:       params.Timescale,
+			SegmentTimeline: sourceTimeline,
+		})
+	}
+	for _, a := range params.audioTracks() {
+		set := DASHAudio{AudioParams: a, ID: 1, RepresentationID: "audio", SegmentTimeline: m.generateSegmentTimeline(a.Segments)}
+		set.Query = template.HTMLEscapeString(a.Query)
+		if !a.Default {
+			set.ID = 100 + a.Track
+			set.RepresentationID = fmt.Sprintf("audio_%d", a.Track)
+		}
+		data.Audio = append(data.Audio, set)
+	}
+
+	tmpl, err := template.New("mpd").Parse(dashMPDTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// formatMPDDuration formats duration as ISO 8601 duration without the PT
+// prefix
+func formatMPDDuration(durationSec float64) string {
 	hours := int(durationSec) / 3600
 	minutes := (int(durationSec) % 3600) / 60
 	seconds := durationSec - float64(hours*3600+minutes*60)
 
-	var durationStr string
 	if hours > 0 {
-		durationStr = fmt.Sprintf("%dH%dM%.3fS", hours, minutes, seconds)
+		return fmt.Sprintf("%dH%dM%.3fS", hours, minutes, seconds)
 	} else if minutes > 0 {
-		durationStr = fmt.Sprintf("%dM%.3fS", minutes, seconds)
-	} else {
-		durationStr = fmt.Sprintf("%.3fS", seconds)
+		return fmt.Sprintf("%dM%.3fS", minutes, seconds)
 	}
+	return fmt.Sprintf("%.3fS", seconds)
+}
 
-	// Generate segment timeline
+// generateSegmentTimeline writes actual segment durations, merging runs of
+// equal durations with the r attribute
+func (m *ManifestService) generateSegmentTimeline(segments []Segment) string {
 	var timeline strings.Builder
-	segmentDurTS := uint64(m.segmentDuration) * uint64(params.Timescale)
-	totalDurTS := uint64(durationSec * float64(params.Timescale))
 
-	var currentTime uint64 = 0
-	for i := 0; i < segmentCount; i++ {
-		dur := segmentDurTS
-		if currentTime+dur > totalDurTS {
-			dur = totalDurTS - currentTime
+	for i := 0; i < len(segments); {
+		dur := segments[i].Duration
+		repeat := 0
+		for i+repeat+1 < len(segments) && segments[i+repeat+1].Duration == dur {
+			repeat++
 		}
+
+		timeline.WriteString("            <S")
 		if i == 0 {
-			timeline.WriteString(fmt.Sprintf("            <S t=\"0\" d=\"%d\"/>\n", dur))
-		} else {
-			timeline.WriteString(fmt.Sprintf("            <S d=\"%d\"/>\n", dur))
+			timeline.WriteString(fmt.Sprintf(" t=\"%d\"", segments[0].StartTime))
+		}
+		timeline.WriteString(fmt.Sprintf(" d=\"%d\"", dur))
+		if repeat > 0 {
+			timeline.WriteString(fmt.Sprintf(" r=\"%d\"", repeat))
 		}
-		currentTime += dur
+		timeline.WriteString("/>\n")
+
+		i += repeat + 1
 	}
 
-	codec := params.Codec
-	if codec == "" {
-		codec = "avc1.640028"
+	return strings.TrimSuffix(timeline.String(), "\n")
+}
+
+// GenerateChannelPlaylist writes sliding window media playlist of a linear
+// channel. Every video occurrence starts with a discontinuity and its own
+// init segment, segments are served by the VOD routes of the video. query
+// returns what is appended to URIs of a video
+func (m *ManifestService) GenerateChannelPlaylist(segments []ChannelSegment, targetDuration int, audio bool, query func(video string) string) string {
+	var sequence, discontinuity uint64
+	if len(segments) > 0 {
+		sequence = segments[0].Sequence
+		discontinuity = segments[0].Occurrence
 	}
 
-	data := DASHMPDData{
-		DurationStr:     durationStr,
-		Timescale:       params.Timescale,
-		SegmentTimeline: strings.TrimSuffix(timeline.String(), "\n"),
-		Codec:           codec,
-		Width:           params.Width,
-		Height:          params.Height,
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:6\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", max(targetDuration, m.segmentDuration)))
+	buf.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", sequence))
+	buf.WriteString(fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuity))
+	buf.WriteString("\n")
+
+	for i, seg := range segments {
+		vf := seg.VideoFile
+		prefix := channelSegmentPath("hls", seg.Video)
+		q := query(seg.Video)
+		if i == 0 || seg.Occurrence != segments[i-1].Occurrence {
+			if i > 0 {
+				buf.WriteString("#EXT-X-DISCONTINUITY\n")
+			}
+			initURI := prefix + "init.mp4"
+			if audio {
+				initURI = prefix + "audio_init.mp4"
+			}
+			buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s%s\"\n", initURI, q))
+			buf.WriteString(fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.Start.UTC().Format("2006-01-02T15:04:05.000Z07:00")))
+		}
+		if audio {
+			buf.WriteString(fmt.Sprintf("#EXTINF:%.6f,\n", float64(vf.AudioSegments[seg.Index].Duration)/float64(vf.AudioTimescale)))
+			buf.WriteString(fmt.Sprintf("%saudio_segment_%d.m4s%s\n", prefix, seg.Index, q))
+		} else {
+			buf.WriteString(fmt.Sprintf("#EXTINF:%.6f,\n", float64(vf.Segments[seg.Index].Duration)/float64(vf.Timescale)))
+			buf.WriteString(fmt.Sprintf("%ssegment_%d.m4s%s\n", prefix, seg.Index, q))
+		}
 	}
+	return buf.String()
+}
 
-	tmpl, err := template.New("mpd").Parse(dashMPDTemplate)
+// DASH MPD Template of a sequence of videos - a Period per video occurrence
+// of a linear channel or per video of a virtual asset
+const periodMPDTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011"
+     xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"
+     xsi:schemaLocation="urn:mpeg:dash:schema:mpd:2011 DASH-MPD.xsd"
+{{- if .DurationStr}}
+     type="static"
+     mediaPresentationDuration="PT{{.DurationStr}}"
+     minBufferTime="PT2S"
+     profiles="urn:mpeg:dash:profile:isoff-on-demand:2011">
+{{- else}}
+     type="dynamic"
+     availabilityStartTime="{{.AvailabilityStartTime}}"
+     publishTime="{{.PublishTime}}"
+     minimumUpdatePeriod="PT{{.MinimumUpdatePeriod}}S"
+     timeShiftBufferDepth="PT{{.TimeShiftBufferDepth}}S"
+     minBufferTime="PT2S"
+     profiles="urn:mpeg:dash:profile:isoff-live:2011">
+{{- end}}
+{{- range .Periods}}
+  <Period id="{{.ID}}" start="PT{{.Start}}S">
+    <AdaptationSet id="0" contentType="video" mimeType="video/mp4" segmentAlignment="true">
+      <Representation id="video" codecs="{{.Codec}}"
+                      bandwidth="{{.Bandwidth}}" width="{{.Width}}" height="{{.Height}}">
+        <SegmentTemplate timescale="{{.Timescale}}"
+                         presentationTimeOffset="{{.PresentationTimeOffset}}"
+                         initialization="{{.Prefix}}init.mp4{{.Query}}"
+                         media="{{.Prefix}}segment_$Number$.m4s{{.Query}}"
+                         startNumber="{{.StartNumber}}">
+          <SegmentTimeline>
+{{.SegmentTimeline}}
+          </SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>
+{{- if .Audio}}
+    <AdaptationSet id="1" contentType="audio" mimeType="audio/mp4" segmentAlignment="true">
+      <Representation id="audio" codecs="{{.Audio.Codec}}"
+                      bandwidth="{{.Audio.Bandwidth}}" audioSamplingRate="{{.Audio.SampleRate}}">
+        <AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="{{.Audio.Channels}}"/>
+        <SegmentTemplate timescale="{{.Audio.Timescale}}"
+                         presentationTimeOffset="{{.AudioPresentationTimeOffset}}"
+                         initialization="{{.Prefix}}audio_init.mp4{{.Query}}"
+                         media="{{.Prefix}}audio_segment_$Number$.m4s{{.Query}}"
+                         startNumber="{{.StartNumber}}">
+          <SegmentTimeline>
+{{.AudioSegmentTimeline}}
+          </SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>
+{{- end}}
+  </Period>
+{{- end}}
+</MPD>`
+
+// periodMPDData is static when DurationStr is set
+type periodMPDData struct {
+	DurationStr string
+
+	AvailabilityStartTime string
+	PublishTime           string
+	MinimumUpdatePeriod   int
+	TimeShiftBufferDepth  int
+	Periods               []mpdPeriod
+}
+
+// mpdPeriod is a video occurrence of a channel in the window or a video of
+// an asset
+type mpdPeriod struct {
+	ID                     uint64
+	Start                  string // seconds since availabilityStartTime
+	Prefix                 string // path of the video segments relative to MPD
+	Query                  string // XML escaped, appended to segment URIs
+	StartNumber            int
+	Codec                  string
+	Bandwidth              uint32
+	Width                  uint32
+	Height                 uint32
+	Timescale              uint32
+	PresentationTimeOffset uint64
+	SegmentTimeline        string
+
+	Audio                       *AudioParams
+	AudioPresentationTimeOffset uint64
+	AudioSegmentTimeline        string
+}
+
+// GenerateChannelMPD writes dynamic MPD of a linear channel with a Period
+// per video occurrence in the window. Periods start at the first segment of
+// the occurrence even when it already left the window. query returns what is
+// appended to URIs of a video
+func (m *ManifestService) GenerateChannelMPD(segments []ChannelSegment, availabilityStart time.Time, audio bool, query func(video string) string) (string, error) {
+	data := periodMPDData{
+		AvailabilityStartTime: availabilityStart.UTC().Format(time.RFC3339),
+		PublishTime:           time.Now().UTC().Format(time.RFC3339),
+		MinimumUpdatePeriod:   m.segmentDuration,
+		TimeShiftBufferDepth:  int(ChannelWindow / time.Second),
+	}
+	for i := 0; i < len(segments); {
+		first := segments[i]
+		n := 1
+		for i+n < len(segments) && segments[i+n].Occurrence == first.Occurrence {
+			n++
+		}
+		vf := first.VideoFile
+		period := mpdPeriod{
+			ID:                     first.Occurrence,
+			Start:                  fmt.Sprintf("%.3f", first.VideoStart.Sub(availabilityStart).Seconds()),
+			Prefix:                 template.HTMLEscapeString(channelSegmentPath("dash", first.Video)),
+			Query:                  template.HTMLEscapeString(query(first.Video)),
+			StartNumber:            first.Index,
+			Codec:                  vf.VideoCodec,
+			Bandwidth:              vf.Bandwidth,
+			Width:                  vf.Width,
+			Height:                 vf.Height,
+			Timescale:              vf.Timescale,
+			PresentationTimeOffset: vf.Segments[0].StartTime,
+			SegmentTimeline:        m.generateSegmentTimeline(vf.Segments[first.Index : first.Index+n]),
+		}
+		if audio {
+			period.Audio = periodAudio(vf)
+			period.AudioPresentationTimeOffset = vf.AudioSegments[0].StartTime
+			period.AudioSegmentTimeline = m.generateSegmentTimeline(vf.AudioSegments[first.Index : first.Index+n])
+		}
+		data.Periods = append(data.Periods, period)
+		i += n
+	}
+	return executePeriodMPD(data)
+}
+
+func executePeriodMPD(data periodMPDData) (string, error) {
+	tmpl, err := template.New("mpd").Parse(periodMPDTemplate)
 	if err != nil {
 		return "", err
 	}
@@ -162,6 +999,103 @@ func (m *ManifestService) GenerateDASHMPD(videoName string, durationSec float64,
 	if err := tmpl.Execute(&buf, data); err != nil {
 		return "", err
 	}
-
 	return buf.String(), nil
 }
+
+// periodAudio describes audio of a single video
+func periodAudio(vf *VideoFile) *AudioParams {
+	bandwidth := max(vf.AudioBandwidth, vf.AudioBitrate)
+	if bandwidth == 0 {
+		bandwidth = 128000
+	}
+	return &AudioParams{
+		Codec:      vf.AudioCodec,
+		Channels:   vf.AudioChannels,
+		Bandwidth:  bandwidth,
+		Timescale:  vf.AudioTimescale,
+		SampleRate: vf.AudioSampleRate,
+	}
+}
+
+// channelSegmentPath returns path of the VOD route of a video relative to
+// channel playlists, which are two levels down from the root
+func channelSegmentPath(route, video string) string {
+	// $ would start a SegmentTemplate identifier
+	return "../../" + route + "/" + strings.ReplaceAll(url.PathEscape(video), "$", "%24") + "/"
+}
+
+// GenerateAssetPlaylist writes VOD media playlist of a virtual asset. Every
+// video after the first starts with a discontinuity and its own init
+// segment, decode times keep increasing across joins. query is appended to
+// every URI
+func (m *ManifestService) GenerateAssetPlaylist(parts []AssetPart, audio bool, query string) string {
+	segmentsOf := func(p AssetPart) ([]Segment, uint32) {
+		if audio {
+			return p.VideoFile.AudioSegments[:p.SegmentCount], p.VideoFile.AudioTimescale
+		}
+		return p.VideoFile.Segments[:p.SegmentCount], p.VideoFile.Timescale
+	}
+	targetDuration := 1
+	for _, p := range parts {
+		segments, timescale := segmentsOf(p)
+		for _, seg := range segments {
+			targetDuration = max(targetDuration, int(math.Ceil(float64(seg.Duration)/float64(timescale))))
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:6\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", targetDuration))
+	buf.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	buf.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	buf.WriteString("\n")
+
+	prefix := ""
+	if audio {
+		prefix = "audio_"
+	}
+	for n, p := range parts {
+		if n > 0 {
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%d/%sinit.mp4%s\"\n", n, prefix, query))
+		segments, timescale := segmentsOf(p)
+		for i, seg := range segments {
+			buf.WriteString(fmt.Sprintf("#EXTINF:%.6f,\n", float64(seg.Duration)/float64(timescale)))
+			buf.WriteString(fmt.Sprintf("%d/%ssegment_%d.m4s%s\n", n, prefix, i, query))
+		}
+	}
+	buf.WriteString("#EXT-X-ENDLIST\n")
+	return buf.String()
+}
+
+// GenerateAssetMPD writes static MPD of a virtual asset with a Period per
+// video. Periods start where the previous video ends, presentationTimeOffset
+// maps the shifted decode times onto them. query is appended to every URI
+func (m *ManifestService) GenerateAssetMPD(tl *AssetTimeline, query string) (string, error) {
+	data := periodMPDData{DurationStr: formatMPDDuration(tl.Duration.Seconds())}
+	for n, p := range tl.Parts {
+		vf := p.VideoFile
+		period := mpdPeriod{
+			ID:                     uint64(n),
+			Start:                  fmt.Sprintf("%.3f", p.Start.Seconds()),
+			Prefix:                 fmt.Sprintf("%d/", n),
+			Query:                  template.HTMLEscapeString(query),
+			Codec:                  vf.VideoCodec,
+			Bandwidth:              vf.Bandwidth,
+			Width:                  vf.Width,
+			Height:                 vf.Height,
+			Timescale:              vf.Timescale,
+			PresentationTimeOffset: shiftTime(p.Start, vf.Timescale),
+			SegmentTimeline:        m.generateSegmentTimeline(vf.Segments[:p.SegmentCount]),
+		}
+		if tl.Audio {
+			period.Audio = periodAudio(vf)
+			period.AudioPresentationTimeOffset = shiftTime(p.Start, vf.AudioTimescale)
+			period.AudioSegmentTimeline = m.generateSegmentTimeline(vf.AudioSegments[:p.SegmentCount])
+		}
+		data.Periods = append(data.Periods, period)
+	}
+	return executePeriodMPD(data)
+}
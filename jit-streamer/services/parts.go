@@ -0,0 +1,166 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Partial segments of LL-HLS come from the same sample index as segments. A
+// part runs from its first sample to the last sample starting no later than
+// part duration after it, so parts never exceed the part target. Parts of
+// the segment a live source is writing are listed once they are complete and
+// surely belong to it, a listed part never changes
+
+// lowLatencySegments is how many complete segments list their parts
+const lowLatencySegments = 3
+
+// Part is a partial segment
+type Part struct {
+	Segment
+	Independent bool // starts with a sync sample
+}
+
+func (s *Segmenter) SegmentDuration() time.Duration {
+	return time.Duration(s.segmentDuration) * time.Second
+}
+
+// VideoParts returns parts of video segment n. Segment len(vf.Segments) is
+// the one being written of a live source
+func (s *Segmenter) VideoParts(vf *VideoFile, n int) []Part {
+	idx := vf.VideoIndex
+	if idx == nil || s.partDuration == 0 {
+		return nil
+	}
+	partDur := s.partTime(vf.Timescale)
+	if n >= 0 && n < len(vf.Segments) {
+		return splitParts(idx, vf.Segments[n].StartSample, vf.Segments[n].EndSample, partDur, false)
+	}
+	if n != len(vf.Segments) || !vf.Live {
+		return nil
+	}
+	start, limit := videoTail(vf)
+	return splitParts(idx, start, limit, partDur, true)
+}
+
+// AudioParts returns parts of audio segment n. Segment len(vf.AudioSegments)
+// is the one being written of a live source
+func (s *Segmenter) AudioParts(vf *VideoFile, n int) []Part {
+	idx := vf.AudioIndex
+	if idx == nil || vf.VideoIndex == nil || s.partDuration == 0 {
+		return nil
+	}
+	partDur := s.partTime(vf.AudioTimescale)
+	if n >= 0 && n < len(vf.AudioSegments) {
+		return splitParts(idx, vf.AudioSegments[n].StartSample, vf.AudioSegments[n].EndSample, partDur, false)
+	}
+	if n != len(vf.AudioSegments) || !vf.Live {
+		return nil
+	}
+	start := uint32(1)
+	if len(vf.AudioSegments) > 0 {
+		start = vf.AudioSegments[len(vf.AudioSegments)-1].EndSample
+	}
+	// Audio is cut where the next video segment starts
+	_, videoLimit := videoTail(vf)
+	return splitParts(idx, start, idx.SampleAt(audioCutTime(vf, videoLimit)), partDur, true)
+}
+
+// LowLatency returns parts of the last complete segments and of the segment
+// being written, nil unless the source is live
+func (s *Segmenter) LowLatency(vf *VideoFile, audio bool) *LowLatencyParams {
+	if !vf.Live || s.partDuration == 0 {
+		return nil
+	}
+	count, parts := len(vf.Segments), s.VideoParts
+	if audio {
+		count, parts = len(vf.AudioSegments), s.AudioParts
+	}
+	ll := &LowLatencyParams{
+		PartTarget:   s.partDuration.Seconds(),
+		FirstSegment: max(0, count-lowLatencySegments),
+	}
+	for n := ll.FirstSegment; n <= count; n++ {
+		ll.Parts = append(ll.Parts, parts(vf, n))
+	}
+	return ll
+}
+
+func (s *Segmenter) GenerateVideoPart(vf *VideoFile, segmentIndex, partIndex int) ([]byte, error) {
+	return s.generatePart(vf, vf.VideoIndex, s.VideoParts(vf, segmentIndex), segmentIndex, partIndex)
+}
+
+func (s *Segmenter) GenerateAudioPart(vf *VideoFile, segmentIndex, partIndex int) ([]byte, error) {
+	return s.generatePart(vf, vf.AudioIndex, s.AudioParts(vf, segmentIndex), segmentIndex, partIndex)
+}
+
+// generatePart writes a part like a segment. It shares sequence number with
+// its segment
+func (s *Segmenter) generatePart(vf *VideoFile, idx *SampleIndex, parts []Part, segmentIndex, partIndex int) ([]byte, error) {
+	if partIndex < 0 || partIndex >= len(parts) {
+		return nil, fmt.Errorf("part %d.%d out of range", segmentIndex, partIndex)
+	}
+	part := parts[partIndex]
+
+	samples, mdatData, err := s.readSamples(vf, idx, part.StartSample, part.EndSample)
+	if err != nil {
+		return nil, err
+	}
+	return s.encodeMediaSegment(uint32(segmentIndex+1), part.StartTime, samples, mdatData)
+}
+
+func (s *Segmenter) partTime(timescale uint32) uint64 {
+	return uint64(s.partDuration) * uint64(timescale) / uint64(time.Second)
+}
+
+// videoTail returns the first sample of the video segment being written and
+// the sample before which samples surely belong to it. The segment ends at a
+// keyframe near the next nominal boundary, not before the latest keyframe
+// written so far
+func videoTail(vf *VideoFile) (start, limit uint32) {
+	idx := vf.VideoIndex
+	start = 1
+	if len(vf.Segments) > 0 {
+		start = vf.Segments[len(vf.Segments)-1].EndSample
+	}
+	limit = uint32(idx.SampleCount() + 1)
+	if k := len(idx.Keyframes); k > 0 && idx.Keyframes[k-1] > start {
+		limit = idx.Keyframes[k-1]
+	}
+	return start, limit
+}
+
+// splitParts splits samples [start, end) into parts of at most partDur. An
+// open range may continue after end, its parts are returned up to the first
+// one that is not known to be complete
+func splitParts(idx *SampleIndex, start, end uint32, partDur uint64, open bool) []Part {
+	var parts []Part
+	last := uint32(idx.SampleCount() + 1)
+	for start < end {
+		// Part ends before the first sample starting later than limit
+		limit := idx.Time(start) + partDur
+		i := sort.Search(int(last-start), func(i int) bool { return idx.Time(start+uint32(i)+1) > limit })
+		if open && i == int(last-start) {
+			break
+		}
+		partEnd := start + max(uint32(i), 1)
+		if partEnd >= end {
+			if open {
+				break
+			}
+			partEnd = end
+		}
+		parts = append(parts, Part{
+			Segment: Segment{
+				StartSample: start,
+				EndSample:   partEnd,
+				StartTime:   idx.Time(start),
+				Duration:    idx.Time(partEnd) - idx.Time(start),
+				Size:        idx.Size(start, partEnd),
+			},
+			Independent: idx.IsSync(start),
+		})
+		start = partEnd
+	}
+	return parts
+}
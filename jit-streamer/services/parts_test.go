@@ -0,0 +1,117 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestLiveParts grows a fragmented file and checks that parts of the segment
+// being written, once listed, end up as parts of the finished segment
+func TestLiveParts(t *testing.T) {
+	video := fixtureVideo()
+	video.keyframeEvery = 45 // 1.8 s, segments end before the nominal boundary
+	full, err := os.ReadFile(writeFragmentedFixture(t, 1, 0, video, fixtureAudio()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "live.mp4")
+	if err := os.WriteFile(path, full[:len(full)/4], 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewSegmenter(2, 60, 300)
+	t.Cleanup(s.Close)
+
+	listed := make(map[[2]int]Part) // parts by segment and part number
+	audioListed := make(map[[2]int]Part)
+	record := func(vf *VideoFile) {
+		t.Helper()
+		for _, audio := range []bool{false, true} {
+			ll := s.LowLatency(vf, audio)
+			if ll == nil {
+				t.Fatal("no parts of a live source")
+			}
+			seen := listed
+			if audio {
+				seen = audioListed
+			}
+			for i, parts := range ll.Parts {
+				for p, part := range parts {
+					key := [2]int{ll.FirstSegment + i, p}
+					if old, ok := seen[key]; ok && old != part {
+						t.Errorf("audio %v part %v changed from %+v to %+v", audio, key, old, part)
+					}
+					seen[key] = part
+				}
+			}
+		}
+	}
+
+	written := len(full) / 4
+	for _, end := range []int{len(full) / 3, len(full) / 2, len(full)*2/3 + 7, len(full)} {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(full[written:end]); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		written = end
+
+		vf, err := s.OpenVideo(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vf.refreshed = time.Time{}
+		if vf, err = s.OpenVideo(path); err != nil {
+			t.Fatal(err)
+		}
+		if !vf.Live {
+			t.Fatal("file still written to is not live")
+		}
+		record(vf)
+		if _, err := s.GenerateVideoPart(vf, len(vf.Segments), 0); err != nil {
+			t.Errorf("first part of segment being written: %v", err)
+		}
+	}
+
+	// Parts of the finished file cover segments without gaps and match the
+	// ones listed while live
+	old := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	vf, _ := s.OpenVideo(path)
+	vf.refreshed = time.Time{}
+	if vf, err = s.OpenVideo(path); err != nil || vf.Live {
+		t.Fatalf("file not finalized: %v", err)
+	}
+	check := func(segments []Segment, partsOf func(*VideoFile, int) []Part, seen map[[2]int]Part, timescale uint32) {
+		t.Helper()
+		for n, seg := range segments {
+			parts := partsOf(vf, n)
+			next := seg.StartSample
+			for p, part := range parts {
+				if part.StartSample != next || part.Duration > s.partTime(timescale) {
+					t.Errorf("part %d.%d is %+v", n, p, part)
+				}
+				next = part.EndSample
+				if old, ok := seen[[2]int{n, p}]; ok && old != part {
+					t.Errorf("part %d.%d was %+v, finished %+v", n, p, old, part)
+				}
+				delete(seen, [2]int{n, p})
+			}
+			if next != seg.EndSample {
+				t.Errorf("parts of segment %d end at %d, segment at %d", n, next, seg.EndSample)
+			}
+		}
+		for key := range seen {
+			t.Errorf("listed part %v is gone", key)
+		}
+	}
+	check(vf.Segments, s.VideoParts, listed, vf.Timescale)
+	check(vf.AudioSegments, s.AudioParts, audioListed, vf.AudioTimescale)
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"amka.ru/jit-streamer/models"
+)
+
+// ErrRemuxPending is returned for sources whose intermediate MP4 is not
+// written yet. Clients should retry later
+var ErrRemuxPending = errors.New("source is being remuxed")
+
+// remuxRetryAfter is how long a failed remux is reported before the source
+// is remuxed again
+const remuxRetryAfter = time.Minute
+
+// Remuxer normalizes containers mp4ff cannot parse (Matroska, AVI, QuickTime)
+// with a one-time lossless ffmpeg remux into an intermediate MP4. Files are
+// named after source path, size and modification time, so they survive
+// restarts and are redone when the source changes. Outputs of changed or
+// deleted sources are removed
+type Remuxer struct {
+	dir       string
+	segmenter *Segmenter                  // stale outputs are closed in it before removal
+	retry     time.Duration               // failed jobs are kept this long
+	run       func(src, out string) error // writes the remuxed source to out
+	mu        sync.Mutex
+	jobs      map[string]*remuxJob // by intermediate path
+}
+
+type remuxJob struct {
+	done     chan struct{}
+	err      error     // valid after done is closed
+	finished time.Time // valid after done is closed
+}
+
+func NewRemuxer(dir string, seg *Segmenter) *Remuxer {
+	r := &Remuxer{
+		dir:       dir,
+		segmenter: seg,
+		retry:     remuxRetryAfter,
+		run:       ffmpegRemux,
+		jobs:      make(map[string]*remuxJob),
+	}
+	r.removeStale()
+	return r
+}
+
+// NeedsRemux reports whether the source has to be remuxed before segmenting
+func NeedsRemux(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mkv", ".avi", ".mov":
+		return true
+	}
+	return false
+}
+
+// Source returns path of the MP4 to segment for the source, starting remux
+// on first use. Native MP4 is returned as is
+func (r *Remuxer) Source(path string) (string, error) {
+	if !NeedsRemux(path) {
+		return path, nil
+	}
+	out, job, err := r.job(path)
+	if err != nil {
+		return "", err
+	}
+	select {
+	case <-job.done:
+		if job.err != nil {
+			return "", job.err
+		}
+		return out, nil
+	default:
+		return "", ErrRemuxPending
+	}
+}
+
+// Status returns remux state of the source, starting remux on first use.
+// It is nil for native MP4
+func (r *Remuxer) Status(path string) *models.RemuxStatus {
+	if !NeedsRemux(path) {
+		return nil
+	}
+	_, err := r.Source(path)
+	switch {
+	case err == nil:
+		return &models.RemuxStatus{State: models.RemuxReady}
+	case errors.Is(err, ErrRemuxPending):
+		return &models.RemuxStatus{State: models.RemuxPending}
+	default:
+		return &models.RemuxStatus{State: models.RemuxFailed, Error: err.Error()}
+	}
+}
+
+// job returns the remux job of the source. A job whose output exists from an
+// earlier run is done at once. Failed jobs are kept for the retry period, so
+// a broken source is not remuxed on every request
+func (r *Remuxer) job(path string) (string, *remuxJob, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to stat source: %w", err)
+	}
+	prefix := r.outputPrefix(path)
+	out := remuxOutput(prefix, fi)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if job, ok := r.jobs[out]; ok && !job.expired(r.retry) {
+		return out, job, nil
+	}
+	job := &remuxJob{done: make(chan struct{})}
+	r.jobs[out] = job
+	if _, err := os.Stat(out); err == nil {
+		job.finish(nil)
+		return out, job, nil
+	}
+
+	go func() {
+		log.Printf("Remuxing %s", path)
+		err := r.remux(path, prefix, out)
+		if err != nil {
+			log.Printf("Remux of %s failed: %v", path, err)
+		} else {
+			log.Printf("Remuxed %s to %s", path, out)
+		}
+		job.finish(err)
+		r.removeStale()
+	}()
+	return out, job, nil
+}
+
+func (j *remuxJob) finish(err error) {
+	j.err, j.finished = err, time.Now()
+	close(j.done)
+}
+
+// expired reports whether the job failed more than retry ago
+func (j *remuxJob) expired(retry time.Duration) bool {
+	select {
+	case <-j.done:
+		return j.err != nil && time.Since(j.finished) >= retry
+	default:
+		return false
+	}
+}
+
+// outputPrefix returns path of outputs of the source without the version
+// suffix. <prefix>.src holds the source path
+func (r *Remuxer) outputPrefix(path string) string {
+	return filepath.Join(r.dir, fmt.Sprintf("%x", sha1.Sum([]byte(path))))
+}
+
+// remuxOutput returns path of the output of the source version fi
+func remuxOutput(prefix string, fi os.FileInfo) string {
+	version := sha1.Sum([]byte(fmt.Sprintf("%d|%d", fi.Size(), fi.ModTime().UnixNano())))
+	return fmt.Sprintf("%s-%x.mp4", prefix, version[:8])
+}
+
+// remux writes the source to out. Output is written to a temporary file and
+// renamed, so a partial file is never picked up as ready
+func (r *Remuxer) remux(src, prefix, out string) error {
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create remux directory: %w", err)
+	}
+	if err := os.WriteFile(prefix+".src", []byte(src), 0644); err != nil {
+		return fmt.Errorf("failed to record remux source: %w", err)
+	}
+	tmp := out + ".tmp"
+	defer os.Remove(tmp)
+
+	if err := r.run(src, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, out)
+}
+
+// removeStale deletes outputs of sources changed or deleted since they were
+// remuxed, and forgets their jobs
+func (r *Remuxer) removeStale() {
+	records, _ := filepath.Glob(filepath.Join(r.dir, "*.src"))
+	for _, record := range records {
+		data, err := os.ReadFile(record)
+		if err != nil {
+			continue
+		}
+		src := string(data)
+		prefix := strings.TrimSuffix(record, ".src")
+		fi, err := os.Stat(src)
+		deleted := err != nil
+		outputs, _ := filepath.Glob(prefix + "-*.mp4")
+		for _, out := range outputs {
+			if !deleted && out == remuxOutput(prefix, fi) {
+				continue
+			}
+			log.Printf("Removing stale remux of %s: %s", src, out)
+			r.segmenter.Forget(out)
+			os.Remove(out)
+			r.mu.Lock()
+			delete(r.jobs, out)
+			r.mu.Unlock()
+		}
+		if deleted {
+			os.Remove(record)
+		}
+	}
+}
+
+// ffmpegRemux copies the source into MP4 with moov in front
+func ffmpegRemux(src, out string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("ffmpeg", remuxArgs(src, out)...)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// remuxArgs returns ffmpeg arguments copying first video and every audio
+// stream, so the segmenter can offer all audio tracks of the source
+func remuxArgs(src, out string) []string {
+	return []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-y",
+		"-i", src,
+		"-map", "0:v:0",
+		"-map", "0:a?",
+		"-sn", "-dn",
+		"-c", "copy",
+		"-f", "mp4",
+		"-movflags", "+faststart",
+		out,
+	}
+}
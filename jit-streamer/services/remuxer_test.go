@@ -0,0 +1,184 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"amka.ru/jit-streamer/models"
+)
+
+// TestRemuxJobs walks remux jobs through pending, ready and failed states
+// with a remux that copies the source once the test lets it finish
+func TestRemuxJobs(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(t.TempDir(), "movie.mkv")
+	writeSource := func(content string, mod time.Time) {
+		if err := os.WriteFile(src, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(src, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeSource("v1", time.Now().Add(-time.Hour))
+
+	seg := NewSegmenter(1, 0, 0)
+	t.Cleanup(seg.Close)
+	var runs atomic.Int32
+	result := make(chan error)
+	newRemuxer := func() *Remuxer {
+		r := NewRemuxer(dir, seg)
+		r.retry = time.Hour
+		r.run = func(src, out string) error {
+			runs.Add(1)
+			if err := <-result; err != nil {
+				return err
+			}
+			data, err := os.ReadFile(src)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(out, data, 0644)
+		}
+		return r
+	}
+	// finish lets the running remux end with err and waits for its state
+	finish := func(r *Remuxer, err error) *models.RemuxStatus {
+		t.Helper()
+		result <- err
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			status := r.Status(src)
+			if status.State != models.RemuxPending {
+				return status
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("remux still pending")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	outputs := func() []string {
+		out, _ := filepath.Glob(filepath.Join(dir, "*.mp4"))
+		return out
+	}
+
+	r := newRemuxer()
+	if _, err := r.Source(src); !errors.Is(err, ErrRemuxPending) {
+		t.Fatalf("Source before remux = %v, want ErrRemuxPending", err)
+	}
+	if status := finish(r, nil); status.State != models.RemuxReady {
+		t.Fatalf("status %+v, want ready", status)
+	}
+	out, err := r.Source(src)
+	if data, _ := os.ReadFile(out); err != nil || string(data) != "v1" {
+		t.Fatalf("Source = %s with %q, %v", out, data, err)
+	}
+	// Output in use by the segmenter, as if opened
+	opened, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg.videoCache[out] = &VideoFile{Path: out, File: opened}
+
+	// Changed source is remuxed again and the old output removed. The
+	// first attempt fails and is reported until the retry period ends
+	writeSource("v2", time.Now())
+	if _, err := r.Source(src); !errors.Is(err, ErrRemuxPending) {
+		t.Fatalf("Source of changed source = %v, want ErrRemuxPending", err)
+	}
+	if status := finish(r, errors.New("broken")); status.State != models.RemuxFailed || status.Error != "broken" {
+		t.Fatalf("status %+v, want failed", status)
+	}
+	if status := r.Status(src); status.State != models.RemuxFailed || runs.Load() != 2 {
+		t.Errorf("failed remux retried at once: %+v after %d runs", status, runs.Load())
+	}
+	r.retry = 0
+	if status := r.Status(src); status.State != models.RemuxPending {
+		t.Fatalf("status %+v after the retry period, want pending", status)
+	}
+	if status := finish(r, nil); status.State != models.RemuxReady || runs.Load() != 3 {
+		t.Fatalf("status %+v after %d runs, want ready after 3", status, runs.Load())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(outputs()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	current, _ := r.Source(src)
+	if got := outputs(); len(got) != 1 || got[0] != current || current == out {
+		t.Errorf("outputs %v, want the new %s only", got, current)
+	}
+	seg.mu.RLock()
+	_, cached := seg.videoCache[out]
+	seg.mu.RUnlock()
+	if _, err := opened.Stat(); cached || !errors.Is(err, os.ErrClosed) {
+		t.Error("removed output still open in the segmenter")
+	}
+
+	// Output of an earlier run is ready at once
+	r = newRemuxer()
+	if got, err := r.Source(src); err != nil || got != current || runs.Load() != 3 {
+		t.Errorf("Source after restart = %s, %v after %d runs", got, err, runs.Load())
+	}
+
+	// Outputs of deleted sources are removed
+	if err := os.Remove(src); err != nil {
+		t.Fatal(err)
+	}
+	newRemuxer()
+	if left, _ := os.ReadDir(dir); len(left) != 0 {
+		t.Errorf("%d files left of a deleted source", len(left))
+	}
+}
+
+func TestRemuxArgs(t *testing.T) {
+	args := strings.Join(remuxArgs("in.mkv", "out.mp4"), " ")
+	if !strings.Contains(args, "-map 0:v:0 -map 0:a? ") {
+		t.Errorf("args %q do not keep every audio stream", args)
+	}
+}
+
+// TestRemuxAudioTracks remuxes Matroska with two audio tracks, both have to
+// reach the segmenter. Needs ffmpeg with libx264
+func TestRemuxAudioTracks(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not found")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "movie.mkv")
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error",
+		"-f", "lavfi", "-i", "testsrc=size=320x180:rate=25:duration=2",
+		"-f", "lavfi", "-i", "sine=frequency=440:duration=2",
+		"-f", "lavfi", "-i", "sine=frequency=880:duration=2",
+		"-map", "0", "-map", "1", "-map", "2",
+		"-c:v", "libx264", "-g", "25", "-c:a", "aac",
+		"-metadata:s:a:0", "language=eng", "-metadata:s:a:1", "language=fra",
+		src)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("ffmpeg cannot write the source: %v: %s", err, out)
+	}
+
+	out := filepath.Join(dir, "movie.mp4")
+	if err := ffmpegRemux(src, out); err != nil {
+		t.Fatal(err)
+	}
+	s := NewSegmenter(1, 0, 0)
+	t.Cleanup(s.Close)
+	vf, err := s.OpenVideo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var languages []string
+	for _, track := range vf.AudioTracks {
+		languages = append(languages, track.Language)
+	}
+	if len(languages) != 2 || languages[0] != "eng" || languages[1] != "fra" {
+		t.Errorf("remuxed audio tracks %v, want [eng fra]", languages)
+	}
+}
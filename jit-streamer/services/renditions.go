@@ -0,0 +1,162 @@
+package services
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// RenditionVideo is a pre-encoded rendition opened as a view matching the
+// source it was requested with
+type RenditionVideo struct {
+	Name  string // quality suffix, e.g. 720p
+	Video *VideoFile
+	path  string // of the rendition file
+}
+
+// RenditionCache keeps pre-encoded renditions of every source opened and
+// checked for segment alignment, so manifests and segments do not list the
+// videos directory and reopen renditions on every request. An entry is
+// dropped when the source or the directory is modified
+type RenditionCache struct {
+	videoService *VideoService
+	segmenter    *Segmenter
+	remuxer      *Remuxer
+
+	mu      sync.Mutex
+	entries map[string]*renditionEntry // by video name
+	skipped map[string]string          // logged reason by rendition path
+}
+
+type renditionEntry struct {
+	source     string // path of the source renditions are aligned with
+	sourceMod  time.Time
+	sourceSize int64
+	dirMod     time.Time
+	renditions []RenditionVideo // aligned with the whole source, clear
+}
+
+func NewRenditionCache(vs *VideoService, seg *Segmenter, rm *Remuxer) *RenditionCache {
+	return &RenditionCache{
+		videoService: vs,
+		segmenter:    seg,
+		remuxer:      rm,
+		entries:      make(map[string]*renditionEntry),
+		skipped:      make(map[string]string),
+	}
+}
+
+// Open returns renditions of the video whose segments line up with vf,
+// limited to the same clip and encrypted like it. The file behind vf itself
+// is served as the original stream
+func (c *RenditionCache) Open(name string, vf *VideoFile) []RenditionVideo {
+	entry := c.entry(name, vf.Path)
+	if entry == nil {
+		return nil
+	}
+
+	renditions := make([]RenditionVideo, 0, len(entry.renditions))
+	for _, r := range entry.renditions {
+		rvf := r.Video
+		if vf.Clip != nil {
+			var err error
+			if rvf, err = c.segmenter.ClipVideo(rvf, vf.Clip); err != nil {
+				c.skip(r.path, err.Error())
+				continue
+			}
+			if !c.segmenter.SegmentsAligned(vf, rvf) {
+				c.skip(r.path, "clipped segments not aligned with "+vf.Path)
+				continue
+			}
+		}
+		r.Video = c.segmenter.EncryptVideo(rvf, vf.Encryption)
+		renditions = append(renditions, r)
+	}
+	return renditions
+}
+
+// entry returns renditions of the video aligned with the whole source at
+// path, discovering them again when the cached entry is stale
+func (c *RenditionCache) entry(name, path string) *renditionEntry {
+	dir, err := os.Stat(c.videoService.cfg.VideosPath)
+	if err != nil {
+		return nil
+	}
+	src, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	c.mu.Unlock()
+	if ok && entry.source == path && entry.sourceMod.Equal(src.ModTime()) && entry.sourceSize == src.Size() && entry.dirMod.Equal(dir.ModTime()) {
+		return entry
+	}
+
+	entry, cacheable := c.discover(name, path)
+	if entry == nil {
+		return nil
+	}
+	entry.sourceMod, entry.sourceSize, entry.dirMod = src.ModTime(), src.Size(), dir.ModTime()
+	c.mu.Lock()
+	if cacheable {
+		c.entries[name] = entry
+	} else {
+		delete(c.entries, name)
+	}
+	c.mu.Unlock()
+	return entry
+}
+
+// discover opens renditions of the video and keeps those aligned with the
+// source at path. Entries with a pending remux or a live video are not
+// cacheable, they change without the directory
+func (c *RenditionCache) discover(name, path string) (*renditionEntry, bool) {
+	list, err := c.videoService.GetRenditions(name)
+	if err != nil {
+		return nil, false
+	}
+	vf, err := c.segmenter.OpenVideo(path)
+	if err != nil {
+		return nil, false
+	}
+
+	entry := &renditionEntry{source: path}
+	cacheable := !vf.Live
+	for _, r := range list {
+		src, err := c.remuxer.Source(r.Path)
+		if err != nil {
+			c.skip(r.Path, err.Error())
+			cacheable = false
+			continue
+		}
+		rvf, err := c.segmenter.OpenVideo(src)
+		if err != nil {
+			c.skip(r.Path, err.Error())
+			continue
+		}
+		if rvf.Path == vf.Path {
+			continue
+		}
+		cacheable = cacheable && !rvf.Live
+		if !c.segmenter.SegmentsAligned(vf, rvf) {
+			c.skip(r.Path, "segments not aligned with "+vf.Path)
+			continue
+		}
+		entry.renditions = append(entry.renditions, RenditionVideo{Name: r.Name, Video: rvf, path: r.Path})
+	}
+	return entry, cacheable
+}
+
+// skip logs a skipped rendition once per reason
+func (c *RenditionCache) skip(path, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.skipped[path] == reason {
+		return
+	}
+	c.skipped[path] = reason
+	log.Printf("Skipping rendition %s: %s", path, reason)
+}
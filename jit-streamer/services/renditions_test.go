@@ -0,0 +1,74 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"amka.ru/jit-streamer/config"
+)
+
+func TestRenditionCache(t *testing.T) {
+	videos := t.TempDir()
+	misaligned := fixtureVideo()
+	misaligned.keyframeEvery = 40
+	addVideo := func(name string, tracks ...fixtureTrack) {
+		data, err := os.ReadFile(writeFixture(t, tracks...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(videos, name+".mp4"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addVideo("movie", fixtureVideo(), fixtureAudio())
+	addVideo("movie_360p", fixtureVideo())
+	addVideo("movie_240p", misaligned)
+
+	seg := NewSegmenter(1, 0, 0)
+	t.Cleanup(seg.Close)
+	c := NewRenditionCache(NewVideoService(&config.Config{VideosPath: videos}), seg, NewRemuxer(t.TempDir(), seg))
+	vf, err := seg.OpenVideo(filepath.Join(videos, "movie.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(renditions []RenditionVideo) []string {
+		var names []string
+		for _, r := range renditions {
+			names = append(names, r.Name)
+		}
+		return names
+	}
+	first := c.Open("movie", vf)
+	if got := names(first); len(got) != 1 || got[0] != "360p" {
+		t.Fatalf("renditions %v, want aligned 360p only", got)
+	}
+	entry := c.entries["movie"]
+	if c.Open("movie", vf); c.entries["movie"] != entry {
+		t.Error("renditions discovered again without a change")
+	}
+
+	// Views follow clip and encryption of the source view
+	clipped, err := seg.ClipVideo(vf, &Clip{Start: 2 * time.Second, End: 4 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := c.Open("movie", seg.EncryptVideo(clipped, "cbcs"))
+	if len(view) != 1 || view[0].Video.Clip == nil || view[0].Video.Encryption != "cbcs" || len(view[0].Video.Segments) != len(clipped.Segments) {
+		t.Fatalf("clipped view %+v", view)
+	}
+	if first[0].Video.Clip != nil || first[0].Video.Encryption != "" {
+		t.Error("view modified the cached rendition")
+	}
+
+	// New rendition in the directory is picked up
+	addVideo("movie_480p", fixtureVideo())
+	if got := names(c.Open("movie", vf)); len(got) != 2 || got[0] != "360p" || got[1] != "480p" {
+		t.Errorf("renditions %v after adding 480p", got)
+	}
+	if c.entries["movie"] == entry {
+		t.Error("stale entry kept after the directory changed")
+	}
+}
@@ -0,0 +1,255 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// SampleIndex is a flat table of every sample of a track, built once when
+// the file is opened. Sample numbers are 1-based like in the sample table,
+// so data of sample nr is at index nr-1
+type SampleIndex struct {
+	DecodeTimes []uint64 // media timeline, sampleCount+1 entries, the last one is track end
+	Offsets     []uint64 // file offset of sample data
+	Sizes       []uint32
+	CTOs        []int32  // nil when track has no ctts
+	Sync        []bool   // nil when every sample is a sync sample
+	Keyframes   []uint32 // sync sample numbers in ascending order
+
+	// Edit list applied to output timing. TimeShift delays the whole track
+	// (leading empty edit), CTOShift is added to every composition offset to
+	// hide media before media_time. At most one of them is non-zero, except
+	// in audio of a sub-clip
+	TimeShift uint64
+	CTOShift  int32
+}
+
+// buildSampleIndex expands stts, stsz, stsc/stco, stss and ctts into
+// per-sample arrays in a single pass over each table
+func buildSampleIndex(stbl *mp4.StblBox) (*SampleIndex, error) {
+	if stbl.Stts == nil {
+		return nil, fmt.Errorf("no stts box")
+	}
+	if stbl.Stsz == nil {
+		return nil, fmt.Errorf("no stsz box")
+	}
+	if stbl.Stsc == nil {
+		return nil, fmt.Errorf("no stsc box")
+	}
+	if stbl.Stco == nil && stbl.Co64 == nil {
+		return nil, fmt.Errorf("no stco or co64 box")
+	}
+
+	idx := &SampleIndex{DecodeTimes: sampleDecodeTimes(stbl.Stts)}
+	sampleCount := idx.SampleCount()
+	if n := int(stbl.Stsz.GetNrSamples()); n < sampleCount {
+		return nil, fmt.Errorf("stsz has %d samples, stts has %d", n, sampleCount)
+	}
+
+	idx.Sizes = make([]uint32, sampleCount)
+	for i := range idx.Sizes {
+		idx.Sizes[i] = stbl.Stsz.GetSampleSize(i + 1)
+	}
+
+	offsets, err := sampleOffsets(stbl, idx.Sizes)
+	if err != nil {
+		return nil, err
+	}
+	idx.Offsets = offsets
+
+	if ctts := stbl.Ctts; ctts != nil {
+		idx.CTOs = make([]int32, sampleCount)
+		for i := 0; i < ctts.NrSampleCount(); i++ {
+			end := int(ctts.EndSampleNr[i+1])
+			if end > sampleCount {
+				end = sampleCount
+			}
+			for nr := int(ctts.EndSampleNr[i]); nr < end; nr++ {
+				idx.CTOs[nr] = ctts.SampleOffset[i]
+			}
+		}
+	}
+
+	if stbl.Stss != nil {
+		idx.Sync = make([]bool, sampleCount)
+		for _, nr := range stbl.Stss.SampleNumber {
+			if nr >= 1 && int(nr) <= sampleCount {
+				idx.Sync[nr-1] = true
+			}
+		}
+	}
+	idx.indexKeyframes()
+
+	return idx, nil
+}
+
+func (idx *SampleIndex) indexKeyframes() {
+	for i := 0; i < idx.SampleCount(); i++ {
+		if idx.Sync == nil || idx.Sync[i] {
+			idx.Keyframes = append(idx.Keyframes, uint32(i+1))
+		}
+	}
+}
+
+// editListOffset returns presentation offset of the track in its timescale:
+// duration of leading empty edits minus media_time of the first edit with
+// media. Later edits are ignored, as dwell and multi-edit presentations
+// cannot be expressed in fragments
+func editListOffset(trak *mp4.TrakBox, movieTimescale, timescale uint32) int64 {
+	if trak.Edts == nil {
+		return 0
+	}
+	var empty uint64
+	for _, elst := range trak.Edts.Elst {
+		for _, entry := range elst.Entries {
+			if entry.MediaTime == -1 {
+				empty += entry.SegmentDuration
+				continue
+			}
+			return int64(rescaleTime(empty, movieTimescale, timescale)) - entry.MediaTime
+		}
+	}
+	return 0
+}
+
+func (idx *SampleIndex) applyPresentationOffset(offset int64) {
+	if offset >= 0 {
+		idx.TimeShift, idx.CTOShift = uint64(offset), 0
+	} else {
+		idx.TimeShift, idx.CTOShift = 0, int32(offset)
+	}
+}
+
+// sampleOffsets walks chunks in order, laying out samples back to back
+// inside each chunk
+func sampleOffsets(stbl *mp4.StblBox, sizes []uint32) ([]uint64, error) {
+	var chunkOffsets []uint64
+	if stbl.Stco != nil {
+		chunkOffsets = make([]uint64, len(stbl.Stco.ChunkOffset))
+		for i, off := range stbl.Stco.ChunkOffset {
+			chunkOffsets[i] = uint64(off)
+		}
+	} else {
+		chunkOffsets = stbl.Co64.ChunkOffset
+	}
+
+	entries := stbl.Stsc.Entries
+	offsets := make([]uint64, len(sizes))
+	nr := 0
+	for e, entry := range entries {
+		lastChunk := uint32(len(chunkOffsets))
+		if e+1 < len(entries) {
+			lastChunk = entries[e+1].FirstChunk - 1
+		}
+		for chunk := entry.FirstChunk; chunk <= lastChunk && nr < len(sizes); chunk++ {
+			if chunk == 0 || int(chunk) > len(chunkOffsets) {
+				return nil, fmt.Errorf("chunk %d offset not found", chunk)
+			}
+			pos := chunkOffsets[chunk-1]
+			for i := uint32(0); i < entry.SamplesPerChunk && nr < len(sizes); i++ {
+				offsets[nr] = pos
+				pos += uint64(sizes[nr])
+				nr++
+			}
+		}
+	}
+	if nr < len(sizes) {
+		return nil, fmt.Errorf("chunks hold %d samples, track has %d", nr, len(sizes))
+	}
+	return offsets, nil
+}
+
+// sampleDecodeTimes returns decode time of every sample plus the end time of
+// the last sample, so times[n-1] is the time of sample n and times[len-1] is
+// the track duration
+func sampleDecodeTimes(stts *mp4.SttsBox) []uint64 {
+	var total uint32
+	for _, count := range stts.SampleCount {
+		total += count
+	}
+
+	times := make([]uint64, 0, total+1)
+	var currentTime uint64 = 0
+	for i, count := range stts.SampleCount {
+		delta := uint64(stts.SampleTimeDelta[i])
+		for j := uint32(0); j < count; j++ {
+			times = append(times, currentTime)
+			currentTime += delta
+		}
+	}
+	return append(times, currentTime)
+}
+
+func (idx *SampleIndex) SampleCount() int {
+	return len(idx.DecodeTimes) - 1
+}
+
+// Times below are on the output timeline, which is the media timeline
+// delayed by TimeShift
+
+// SampleAt returns number of the first sample with decode time >= t, or
+// SampleCount()+1 if t is past the last sample
+func (idx *SampleIndex) SampleAt(t uint64) uint32 {
+	t = idx.mediaTime(t)
+	n := idx.SampleCount()
+	return uint32(sort.Search(n, func(i int) bool { return idx.DecodeTimes[i] >= t }) + 1)
+}
+
+// KeyframeAt returns position in Keyframes of the first sync sample with
+// decode time >= t, or len(Keyframes) if there is none
+func (idx *SampleIndex) KeyframeAt(t uint64) int {
+	t = idx.mediaTime(t)
+	return sort.Search(len(idx.Keyframes), func(i int) bool {
+		return idx.DecodeTimes[idx.Keyframes[i]-1] >= t
+	})
+}
+
+func (idx *SampleIndex) mediaTime(t uint64) uint64 {
+	if t < idx.TimeShift {
+		return 0
+	}
+	return t - idx.TimeShift
+}
+
+// Time returns decode time of sample nr, nr SampleCount()+1 gives track end
+func (idx *SampleIndex) Time(nr uint32) uint64 {
+	return idx.DecodeTimes[nr-1] + idx.TimeShift
+}
+
+func (idx *SampleIndex) IsSync(nr uint32) bool {
+	return idx.Sync == nil || idx.Sync[nr-1]
+}
+
+// CTO returns composition offset of sample nr with edit list applied, so it
+// can be negative
+func (idx *SampleIndex) CTO(nr uint32) int32 {
+	if idx.CTOs == nil {
+		return idx.CTOShift
+	}
+	return idx.CTOs[nr-1] + idx.CTOShift
+}
+
+// Samples returns fragment sample entries of [startSample, endSample)
+func (idx *SampleIndex) Samples(startSample, endSample uint32) []mp4.Sample {
+	samples := make([]mp4.Sample, 0, endSample-startSample)
+	for nr := startSample; nr < endSample; nr++ {
+		var flags uint32 = 0x1010000 // Non-sync sample
+		if idx.IsSync(nr) {
+			flags = 0x2000000 // Sync sample (keyframe)
+		}
+		dur := uint32(idx.DecodeTimes[nr] - idx.DecodeTimes[nr-1])
+		samples = append(samples, mp4.NewSample(flags, dur, idx.Sizes[nr-1], idx.CTO(nr)))
+	}
+	return samples
+}
+
+// Size returns total size of sample data in [startSample, endSample)
+func (idx *SampleIndex) Size(startSample, endSample uint32) uint64 {
+	var size uint64
+	for nr := startSample; nr < endSample; nr++ {
+		size += uint64(idx.Sizes[nr-1])
+	}
+	return size
+}
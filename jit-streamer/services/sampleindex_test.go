@@ -0,0 +1,137 @@
+package services
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// fixtureMovieTimescale is the mvhd timescale of mp4.CreateMvhd, used for
+// edit durations
+const fixtureMovieTimescale = 90000
+
+// decodeFragment parses generated media segment and returns its only traf
+func decodeFragment(t *testing.T, data []byte) *mp4.TrafBox {
+	t.Helper()
+	f, err := mp4.DecodeFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Segments) != 1 || len(f.Segments[0].Fragments) != 1 {
+		t.Fatalf("expected one fragment")
+	}
+	return f.Segments[0].Fragments[0].Moof.Traf
+}
+
+func TestEditListMediaTimeShiftsCompositionOffsets(t *testing.T) {
+	// I P B B pattern delayed by two frames, as written by encoders with
+	// B-frames, and an edit skipping that delay
+	video := fixtureVideo()
+	video.cto = make([]int32, video.sampleCount)
+	for i := range video.cto {
+		switch i % video.keyframeEvery % 4 {
+		case 0:
+			video.cto[i] = 1024
+		case 1:
+			video.cto[i] = 2048
+		default:
+			video.cto[i] = 0
+		}
+	}
+	video.edits = []mp4.ElstEntry{{SegmentDuration: 6 * fixtureMovieTimescale, MediaTime: 1024, MediaRateInteger: 1}}
+	s, vf := openFixture(t, video)
+
+	data, err := s.GenerateMediaSegment(vf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traf := decodeFragment(t, data)
+	if got, want := traf.Tfdt.BaseMediaDecodeTime(), vf.Segments[1].StartTime; got != want {
+		t.Errorf("tfdt %d, want %d", got, want)
+	}
+	if traf.Trun.Version != 1 {
+		t.Errorf("trun version %d, want 1 for negative offsets", traf.Trun.Version)
+	}
+	wantCTO := []int32{0, 1024, -1024, -1024}
+	for i, sample := range traf.Trun.Samples[:4] {
+		if sample.CompositionTimeOffset != wantCTO[i] {
+			t.Errorf("sample %d cto %d, want %d", i, sample.CompositionTimeOffset, wantCTO[i])
+		}
+	}
+}
+
+func TestEditListEmptyEditDelaysTrack(t *testing.T) {
+	audio := fixtureAudio()
+	audio.edits = []mp4.ElstEntry{
+		{SegmentDuration: fixtureMovieTimescale / 2, MediaTime: -1, MediaRateInteger: 1},
+		{SegmentDuration: 6 * fixtureMovieTimescale, MediaTime: 0, MediaRateInteger: 1},
+	}
+	s, vf := openFixture(t, fixtureVideo(), audio)
+
+	// Audio starts 0.5 s into the presentation
+	if vf.AudioSegments[0].StartTime != 24000 {
+		t.Errorf("first audio segment starts at %d, want 24000", vf.AudioSegments[0].StartTime)
+	}
+	// First sample at or after the 1 s video boundary: 24000 + 24*1024
+	if vf.AudioSegments[1].StartTime != 48576 {
+		t.Errorf("second audio segment starts at %d, want 48576", vf.AudioSegments[1].StartTime)
+	}
+
+	data, err := s.GenerateAudioMediaSegment(vf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traf := decodeFragment(t, data)
+	if got := traf.Tfdt.BaseMediaDecodeTime(); got != 24000 {
+		t.Errorf("tfdt %d, want 24000", got)
+	}
+	if traf.Trun.Version != 0 {
+		t.Errorf("trun version %d, want 0 without negative offsets", traf.Trun.Version)
+	}
+}
+
+func TestEditListAudioPriming(t *testing.T) {
+	audio := fixtureAudio()
+	audio.edits = []mp4.ElstEntry{{SegmentDuration: 6 * fixtureMovieTimescale, MediaTime: 2112, MediaRateInteger: 1}}
+	s, vf := openFixture(t, fixtureVideo(), audio)
+
+	data, err := s.GenerateAudioMediaSegment(vf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traf := decodeFragment(t, data)
+	if got := traf.Tfdt.BaseMediaDecodeTime(); got != 0 {
+		t.Errorf("tfdt %d, want 0", got)
+	}
+	if traf.Trun.Version != 1 {
+		t.Errorf("trun version %d, want 1", traf.Trun.Version)
+	}
+	for i, sample := range traf.Trun.Samples {
+		if sample.CompositionTimeOffset != -2112 {
+			t.Fatalf("sample %d cto %d, want -2112", i, sample.CompositionTimeOffset)
+		}
+	}
+
+	if _, err := s.GenerateTSSegment(vf, 0); err != nil {
+		t.Errorf("TS segment: %v", err)
+	}
+}
+
+func TestNoEditList(t *testing.T) {
+	s, vf := openFixture(t, fixtureVideo(), fixtureAudio())
+
+	for i, gen := range []func(*VideoFile, int) ([]byte, error){s.GenerateMediaSegment, s.GenerateAudioMediaSegment} {
+		data, err := gen(vf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		traf := decodeFragment(t, data)
+		if got := traf.Tfdt.BaseMediaDecodeTime(); got != 0 {
+			t.Errorf("track %d: tfdt %d, want 0", i, got)
+		}
+		if traf.Trun.Version != 0 {
+			t.Errorf("track %d: trun version %d, want 0", i, traf.Trun.Version)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SegmentKey identifies generated init or media segment
+type SegmentKey struct {
+	Video   string        // path of the source file
+	Clip    string        // sub-clip range, empty for the whole file
+	Offset  time.Duration // start on the timeline of a virtual asset
+	Track   string        // "video", "audio", "iframes", "thumbnails" or "subtitles"
+	Audio   int           // audio track plus one when not the default, for audio and MPEG-TS
+	Quality string        // ladder rung or subtitle language, empty for the source stream
+	Index   int           // segment index, -1 for init segment
+	Part    int           // LL-HLS part index plus one, 0 for the whole segment
+	Format  string        // "fmp4", "ts", "jpeg" or "vtt"
+
+	Encryption string // scheme of encrypted video and audio, empty when clear
+}
+
+func (k SegmentKey) String() string {
+	video := k.Video
+	track := k.Track
+	if k.Audio > 0 {
+		track += strconv.Itoa(k.Audio - 1)
+	}
+	if k.Encryption != "" {
+		track += "+" + k.Encryption
+	}
+	if k.Clip != "" {
+		video += "#" + k.Clip
+	}
+	if k.Offset != 0 {
+		video += "@" + k.Offset.String()
+	}
+	if k.Part > 0 {
+		return fmt.Sprintf("%s|%s|%s|%d.%d|%s", video, track, k.Quality, k.Index, k.Part-1, k.Format)
+	}
+	return fmt.Sprintf("%s|%s|%s|%d|%s", video, track, k.Quality, k.Index, k.Format)
+}
+
+// SegmentETag returns the entity tag of the segment generated from vf under
+// key. It is derived from path, size and modification time of the source as
+// it was opened, and kid, the key of encrypted segments
+func SegmentETag(vf *VideoFile, key SegmentKey, kid string) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%d|%s|%s", vf.Path, vf.Size, vf.ModTime.UnixNano(), key, kid)))
+	return fmt.Sprintf("\"%x\"", sum)
+}
+
+// CacheStats is a snapshot of cache counters
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	DiskHits  uint64 `json:"disk_hits"`
+	Misses    uint64 `json:"misses"`
+	Coalesced uint64 `json:"coalesced"` // requests that waited for generation started by another one
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	MaxBytes  int64  `json:"max_bytes"`
+
+	DiskEntries  int   `json:"disk_entries"`
+	DiskBytes    int64 `json:"disk_bytes"`
+	DiskMaxBytes int64 `json:"disk_max_bytes"`
+}
+
+// SegmentCache keeps generated segments in memory within a byte budget,
+// least recently used first out. Evicted segments can be kept in an optional
+// on-disk tier with its own budget
+type SegmentCache struct {
+	mu      sync.Mutex
+	memory  *lruIndex
+	disk    *lruIndex // nil when disk tier is disabled
+	diskDir string
+
+	// Generations in progress, concurrent requests for the same key wait for
+	// the one already running
+	flights map[SegmentKey]*flight
+
+	hits, diskHits, misses, coalesced, evictions uint64
+}
+
+type flight struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// NewSegmentCache creates cache with memory budget in bytes. Disk tier is
+// enabled when diskDir is not empty; files left from previous runs are removed
+func NewSegmentCache(maxBytes int64, diskDir string, diskMaxBytes int64) *SegmentCache {
+	c := &SegmentCache{
+		memory:  newLRUIndex(maxBytes),
+		flights: make(map[SegmentKey]*flight),
+	}
+	if diskDir != "" && diskMaxBytes > 0 {
+		if err := os.MkdirAll(diskDir, 0755); err != nil {
+			log.Printf("Segment disk cache disabled: %v", err)
+			return c
+		}
+		stale, _ := filepath.Glob(filepath.Join(diskDir, "*.seg"))
+		for _, path := range stale {
+			os.Remove(path)
+		}
+		c.disk = newLRUIndex(diskMaxBytes)
+		c.diskDir = diskDir
+	}
+	return c
+}
+
+// GetOrGenerate returns cached segment or generates and stores it. Identical
+// concurrent requests share one generation and all get its result or error.
+// Generation runs detached from ctx, so a cancelled request only stops
+// waiting and does not abort the work for the others
+func (c *SegmentCache) GetOrGenerate(ctx context.Context, key SegmentKey, generate func() ([]byte, error)) ([]byte, error) {
+	if data, ok := c.Get(key); ok {
+		return data, nil
+	}
+
+	c.mu.Lock()
+	f, running := c.flights[key]
+	if running {
+		c.coalesced++
+	} else {
+		// Generation may have finished between Get and here
+		if e, ok := c.memory.get(key); ok {
+			c.mu.Unlock()
+			return e.data, nil
+		}
+		f = &flight{done: make(chan struct{})}
+		c.flights[key] = f
+		go c.generate(key, f, generate)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.data, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *SegmentCache) generate(key SegmentKey, f *flight, generate func() ([]byte, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			f.data, f.err = nil, fmt.Errorf("segment generation panicked: %v", r)
+		}
+		c.mu.Lock()
+		delete(c.flights, key)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+
+	f.data, f.err = generate()
+	if f.err == nil {
+		c.Put(key, f.data)
+	}
+}
+
+// Get looks segment up in memory, then on disk. Disk hits are promoted back
+// to memory
+func (c *SegmentCache) Get(key SegmentKey) ([]byte, bool) {
+	c.mu.Lock()
+	if e, ok := c.memory.get(key); ok {
+		c.hits++
+		c.mu.Unlock()
+		return e.data, true
+	}
+	_, onDisk := c.disk.get(key)
+	c.mu.Unlock()
+
+	if onDisk {
+		data, err := os.ReadFile(c.diskPath(key))
+		if err == nil {
+			c.mu.Lock()
+			c.diskHits++
+			c.mu.Unlock()
+			c.Put(key, data)
+			return data, true
+		}
+		c.mu.Lock()
+		c.disk.remove(key)
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	c.misses++
+	c.mu.Unlock()
+	return nil, false
+}
+
+// Put stores segment in memory, spilling evicted entries to disk tier
+func (c *SegmentCache) Put(key SegmentKey, data []byte) {
+	c.mu.Lock()
+	evicted := c.memory.add(&lruEntry{key: key, data: data, size: int64(len(data))})
+	c.evictions += uint64(len(evicted))
+	c.mu.Unlock()
+
+	for _, e := range evicted {
+		c.spill(e)
+	}
+}
+
+// spill writes entry evicted from memory to the disk tier
+func (c *SegmentCache) spill(e *lruEntry) {
+	if c.disk == nil {
+		return
+	}
+	c.mu.Lock()
+	_, exists := c.disk.get(e.key)
+	c.mu.Unlock()
+	if exists {
+		return
+	}
+
+	if err := os.WriteFile(c.diskPath(e.key), e.data, 0644); err != nil {
+		log.Printf("Failed to write segment to disk cache: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	removed := c.disk.add(&lruEntry{key: e.key, size: e.size})
+	c.mu.Unlock()
+	for _, r := range removed {
+		os.Remove(c.diskPath(r.key))
+	}
+}
+
+func (c *SegmentCache) diskPath(key SegmentKey) string {
+	sum := sha1.Sum([]byte(key.String()))
+	return filepath.Join(c.diskDir, hex.EncodeToString(sum[:])+".seg")
+}
+
+// Stats returns current counters
+func (c *SegmentCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := CacheStats{
+		Hits:      c.hits,
+		DiskHits:  c.diskHits,
+		Misses:    c.misses,
+		Coalesced: c.coalesced,
+		Evictions: c.evictions,
+		Entries:   c.memory.ll.Len(),
+		Bytes:     c.memory.size,
+		MaxBytes:  c.memory.maxBytes,
+	}
+	if c.disk != nil {
+		stats.DiskEntries = c.disk.ll.Len()
+		stats.DiskBytes = c.disk.size
+		stats.DiskMaxBytes = c.disk.maxBytes
+	}
+	return stats
+}
+
+type lruEntry struct {
+	key  SegmentKey
+	data []byte // nil in disk index
+	size int64
+}
+
+// lruIndex is a size-bounded LRU list. It is not safe for concurrent use
+type lruIndex struct {
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	items    map[SegmentKey]*list.Element
+}
+
+func newLRUIndex(maxBytes int64) *lruIndex {
+	return &lruIndex{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[SegmentKey]*list.Element),
+	}
+}
+
+func (l *lruIndex) get(key SegmentKey) (*lruEntry, bool) {
+	if l == nil {
+		return nil, false
+	}
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.ll.MoveToFront(el)
+	return el.Value.(*lruEntry), true
+}
+
+// add inserts entry and returns entries evicted to fit the budget. Entry
+// larger than the whole budget is returned as evicted right away
+func (l *lruIndex) add(e *lruEntry) []*lruEntry {
+	if e.size > l.maxBytes {
+		return []*lruEntry{e}
+	}
+	if el, ok := l.items[e.key]; ok {
+		old := el.Value.(*lruEntry)
+		l.size += e.size - old.size
+		el.Value = e
+		l.ll.MoveToFront(el)
+	} else {
+		l.items[e.key] = l.ll.PushFront(e)
+		l.size += e.size
+	}
+
+	var evicted []*lruEntry
+	for l.size > l.maxBytes {
+		el := l.ll.Back()
+		old := el.Value.(*lruEntry)
+		l.ll.Remove(el)
+		delete(l.items, old.key)
+		l.size -= old.size
+		evicted = append(evicted, old)
+	}
+	return evicted
+}
+
+func (l *lruIndex) remove(key SegmentKey) {
+	if l == nil {
+		return
+	}
+	if el, ok := l.items[key]; ok {
+		l.ll.Remove(el)
+		delete(l.items, key)
+		l.size -= el.Value.(*lruEntry).size
+	}
+}
@@ -0,0 +1,289 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lruKeys returns segment indexes of the index from most to least recently
+// used
+func lruKeys(l *lruIndex) []int {
+	var keys []int
+	for el := l.ll.Front(); el != nil; el = el.Next() {
+		keys = append(keys, el.Value.(*lruEntry).key.Index)
+	}
+	return keys
+}
+
+func TestLRUIndex(t *testing.T) {
+	l := newLRUIndex(300)
+	entry := func(index int, size int64) *lruEntry {
+		return &lruEntry{key: SegmentKey{Video: "a.mp4", Index: index}, size: size}
+	}
+	evictedKeys := func(evicted []*lruEntry) []int {
+		var keys []int
+		for _, e := range evicted {
+			keys = append(keys, e.key.Index)
+		}
+		return keys
+	}
+
+	for i := range 3 {
+		if evicted := l.add(entry(i, 100)); len(evicted) != 0 {
+			t.Fatalf("entry %d evicted %v within budget", i, evictedKeys(evicted))
+		}
+	}
+	l.get(SegmentKey{Video: "a.mp4", Index: 0})
+	if evicted := evictedKeys(l.add(entry(3, 100))); !slices.Equal(evicted, []int{1}) {
+		t.Errorf("evicted %v, want least recently used 1", evicted)
+	}
+	if keys := lruKeys(l); !slices.Equal(keys, []int{3, 0, 2}) {
+		t.Errorf("order %v, want [3 0 2]", keys)
+	}
+
+	// Entry larger than the budget does not displace anything
+	if evicted := evictedKeys(l.add(entry(4, 301))); !slices.Equal(evicted, []int{4}) {
+		t.Errorf("oversized entry evicted %v, want itself", evicted)
+	}
+	if keys := lruKeys(l); !slices.Equal(keys, []int{3, 0, 2}) || l.size != 300 {
+		t.Errorf("oversized entry changed index to %v of %d bytes", keys, l.size)
+	}
+
+	// Replaced entry is accounted with its new size and evicts what no longer fits
+	if evicted := evictedKeys(l.add(entry(0, 150))); !slices.Equal(evicted, []int{2}) {
+		t.Errorf("grown entry evicted %v, want [2]", evicted)
+	}
+	if keys := lruKeys(l); !slices.Equal(keys, []int{0, 3}) || l.size != 250 {
+		t.Errorf("index %v of %d bytes, want [0 3] of 250", keys, l.size)
+	}
+	l.remove(SegmentKey{Video: "a.mp4", Index: 3})
+	if keys := lruKeys(l); !slices.Equal(keys, []int{0}) || l.size != 150 {
+		t.Errorf("index %v of %d bytes after remove, want [0] of 150", keys, l.size)
+	}
+}
+
+func TestSegmentCacheTiers(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "stale.seg"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := NewSegmentCache(250, dir, 250)
+	if _, err := os.Stat(filepath.Join(dir, "stale.seg")); !os.IsNotExist(err) {
+		t.Error("segment left from a previous run kept")
+	}
+
+	key := func(index int) SegmentKey {
+		return SegmentKey{Video: "a.mp4", Track: "video", Index: index, Format: "fmp4"}
+	}
+	segment := func(index int, size int) []byte {
+		return bytes.Repeat([]byte{byte(index)}, size)
+	}
+	onDisk := func(index int) bool {
+		_, err := os.Stat(c.diskPath(key(index)))
+		return err == nil
+	}
+	checkStats := func(want CacheStats) {
+		t.Helper()
+		want.MaxBytes, want.DiskMaxBytes = 250, 250
+		if got := c.Stats(); got != want {
+			t.Errorf("stats %+v, want %+v", got, want)
+		}
+	}
+
+	// Third segment spills the least recently used one to disk
+	for i := range 3 {
+		c.Put(key(i), segment(i, 100))
+	}
+	if !onDisk(0) || onDisk(1) || onDisk(2) {
+		t.Error("evicted segment 0 not spilled to disk alone")
+	}
+	checkStats(CacheStats{Evictions: 1, Entries: 2, Bytes: 200, DiskEntries: 1, DiskBytes: 100})
+
+	// Disk hit is promoted to memory and spills segment 1 in turn
+	if data, ok := c.Get(key(0)); !ok || !bytes.Equal(data, segment(0, 100)) {
+		t.Fatal("spilled segment not read back from disk")
+	}
+	if _, ok := c.memory.items[key(0)]; !ok || !onDisk(1) {
+		t.Error("disk hit not promoted to memory")
+	}
+	if _, ok := c.Get(key(2)); !ok {
+		t.Error("segment 2 not in memory")
+	}
+	if _, ok := c.Get(key(9)); ok {
+		t.Error("segment never put found")
+	}
+	checkStats(CacheStats{Hits: 1, DiskHits: 1, Misses: 1, Evictions: 2, Entries: 2, Bytes: 200, DiskEntries: 2, DiskBytes: 200})
+
+	// Segment 0 is already on disk, spilling segment 2 then exceeds the disk
+	// budget and deletes the least recently used file
+	c.Put(key(3), segment(3, 100))
+	c.Put(key(4), segment(4, 100))
+	if !onDisk(0) || onDisk(1) || !onDisk(2) {
+		t.Error("disk tier does not hold segments 0 and 2 only")
+	}
+	if _, ok := c.Get(key(1)); ok {
+		t.Error("segment evicted from disk found")
+	}
+
+	// Segment larger than both budgets is not kept anywhere
+	c.Put(key(5), segment(5, 300))
+	if _, ok := c.Get(key(5)); ok || onDisk(5) {
+		t.Error("oversized segment kept")
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(files) != 2 {
+		t.Errorf("%d files in disk tier, want 2", len(files))
+	}
+	checkStats(CacheStats{Hits: 1, DiskHits: 1, Misses: 3, Evictions: 5, Entries: 2, Bytes: 200, DiskEntries: 2, DiskBytes: 200})
+}
+
+func TestSegmentCacheMemoryOnly(t *testing.T) {
+	c := NewSegmentCache(100, "", 0)
+	c.Put(SegmentKey{Index: 0}, make([]byte, 60))
+	c.Put(SegmentKey{Index: 1}, make([]byte, 60))
+	if _, ok := c.Get(SegmentKey{Index: 0}); ok {
+		t.Error("evicted segment found without a disk tier")
+	}
+	if got := c.Stats(); got != (CacheStats{Misses: 1, Evictions: 1, Entries: 1, Bytes: 60, MaxBytes: 100}) {
+		t.Errorf("stats %+v", got)
+	}
+}
+
+// waitCoalesced waits until n requests wait for a generation started by
+// another one
+func waitCoalesced(t *testing.T, c *SegmentCache, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().Coalesced < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d requests coalesced", c.Stats().Coalesced, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestGetOrGenerateCoalescing runs concurrent requests for one segment
+// against generations that succeed, fail or panic. Every waiter gets the
+// result of the single generation
+func TestGetOrGenerateCoalescing(t *testing.T) {
+	const callers = 16
+	for _, tc := range []struct {
+		name     string
+		generate func() ([]byte, error)
+		err      string // substring of the error every caller gets
+	}{
+		{"success", func() ([]byte, error) { return []byte("segment"), nil }, ""},
+		{"error", func() ([]byte, error) { return nil, errors.New("broken source") }, "broken source"},
+		{"panic", func() ([]byte, error) { panic("index out of range") }, "panicked: index out of range"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewSegmentCache(1<<20, "", 0)
+			key := SegmentKey{Video: "a.mp4", Track: "video", Index: 7, Format: "fmp4"}
+			release := make(chan struct{})
+			var runs atomic.Int32
+			generate := func() ([]byte, error) {
+				runs.Add(1)
+				<-release
+				return tc.generate()
+			}
+
+			type result struct {
+				data []byte
+				err  error
+			}
+			results := make(chan result, callers)
+			for range callers {
+				go func() {
+					data, err := c.GetOrGenerate(context.Background(), key, generate)
+					results <- result{data, err}
+				}()
+			}
+			waitCoalesced(t, c, callers-1)
+			close(release)
+
+			for range callers {
+				r := <-results
+				switch {
+				case tc.err == "" && (r.err != nil || string(r.data) != "segment"):
+					t.Errorf("got %q, %v", r.data, r.err)
+				case tc.err != "" && (r.err == nil || !strings.Contains(r.err.Error(), tc.err)):
+					t.Errorf("error %v, want %q", r.err, tc.err)
+				}
+			}
+			if n := runs.Load(); n != 1 {
+				t.Errorf("%d generations for %d callers", n, callers)
+			}
+
+			// Failures are not cached, the next request generates again
+			if _, cached := c.Get(key); cached != (tc.err == "") {
+				t.Errorf("segment cached %v", cached)
+			}
+			c.GetOrGenerate(context.Background(), key, generate)
+			want := int32(1)
+			if tc.err != "" {
+				want = 2
+			}
+			if n := runs.Load(); n != want {
+				t.Errorf("%d generations after the first one returned, want %d", n, want)
+			}
+		})
+	}
+}
+
+// TestGetOrGenerateCancel checks that a request which gives up stops
+// waiting right away while the generation it started completes for others
+func TestGetOrGenerateCancel(t *testing.T) {
+	c := NewSegmentCache(1<<20, "", 0)
+	key := SegmentKey{Video: "a.mp4", Track: "video", Index: 3, Format: "fmp4"}
+	started, release := make(chan struct{}), make(chan struct{})
+	var runs atomic.Int32
+	generate := func() ([]byte, error) {
+		runs.Add(1)
+		close(started)
+		<-release
+		return []byte("segment"), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := c.GetOrGenerate(ctx, key, generate)
+		first <- err
+	}()
+	<-started
+	second := make(chan []byte, 1)
+	go func() {
+		data, _ := c.GetOrGenerate(context.Background(), key, generate)
+		second <- data
+	}()
+	waitCoalesced(t, c, 1)
+
+	cancel()
+	select {
+	case err := <-first:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled request got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled request still waits for generation")
+	}
+
+	close(release)
+	if data := <-second; string(data) != "segment" {
+		t.Errorf("waiting request got %q", data)
+	}
+	if data, ok := c.Get(key); !ok || string(data) != "segment" {
+		t.Error("segment of the cancelled request not cached")
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("%d generations, want 1", n)
+	}
+}
@@ -3,23 +3,28 @@ package services
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/Eyevinn/mp4ff/mp4"
 )
 
 type Segmenter struct {
-	segmentDuration uint64 // in seconds
+	segmentDuration uint64        // in seconds
+	liveIdle        time.Duration // fragmented files modified this recently are live, 0 disables live mode
+	partDuration    time.Duration // LL-HLS part duration of live sources, 0 disables parts
 	mu              sync.RWMutex
 	videoCache      map[string]*VideoFile
+	clips           *clipViews
 }
 
 type VideoFile struct {
 	Path       string
 	File       *os.File
 	MP4        *mp4.File
+	ModTime    time.Time // of the file when opened, identifies it with Path and Size
+	Size       int64
 	Timescale  uint32
 	Duration   uint64
 	VideoTrack *mp4.TrakBox
@@ -27,18 +32,54 @@ type VideoFile struct {
 	VideoCodec string
 	Width      uint32
 	Height     uint32
+	Segments   []Segment // keyframe aligned video segments
+	Bandwidth  uint32    // measured peak segment bitrate
+	AvgBitrate uint32    // measured average bitrate
+	VideoIndex *SampleIndex
+
+	AudioTimescale  uint32
+	AudioSampleRate uint32 // in Hz, the timescale can differ from it
+	AudioDuration   uint64
+	AudioCodec      string
+	AudioChannels   uint16
+	AudioBitrate    uint32
+	AudioSegments   []Segment // aligned to video segment boundaries
+	AudioBandwidth  uint32    // measured peak segment bitrate
+	AudioIndex      *SampleIndex
+
+	// Every audio track of the file, the fields above describe the selected one
+	AudioTracks   []AudioTrack
+	AudioSelected int
+	AudioDefault  int // selected when the file is opened
+
+	// Fragmented file still being written. Segments cover complete GOPs only
+	// and the index is refreshed as the file grows
+	Live      bool
+	Event     bool      // opened while live, stays set after the writer is done
+	LiveStart time.Time // wall clock time of media time zero
+	liveEnd   uint64    // file size covered by the index
+	refreshed time.Time
+
+	Clip       *Clip         // sub-clip this view is limited to, nil for the whole file
+	ClipOrigin uint64        // source time of the first sample of the clip in Timescale
+	Offset     time.Duration // start of this view on the timeline of a virtual asset
+	Encryption string        // "cenc" or "cbcs" when fMP4 segments of this view are encrypted
+	Token      string        // playback token carried onto every URI of manifests of this view
 }
 
-func NewSegmenter(segmentDurationSec int) *Segmenter {
+func NewSegmenter(segmentDurationSec int, liveIdleSec int, partDurationMs int) *Segmenter {
 	return &Segmenter{
 		segmentDuration: uint64(segmentDurationSec),
+		liveIdle:        time.Duration(liveIdleSec) * time.Second,
+		partDuration:    time.Duration(partDurationMs) * time.Millisecond,
 		videoCache:      make(map[string]*VideoFile),
+		clips:           newClipViews(),
 	}
 }
 
 func (s *Segmenter) OpenVideo(path string) (*VideoFile, error) {
 	s.mu.RLock()
-	if vf, ok := s.videoCache[path]; ok {
+	if vf, ok := s.videoCache[path]; ok && !s.needsRefresh(vf) {
 		s.mu.RUnlock()
 		return vf, nil
 	}
@@ -49,6 +90,9 @@ func (s *Segmenter) OpenVideo(path string) (*VideoFile, error) {
 
 	// Double check after acquiring write lock
 	if vf, ok := s.videoCache[path]; ok {
+		if s.needsRefresh(vf) {
+			return s.refreshLive(vf), nil
+		}
 		return vf, nil
 	}
 
@@ -56,8 +100,24 @@ func (s *Segmenter) OpenVideo(path string) (*VideoFile, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to open video file: %w", err)
 	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to stat video file: %w", err)
+	}
 
-	parsedFile, err := mp4.DecodeFile(f)
+	var parsedFile *mp4.File
+	var parsedEnd uint64
+	growing := s.isGrowing(fi)
+	if growing {
+		// Writer may be in the middle of a box, only complete boxes are read
+		parsedFile = mp4.NewFile()
+		parsedEnd, err = decodeCompleteBoxes(f, parsedFile, 0, uint64(fi.Size()))
+	} else {
+		// Sample data is read on demand, so mdat is skipped instead of loaded.
+		// This also keeps files with moov at the end cheap to open
+		parsedFile, err = mp4.DecodeFile(f, mp4.WithDecodeMode(mp4.DecModeLazyMdat))
+	}
 	if err != nil {
 		f.Close()
 		return nil, fmt.Errorf("failed to parse MP4: %w", err)
@@ -69,9 +129,16 @@ func (s *Segmenter) OpenVideo(path string) (*VideoFile, error) {
 	}
 
 	vf := &VideoFile{
-		Path: path,
-		File: f,
-		MP4:  parsedFile,
+		Path:    path,
+		File:    f,
+		MP4:     parsedFile,
+		ModTime: fi.ModTime(),
+		Size:    fi.Size(),
+	}
+	if growing && parsedFile.IsFragmented() && parsedFile.Mfra == nil {
+		vf.Live, vf.Event = true, true
+		vf.liveEnd = parsedEnd
+		vf.refreshed = time.Now()
 	}
 
 	// Find video and audio tracks
@@ -94,15 +161,28 @@ func (s *Segmenter) OpenVideo(path string) (*VideoFile, error) {
 			}
 			vf.VideoCodec = extractVideoCodec(trak)
 		case "soun":
-			vf.AudioTrack = trak
+			vf.AudioTracks = append(vf.AudioTracks, newAudioTrack(trak))
 		}
 	}
+	if len(vf.AudioTracks) > 0 {
+		vf.AudioDefault = defaultAudio(vf.AudioTracks)
+		vf.useAudio(vf.AudioDefault)
+	}
 
 	if vf.VideoTrack == nil {
 		f.Close()
 		return nil, fmt.Errorf("no video track found")
 	}
 
+	if err := s.buildSegmentMaps(vf); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if vf.Live {
+		// Recording runs in real time, so media time zero was this long ago
+		vf.LiveStart = time.Now().Add(-time.Duration(vf.Duration) * time.Second / time.Duration(vf.Timescale))
+	}
+
 	s.videoCache[path] = vf
 	return vf, nil
 }
@@ -129,19 +209,196 @@ func extractVideoCodec(trak *mp4.TrakBox) string {
 	}
 
 	// Check for HEVC (H.265)
-	if stsd.HvcX != nil {
-		return "hvc1.1.6.L93.B0" // Common HEVC codec string
+	if stsd.HvcX != nil && stsd.HvcX.HvcC != nil {
+		return hevcCodecString(stsd.HvcX.Type(), stsd.HvcX.HvcC)
+	}
+
+	if stsd.Av01 != nil && stsd.Av01.Av1C != nil {
+		return av1CodecString(stsd.Av01.Av1C)
+	}
+
+	if stsd.VpXX != nil && stsd.VpXX.VppC != nil {
+		return vpCodecString(stsd.VpXX.Type(), stsd.VpXX.VppC)
 	}
 
 	return "avc1.640028" // Default fallback
 }
 
-func (s *Segmenter) GetSegmentCount(vf *VideoFile) int {
-	if vf.Timescale == 0 {
-		return 0
+// extractAudioParams returns RFC 6381 codec string, channel count and average
+// bitrate of the audio track
+func extractAudioParams(trak *mp4.TrakBox) (string, uint16, uint32) {
+	if trak.Mdia == nil || trak.Mdia.Minf == nil || trak.Mdia.Minf.Stbl == nil || trak.Mdia.Minf.Stbl.Stsd == nil {
+		return "mp4a.40.2", 2, 0 // Default fallback
+	}
+
+	stsd := trak.Mdia.Minf.Stbl.Stsd
+
+	switch {
+	case stsd.Mp4a != nil:
+		codec := "mp4a.40.2"
+		var bitrate uint32
+		if esds := stsd.Mp4a.Esds; esds != nil && esds.DecConfigDescriptor != nil {
+			dcd := esds.DecConfigDescriptor
+			bitrate = dcd.AvgBitrate
+			if dcd.ObjectType != 0x40 {
+				codec = fmt.Sprintf("mp4a.%02X", dcd.ObjectType)
+			} else if dcd.DecSpecificInfo != nil && len(dcd.DecSpecificInfo.DecConfig) > 0 {
+				// Audio object type is the first 5 bits of AudioSpecificConfig
+				if aot := dcd.DecSpecificInfo.DecConfig[0] >> 3; aot > 0 && aot < 31 {
+					codec = fmt.Sprintf("mp4a.40.%d", aot)
+				}
+			}
+		}
+		return codec, stsd.Mp4a.ChannelCount, bitrate
+	case stsd.AC3 != nil:
+		return "ac-3", stsd.AC3.ChannelCount, 0
+	case stsd.EC3 != nil:
+		return "ec-3", stsd.EC3.ChannelCount, 0
+	case stsd.Opus != nil:
+		return "opus", stsd.Opus.ChannelCount, 0
+	}
+
+	return "mp4a.40.2", 2, 0 // Default fallback
+}
+
+// buildSegmentMaps indexes samples of both tracks and builds segments
+func (s *Segmenter) buildSegmentMaps(vf *VideoFile) error {
+	if vf.Timescale == 0 || vf.VideoTrack.Mdia.Minf == nil || vf.VideoTrack.Mdia.Minf.Stbl == nil {
+		return fmt.Errorf("invalid video track")
+	}
+
+	videoIndex, err := s.indexTrack(vf, vf.VideoTrack)
+	if err != nil {
+		return fmt.Errorf("failed to index video samples: %w", err)
+	}
+	videoIndex.applyPresentationOffset(editListOffset(vf.VideoTrack, vf.MP4.Moov.Mvhd.Timescale, vf.Timescale))
+	vf.VideoIndex = videoIndex
+	if vf.Duration == 0 || vf.MP4.IsFragmented() {
+		vf.Duration = videoIndex.DecodeTimes[videoIndex.SampleCount()]
+	}
+
+	// Tracks are copied, a live refresh must not change those of vf in use
+	tracks := make([]AudioTrack, len(vf.AudioTracks))
+	for n, t := range vf.AudioTracks {
+		if t.Timescale != 0 && t.Trak.Mdia.Minf != nil && t.Trak.Mdia.Minf.Stbl != nil {
+			audioIndex, err := s.indexTrack(vf, t.Trak)
+			if err != nil {
+				return fmt.Errorf("failed to index audio samples: %w", err)
+			}
+			audioIndex.applyPresentationOffset(editListOffset(t.Trak, vf.MP4.Moov.Mvhd.Timescale, t.Timescale))
+			t.Index = audioIndex
+			if t.Duration == 0 || vf.MP4.IsFragmented() {
+				t.Duration = audioIndex.DecodeTimes[audioIndex.SampleCount()]
+			}
+		}
+		tracks[n] = t
 	}
-	segmentDurTS := s.segmentDuration * uint64(vf.Timescale)
-	return int((vf.Duration + segmentDurTS - 1) / segmentDurTS)
+	vf.AudioTracks = tracks
+	if len(tracks) > 0 {
+		vf.useAudio(vf.AudioSelected)
+	}
+
+	return s.buildSegments(vf)
+}
+
+// buildSegments splits video at keyframes closest to multiples of segment
+// duration and cuts audio at the same points in time
+func (s *Segmenter) buildSegments(vf *VideoFile) error {
+	videoIndex := vf.VideoIndex
+	segments, err := buildKeyframeSegments(videoIndex, s.segmentDuration*uint64(vf.Timescale), vf.Live)
+	if err != nil {
+		return fmt.Errorf("failed to build video segment map: %w", err)
+	}
+	vf.Segments = segments
+	vf.Bandwidth, vf.AvgBitrate = segmentBandwidth(segments, vf.Timescale)
+	return s.buildAudioSegments(vf)
+}
+
+// buildAudioSegments cuts the selected audio track at the video segments
+func (s *Segmenter) buildAudioSegments(vf *VideoFile) error {
+	if vf.AudioIndex == nil {
+		return nil
+	}
+	segments := vf.Segments
+	videoIndex := vf.VideoIndex
+
+	// Audio is cut where video segments start to be presented
+	startTimes := make([]uint64, 0, len(segments)+1)
+	for _, seg := range segments {
+		startTimes = append(startTimes, audioCutTime(vf, seg.StartSample))
+	}
+	if vf.Live && len(segments) > 0 {
+		// End of the last complete video segment, audio after it is left out
+		if end := segments[len(segments)-1].EndSample; int(end) <= videoIndex.SampleCount() {
+			startTimes = append(startTimes, audioCutTime(vf, end))
+		}
+	}
+
+	audioSegments, err := buildAlignedSegments(vf.AudioIndex, startTimes)
+	if err != nil {
+		return fmt.Errorf("failed to build audio segment map: %w", err)
+	}
+	if vf.Live && len(audioSegments) > 0 {
+		// Last one runs to the end of what is written so far
+		audioSegments = audioSegments[:len(audioSegments)-1]
+	}
+	vf.AudioSegments = audioSegments
+	vf.AudioBandwidth, _ = segmentBandwidth(audioSegments, vf.AudioTimescale)
+	return nil
+}
+
+// audioCutTime returns presentation time of video sample nr in audio
+// timescale. Past the last sample it is the earliest time a keyframe written
+// later can be presented at
+func audioCutTime(vf *VideoFile, nr uint32) uint64 {
+	idx := vf.VideoIndex
+	cto := idx.CTOShift
+	if int(nr) <= idx.SampleCount() {
+		cto = idx.CTO(nr)
+	}
+	start := int64(idx.Time(nr)) + int64(cto)
+	if start < 0 {
+		start = 0
+	}
+	return rescaleTime(uint64(start), vf.Timescale, vf.AudioTimescale)
+}
+
+// indexTrack builds sample index from the sample table, or from movie
+// fragments when the file is fragmented
+func (s *Segmenter) indexTrack(vf *VideoFile, trak *mp4.TrakBox) (*SampleIndex, error) {
+	if !vf.MP4.IsFragmented() {
+		return buildSampleIndex(trak.Mdia.Minf.Stbl)
+	}
+	originTime, originTimescale := fragmentOrigin(vf.MP4)
+	return buildFragmentedSampleIndex(vf.MP4, trak, originTime, originTimescale)
+}
+
+// SegmentsAligned reports whether both videos are cut at the same points in
+// time, so their segments are interchangeable in an ABR ladder
+func (s *Segmenter) SegmentsAligned(ref, vf *VideoFile) bool {
+	if len(ref.Segments) != len(vf.Segments) {
+		return false
+	}
+	// Allow for timescale rounding up to 10 ms
+	tolerance := uint64(ref.Timescale / 100)
+	for i, seg := range vf.Segments {
+		refStart := ref.Segments[i].StartTime
+		start := rescaleTime(seg.StartTime, vf.Timescale, ref.Timescale)
+		if start > refStart+tolerance || refStart > start+tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Segmenter) GetSegmentCount(vf *VideoFile) int {
+	return len(vf.Segments)
+}
+
+// GetAudioSegmentCount returns number of audio segments. Audio segments share
+// boundaries with video ones, so the count differs only when track durations do
+func (s *Segmenter) GetAudioSegmentCount(vf *VideoFile) int {
+	return len(vf.AudioSegments)
 }
 
 func (s *Segmenter) GetDurationSec(vf *VideoFile) float64 {
@@ -151,11 +408,33 @@ func (s *Segmenter) GetDurationSec(vf *VideoFile) float64 {
 	return float64(vf.Duration) / float64(vf.Timescale)
 }
 
+func (s *Segmenter) GetAudioDurationSec(vf *VideoFile) float64 {
+	if vf.AudioTimescale == 0 {
+		return 0
+	}
+	return float64(vf.AudioDuration) / float64(vf.AudioTimescale)
+}
+
 func (s *Segmenter) GenerateInitSegment(vf *VideoFile) ([]byte, error) {
+	if vf.VideoTrack == nil {
+		return nil, fmt.Errorf("no video track")
+	}
+	return s.generateInitSegment(vf.VideoTrack, vf.Timescale, videoBrands(vf.VideoCodec))
+}
+
+// GenerateAudioInitSegment returns init segment of the separate audio rendition
+func (s *Segmenter) GenerateAudioInitSegment(vf *VideoFile) ([]byte, error) {
+	if vf.AudioTrack == nil {
+		return nil, fmt.Errorf("no audio track")
+	}
+	return s.generateInitSegment(vf.AudioTrack, vf.AudioTimescale, []string{"isom", "iso2", "iso6", "mp41"})
+}
+
+func (s *Segmenter) generateInitSegment(srcTrak *mp4.TrakBox, timescale uint32, brands []string) ([]byte, error) {
 	buf := &bytes.Buffer{}
 
 	// Create ftyp box
-	ftyp := mp4.NewFtyp("isom", 0x200, []string{"isom", "iso2", "avc1", "mp41"})
+	ftyp := mp4.NewFtyp("isom", 0x200, brands)
 	if err := ftyp.Encode(buf); err != nil {
 		return nil, fmt.Errorf("failed to encode ftyp: %w", err)
 	}
@@ -165,27 +444,22 @@ func (s *Segmenter) GenerateInitSegment(vf *VideoFile) ([]byte, error) {
 
 	// Add mvhd
 	mvhd := mp4.CreateMvhd()
-	mvhd.Timescale = vf.Timescale
+	mvhd.Timescale = timescale
 	mvhd.Duration = 0 // For fragmented MP4, duration in moov should be 0
 	mvhd.NextTrackID = 2
 	moov.AddChild(mvhd)
 
-	// Add video track only (no audio to avoid codec mismatch issues)
-	if vf.VideoTrack != nil {
-		videoTrak := s.createFragmentedTrak(vf.VideoTrack, 1)
-		moov.AddChild(videoTrak)
-	}
+	// Each rendition carries a single track
+	moov.AddChild(s.createFragmentedTrak(srcTrak, 1))
 
 	// Add mvex for fragmented MP4
 	mvex := &mp4.MvexBox{}
-	if vf.VideoTrack != nil {
-		trex := mp4.CreateTrex(1)
-		trex.DefaultSampleDescriptionIndex = 1
-		trex.DefaultSampleDuration = 0
-		trex.DefaultSampleSize = 0
-		trex.DefaultSampleFlags = 0
-		mvex.AddChild(trex)
-	}
+	trex := mp4.CreateTrex(1)
+	trex.DefaultSampleDescriptionIndex = 1
+	trex.DefaultSampleDuration = 0
+	trex.DefaultSampleSize = 0
+	trex.DefaultSampleFlags = 0
+	mvex.AddChild(trex)
 	moov.AddChild(mvex)
 
 	if err := moov.Encode(buf); err != nil {
@@ -295,29 +569,38 @@ func (s *Segmenter) GenerateMediaSegment(vf *VideoFile, segmentIndex int) ([]byt
 	if vf.VideoTrack == nil {
 		return nil, fmt.Errorf("no video track")
 	}
+	return s.generateMediaSegment(vf, vf.VideoIndex, vf.Segments, segmentIndex)
+}
 
-	stbl := vf.VideoTrack.Mdia.Minf.Stbl
-	if stbl == nil {
-		return nil, fmt.Errorf("no stbl box")
+// GenerateAudioMediaSegment returns audio segment covering the same time
+// interval as the video segment with the same index
+func (s *Segmenter) GenerateAudioMediaSegment(vf *VideoFile, segmentIndex int) ([]byte, error) {
+	if vf.AudioIndex == nil {
+		return nil, fmt.Errorf("no audio track")
 	}
+	return s.generateMediaSegment(vf, vf.AudioIndex, vf.AudioSegments, segmentIndex)
+}
 
-	segmentDurTS := s.segmentDuration * uint64(vf.Timescale)
-	startTime := uint64(segmentIndex) * segmentDurTS
-	endTime := startTime + segmentDurTS
-	if endTime > vf.Duration {
-		endTime = vf.Duration
+func (s *Segmenter) generateMediaSegment(vf *VideoFile, idx *SampleIndex, segments []Segment, segmentIndex int) ([]byte, error) {
+	if segmentIndex < 0 || segmentIndex >= len(segments) {
+		return nil, fmt.Errorf("segment %d out of range", segmentIndex)
+	}
+	seg := segments[segmentIndex]
+
+	if seg.StartSample >= seg.EndSample {
+		return nil, fmt.Errorf("no samples in segment %d", segmentIndex)
 	}
 
-	// Get sample range for this segment
-	startSample, endSample, err := s.getSampleRange(stbl, startTime, endTime)
+	samples, mdatData, err := s.readSamples(vf, idx, seg.StartSample, seg.EndSample)
 	if err != nil {
 		return nil, err
 	}
 
-	if startSample >= endSample {
-		return nil, fmt.Errorf("no samples in segment %d", segmentIndex)
-	}
+	return s.encodeMediaSegment(uint32(segmentIndex+1), seg.StartTime, samples, mdatData)
+}
 
+// encodeMediaSegment writes styp+moof+mdat of a single track fragment
+func (s *Segmenter) encodeMediaSegment(sequenceNumber uint32, baseTime uint64, samples []mp4.Sample, mdatData []byte) ([]byte, error) {
 	buf := &bytes.Buffer{}
 
 	// Create styp box
@@ -325,36 +608,23 @@ func (s *Segmenter) GenerateMediaSegment(vf *VideoFile, segmentIndex int) ([]byt
 	if err := styp.Encode(buf); err != nil {
 		return nil, err
 	}
-	stypSize := buf.Len()
-
-	// Create traf and get sample data
-	traf, mdatData, err := s.createTraf(vf, stbl, 1, startSample, endSample, startTime)
-	if err != nil {
+	if err := s.encodeFragment(buf, sequenceNumber, baseTime, samples, mdatData); err != nil {
 		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	// Create moof box
-	moof := &mp4.MoofBox{}
-
-	// Add mfhd
-	mfhd := &mp4.MfhdBox{
-		SequenceNumber: uint32(segmentIndex + 1),
-	}
-	moof.AddChild(mfhd)
-	moof.AddChild(traf)
+// encodeFragment writes moof+mdat of a single track fragment
+func (s *Segmenter) encodeFragment(buf *bytes.Buffer, sequenceNumber uint32, baseTime uint64, samples []mp4.Sample, mdatData []byte) error {
+	start := buf.Len()
+	moof, traf := s.createMoof(sequenceNumber, baseTime, samples)
 
 	// Calculate moof size to determine data offset
 	moofSize := moof.Size()
 
-	// mdat header size (8 bytes for regular, 16 for extended)
-	mdatHeaderSize := 8
-	if len(mdatData)+8 > 0xFFFFFFFF {
-		mdatHeaderSize = 16
-	}
-
 	// DataOffset is relative to the start of moof, pointing to mdat payload
 	// DataOffset = moofSize + mdatHeaderSize (from moof start to mdat data)
-	dataOffset := int32(moofSize) + int32(mdatHeaderSize)
+	dataOffset := int32(moofSize) + int32(mdatHeaderSize(uint64(len(mdatData))))
 
 	// Update trun DataOffset
 	if traf.Trun != nil {
@@ -362,14 +632,14 @@ func (s *Segmenter) GenerateMediaSegment(vf *VideoFile, segmentIndex int) ([]byt
 	}
 
 	if err := moof.Encode(buf); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Verify moof was written correctly
-	actualMoofSize := buf.Len() - stypSize
+	actualMoofSize := buf.Len() - start
 	if uint64(actualMoofSize) != moofSize {
 		// Recalculate if size changed
-		dataOffset = int32(actualMoofSize) + int32(mdatHeaderSize)
+		dataOffset = int32(actualMoofSize) + int32(mdatHeaderSize(uint64(len(mdatData))))
 		// Need to re-encode - but for now just use the calculated value
 	}
 
@@ -377,51 +647,44 @@ func (s *Segmenter) GenerateMediaSegment(vf *VideoFile, segmentIndex int) ([]byt
 	mdat := &mp4.MdatBox{
 		Data: mdatData,
 	}
-	if err := mdat.Encode(buf); err != nil {
-		return nil, err
-	}
-
-	return buf.Bytes(), nil
+	return mdat.Encode(buf)
 }
 
-func (s *Segmenter) getSampleRange(stbl *mp4.StblBox, startTime, endTime uint64) (uint32, uint32, error) {
-	stts := stbl.Stts
-	if stts == nil {
-		return 0, 0, fmt.Errorf("no stts box")
+// fragmentSize returns size of the fragment encodeFragment writes, without
+// reading sample data
+func (s *Segmenter) fragmentSize(sequenceNumber uint32, baseTime uint64, samples []mp4.Sample) uint64 {
+	moof, _ := s.createMoof(sequenceNumber, baseTime, samples)
+	var dataSize uint64
+	for _, sample := range samples {
+		dataSize += uint64(sample.Size)
 	}
+	return moof.Size() + mdatHeaderSize(dataSize) + dataSize
+}
 
-	var sampleNum uint32 = 1
-	var currentTime uint64 = 0
-	var startSample, endSample uint32 = 0, 0
-
-	// If starting from 0, first sample is always 1
-	if startTime == 0 {
-		startSample = 1
+// mdatHeaderSize is 8 bytes for regular, 16 for extended size
+func mdatHeaderSize(dataSize uint64) uint64 {
+	if dataSize+8 > 0xFFFFFFFF {
+		return 16
 	}
+	return 8
+}
 
-	for i, count := range stts.SampleCount {
-		delta := stts.SampleTimeDelta[i]
-		for j := uint32(0); j < count; j++ {
-			if startSample == 0 && currentTime >= startTime {
-				startSample = sampleNum
-			}
-			currentTime += uint64(delta)
-			if currentTime >= endTime {
-				endSample = sampleNum + 1
-				return startSample, endSample, nil
-			}
-			sampleNum++
-		}
-	}
+func (s *Segmenter) createMoof(sequenceNumber uint32, baseTime uint64, samples []mp4.Sample) (*mp4.MoofBox, *mp4.TrafBox) {
+	traf := s.createTraf(1, baseTime, samples)
+
+	// Create moof box
+	moof := &mp4.MoofBox{}
 
-	endSample = sampleNum
-	if startSample == 0 {
-		startSample = 1
+	// Add mfhd
+	mfhd := &mp4.MfhdBox{
+		SequenceNumber: sequenceNumber,
 	}
-	return startSample, endSample, nil
+	moof.AddChild(mfhd)
+	moof.AddChild(traf)
+	return moof, traf
 }
 
-func (s *Segmenter) createTraf(vf *VideoFile, stbl *mp4.StblBox, trackID uint32, startSample, endSample uint32, baseTime uint64) (*mp4.TrafBox, []byte, error) {
+func (s *Segmenter) createTraf(trackID uint32, baseTime uint64, samples []mp4.Sample) *mp4.TrafBox {
 	traf := &mp4.TrafBox{}
 
 	// Create tfhd using factory function
@@ -433,133 +696,78 @@ func (s *Segmenter) createTraf(vf *VideoFile, stbl *mp4.StblBox, trackID uint32,
 	tfdt := mp4.CreateTfdt(baseTime)
 	traf.AddChild(tfdt)
 
-	// Create trun and read sample data
 	trun := &mp4.TrunBox{
 		Version: 0,
 		Flags:   0x000F01, // Data offset, duration, size, flags, composition time offset
-	}
-
-	var mdatData bytes.Buffer
-
-	// Get sample sizes
-	stsz := stbl.Stsz
-	if stsz == nil {
-		return nil, nil, fmt.Errorf("no stsz box")
-	}
-
-	// Get sample durations from stts
-	stts := stbl.Stts
-	durations := s.expandSampleDurations(stts, endSample)
-
-	// Get sync samples (keyframes)
-	var syncSamples map[uint32]bool
-	if stbl.Stss != nil {
-		syncSamples = make(map[uint32]bool)
-		for _, ss := range stbl.Stss.SampleNumber {
-			syncSamples[ss] = true
+		Samples: samples,
+	}
+	// Edit list shift may make composition offsets negative, which needs
+	// signed offsets of version 1
+	for _, sample := range samples {
+		if sample.CompositionTimeOffset < 0 {
+			trun.Version = 1
+			break
 		}
 	}
 
-	// Get composition time offsets
-	ctts := stbl.Ctts
-
-	for sampleNum := startSample; sampleNum < endSample; sampleNum++ {
-		// Get sample size using the GetSampleSize method (1-indexed)
-		size := stsz.GetSampleSize(int(sampleNum))
-
-		// Get sample duration
-		var duration uint32 = 1024 // Default
-		if int(sampleNum-1) < len(durations) {
-			duration = durations[sampleNum-1]
-		}
-
-		// Get sample flags
-		var flags uint32 = 0x1010000 // Non-sync sample
-		if syncSamples == nil || syncSamples[sampleNum] {
-			flags = 0x2000000 // Sync sample (keyframe)
-		}
-
-		// Get composition time offset
-		var cto int32 = 0
-		if ctts != nil {
-			cto = ctts.GetCompositionTimeOffset(sampleNum)
-		}
-
-		sample := mp4.NewSample(flags, duration, size, cto)
-		trun.Samples = append(trun.Samples, sample)
-
-		// Read sample data
-		offset, err := s.getSampleOffset(stbl, sampleNum)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		sampleData := make([]byte, size)
-		if _, err := vf.File.Seek(int64(offset), io.SeekStart); err != nil {
-			return nil, nil, err
-		}
-		if _, err := io.ReadFull(vf.File, sampleData); err != nil {
-			return nil, nil, err
-		}
-
-		mdatData.Write(sampleData)
-	}
-
 	// DataOffset will be set later, but set a placeholder so Size() includes it
 	trun.DataOffset = 1
 	traf.AddChild(trun)
 
-	return traf, mdatData.Bytes(), nil
+	return traf
 }
 
-func (s *Segmenter) expandSampleDurations(stts *mp4.SttsBox, maxSample uint32) []uint32 {
-	result := make([]uint32, 0, maxSample)
-	for i, count := range stts.SampleCount {
-		dur := stts.SampleTimeDelta[i]
-		for j := uint32(0); j < count && uint32(len(result)) < maxSample; j++ {
-			result = append(result, dur)
+// readSamples returns fragment sample entries and data of
+// [startSample, endSample). ReadAt does not use the shared file position, so
+// requests may read the same VideoFile concurrently. Samples adjacent in the
+// file, normally a whole chunk, are fetched in one read
+func (s *Segmenter) readSamples(vf *VideoFile, idx *SampleIndex, startSample, endSample uint32) ([]mp4.Sample, []byte, error) {
+	if startSample < 1 || endSample > uint32(idx.SampleCount()+1) || startSample > endSample {
+		return nil, nil, fmt.Errorf("sample range [%d, %d) out of track", startSample, endSample)
+	}
+	samples := idx.Samples(startSample, endSample)
+
+	mdatData := make([]byte, idx.Size(startSample, endSample))
+	var runStart, pos uint64 // run of adjacent samples in mdatData
+	var runOffset uint64     // file offset of the run
+	for nr := startSample; nr < endSample; nr++ {
+		offset := idx.Offsets[nr-1]
+		if nr == startSample || offset != runOffset+(pos-runStart) {
+			if err := readFullAt(vf.File, mdatData[runStart:pos], runOffset); err != nil {
+				return nil, nil, err
+			}
+			runStart, runOffset = pos, offset
 		}
+		pos += uint64(idx.Sizes[nr-1])
 	}
-	return result
-}
-
-func (s *Segmenter) getSampleOffset(stbl *mp4.StblBox, sampleNum uint32) (uint64, error) {
-	stsc := stbl.Stsc
-	stco := stbl.Stco
-	co64 := stbl.Co64
-	stsz := stbl.Stsz
-
-	if stsc == nil {
-		return 0, fmt.Errorf("no stsc box")
-	}
-	if stco == nil && co64 == nil {
-		return 0, fmt.Errorf("no stco or co64 box")
+	if err := readFullAt(vf.File, mdatData[runStart:pos], runOffset); err != nil {
+		return nil, nil, err
 	}
 
-	// Use StscBox method to find chunk for sample
-	chunkNr, firstSampleInChunk, err := stsc.ChunkNrFromSampleNr(int(sampleNum))
-	if err != nil {
-		return 0, fmt.Errorf("failed to find chunk for sample %d: %w", sampleNum, err)
-	}
+	return samples, mdatData, nil
+}
 
-	// Get chunk offset
-	var chunkOffset uint64
-	if stco != nil && chunkNr-1 < len(stco.ChunkOffset) {
-		chunkOffset = uint64(stco.ChunkOffset[chunkNr-1])
-	} else if co64 != nil && chunkNr-1 < len(co64.ChunkOffset) {
-		chunkOffset = co64.ChunkOffset[chunkNr-1]
-	} else {
-		return 0, fmt.Errorf("chunk %d offset not found", chunkNr)
+func readFullAt(f *os.File, buf []byte, offset uint64) error {
+	if len(buf) == 0 {
+		return nil
 	}
-
-	// Calculate offset within chunk
-	var offsetInChunk uint64 = 0
-	for i := firstSampleInChunk; i < int(sampleNum); i++ {
-		size := stsz.GetSampleSize(i) // GetSampleSize is 1-indexed
-		offsetInChunk += uint64(size)
+	if _, err := f.ReadAt(buf, int64(offset)); err != nil {
+		return fmt.Errorf("failed to read %d bytes at offset %d: %w", len(buf), offset, err)
 	}
+	return nil
+}
 
-	return chunkOffset + offsetInChunk, nil
+// Forget closes the file at path and drops it and its clip views from the
+// cache, for files about to be deleted
+func (s *Segmenter) Forget(path string) {
+	s.mu.Lock()
+	vf, ok := s.videoCache[path]
+	delete(s.videoCache, path)
+	s.mu.Unlock()
+	if ok && vf.File != nil {
+		vf.File.Close()
+	}
+	s.clips.remove(path)
 }
 
 func (s *Segmenter) Close() {
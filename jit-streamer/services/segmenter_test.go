@@ -0,0 +1,202 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openFixture(t testing.TB, tracks ...fixtureTrack) (*Segmenter, *VideoFile) {
+	t.Helper()
+	s := NewSegmenter(1, 0, 0)
+	t.Cleanup(s.Close)
+	vf, err := s.OpenVideo(writeFixture(t, tracks...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, vf
+}
+
+func TestReadSamplesAcrossChunks(t *testing.T) {
+	s, vf := openFixture(t, fixtureVideo(), fixtureAudio())
+
+	tracks := []struct {
+		idx      int
+		trak     fixtureTrack
+		segments []Segment
+	}{
+		{0, fixtureVideo(), vf.Segments},
+		{1, fixtureAudio(), vf.AudioSegments},
+	}
+	for _, tr := range tracks {
+		idx := vf.VideoIndex
+		if tr.trak.handler == "audio" {
+			idx = vf.AudioIndex
+		}
+		for i, seg := range tr.segments {
+			var want []byte
+			for nr := seg.StartSample; nr < seg.EndSample; nr++ {
+				keyframe := tr.trak.keyframeEvery == 0 || (int(nr)-1)%tr.trak.keyframeEvery == 0
+				want = append(want, fixtureSampleData(tr.idx, int(nr), keyframe, tr.trak.handler == "video")...)
+			}
+			samples, data, err := s.readSamples(vf, idx, seg.StartSample, seg.EndSample)
+			if err != nil {
+				t.Fatalf("%s segment %d: %v", tr.trak.handler, i, err)
+			}
+			if len(samples) != int(seg.EndSample-seg.StartSample) {
+				t.Errorf("%s segment %d: got %d samples, want %d", tr.trak.handler, i, len(samples), seg.EndSample-seg.StartSample)
+			}
+			if !bytes.Equal(data, want) {
+				t.Errorf("%s segment %d: sample data differs from the source", tr.trak.handler, i)
+			}
+		}
+	}
+}
+
+// TestParallelSegmentGeneration checks that segments generated concurrently
+// from one shared VideoFile are byte-identical to serially generated ones.
+// Run with -race to catch unsynchronized file access
+func TestParallelSegmentGeneration(t *testing.T) {
+	s, vf := openFixture(t, fixtureVideo(), fixtureAudio())
+
+	type generator struct {
+		name string
+		gen  func(int) ([]byte, error)
+	}
+	generators := []generator{
+		{"video", func(i int) ([]byte, error) { return s.GenerateMediaSegment(vf, i) }},
+		{"audio", func(i int) ([]byte, error) { return s.GenerateAudioMediaSegment(vf, i) }},
+		{"ts", func(i int) ([]byte, error) { return s.GenerateTSSegment(vf, i) }},
+	}
+
+	serial := make(map[string][]byte)
+	for _, g := range generators {
+		for i := range vf.Segments {
+			data, err := g.gen(i)
+			if err != nil {
+				t.Fatalf("%s segment %d: %v", g.name, i, err)
+			}
+			serial[fmt.Sprintf("%s/%d", g.name, i)] = data
+		}
+	}
+
+	const workers = 32
+	const rounds = 100
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*rounds)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				g := generators[(w+r)%len(generators)]
+				i := (w*7 + r*3) % len(vf.Segments)
+				data, err := g.gen(i)
+				if err != nil {
+					errs <- fmt.Errorf("%s segment %d: %w", g.name, i, err)
+					continue
+				}
+				if !bytes.Equal(data, serial[fmt.Sprintf("%s/%d", g.name, i)]) {
+					errs <- fmt.Errorf("%s segment %d differs from serial generation", g.name, i)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestSegmentETag checks that entity tags survive a restart and change with
+// segment parameters, the key of encrypted segments and the source file
+func TestSegmentETag(t *testing.T) {
+	_, vf := openFixture(t, fixtureVideo())
+	key := SegmentKey{Video: vf.Path, Track: "video", Index: 1, Format: "fmp4"}
+	tag := SegmentETag(vf, key, "")
+
+	s2 := NewSegmenter(1, 0, 0)
+	t.Cleanup(s2.Close)
+	reopened, err := s2.OpenVideo(vf.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := SegmentETag(reopened, key, ""); got != tag {
+		t.Errorf("ETag after reopening %s, want %s", got, tag)
+	}
+
+	other := key
+	other.Index = 2
+	if SegmentETag(vf, other, "") == tag {
+		t.Error("ETag does not depend on the segment")
+	}
+	other = key
+	other.Encryption = "cenc"
+	if SegmentETag(vf, other, "") == tag {
+		t.Error("ETag does not depend on encryption")
+	}
+	if SegmentETag(vf, other, "kid1") == SegmentETag(vf, other, "kid2") {
+		t.Error("ETag does not depend on the key")
+	}
+
+	if err := os.Chtimes(vf.Path, time.Time{}, vf.ModTime.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	s3 := NewSegmenter(1, 0, 0)
+	t.Cleanup(s3.Close)
+	replaced, err := s3.OpenVideo(vf.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if SegmentETag(replaced, key, "") == tag {
+		t.Error("ETag does not change with the source file")
+	}
+}
+
+// BenchmarkGenerateMediaSegment generates segments at the start, middle and
+// end of a two-hour track. Cost should not depend on the position
+func BenchmarkGenerateMediaSegment(b *testing.B) {
+	video := fixtureVideo()
+	video.sampleCount = 2 * 60 * 60 * 25
+	video.samplesPerChunk = 25
+	s, vf := openFixture(b, video)
+
+	positions := []struct {
+		name  string
+		index int
+	}{
+		{"first", 0},
+		{"middle", len(vf.Segments) / 2},
+		{"last", len(vf.Segments) - 1},
+	}
+	for _, p := range positions {
+		b.Run(p.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := s.GenerateMediaSegment(vf, p.index); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSampleAt(b *testing.B) {
+	video := fixtureVideo()
+	video.sampleCount = 2 * 60 * 60 * 25
+	video.samplesPerChunk = 25
+	_, vf := openFixture(b, video)
+
+	end := vf.VideoIndex.DecodeTimes[vf.VideoIndex.SampleCount()]
+	for _, frac := range []uint64{0, 2, 4} {
+		t := end * frac / 4
+		b.Run(fmt.Sprintf("at_%d_of_4", frac), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				vf.VideoIndex.SampleAt(t)
+			}
+		})
+	}
+}
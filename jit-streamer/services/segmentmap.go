@@ -0,0 +1,144 @@
+package services
+
+import (
+	"fmt"
+)
+
+// Segment describes sample range and timing of one media segment
+type Segment struct {
+	StartSample uint32 // 1-based, inclusive
+	EndSample   uint32 // exclusive
+	StartTime   uint64 // decode time of StartSample in track timescale
+	Duration    uint64 // in track timescale
+	Size        uint64 // total size of sample data in bytes
+}
+
+// buildKeyframeSegments splits track into segments of roughly segmentDurTS.
+// Every boundary is snapped to the sync sample nearest to the nominal
+// boundary, so each segment starts with a keyframe. An open track is still
+// being written: a boundary waiting for the next keyframe and the segment
+// after the last boundary are left out, so listed segments never change
+func buildKeyframeSegments(idx *SampleIndex, segmentDurTS uint64, open bool) ([]Segment, error) {
+	if segmentDurTS == 0 {
+		return nil, fmt.Errorf("zero segment duration")
+	}
+	sampleCount := idx.SampleCount()
+	if sampleCount == 0 {
+		return nil, fmt.Errorf("track has no samples")
+	}
+	trackEnd := idx.Time(uint32(sampleCount + 1))
+	keyframes := idx.Keyframes
+
+	// First segment always starts at the first sample, targets are counted
+	// from it past a leading empty edit
+	boundaries := []uint32{1}
+	target := idx.TimeShift + segmentDurTS
+	for {
+		last := boundaries[len(boundaries)-1]
+		// Keyframes around target: keyframes[k-1] < target <= keyframes[k]
+		k := idx.KeyframeAt(target)
+		var prev uint32 // last keyframe before target in current segment, 0 if none
+		if k > 0 && keyframes[k-1] > last {
+			prev = keyframes[k-1]
+		}
+
+		if k == len(keyframes) {
+			// Track continues past the last target with no keyframe after it
+			if prev != 0 && target < trackEnd && !open {
+				boundaries = append(boundaries, prev)
+			}
+			break
+		}
+
+		chosen := keyframes[k]
+		if prev != 0 && target-idx.Time(prev) < idx.Time(chosen)-target {
+			chosen = prev
+		}
+		if chosen <= last {
+			// Nothing left to split before target
+			target += segmentDurTS
+			continue
+		}
+		boundaries = append(boundaries, chosen)
+		// Snapping back to an earlier keyframe must not aim at the same
+		// target again, that would cut a short segment right after it
+		elapsed := idx.Time(chosen) - idx.TimeShift
+		target = max(target+segmentDurTS, idx.TimeShift+(elapsed/segmentDurTS+1)*segmentDurTS)
+	}
+
+	segments := segmentsFromBoundaries(idx, boundaries)
+	if open {
+		// Segment after the last boundary is still being written
+		segments = segments[:len(segments)-1]
+	}
+	return segments, nil
+}
+
+// buildAlignedSegments splits track so that segment i starts at the first
+// sample with decode time >= startTimes[i]. It is used to align audio with
+// video segments. Trailing segments without samples are dropped
+func buildAlignedSegments(idx *SampleIndex, startTimes []uint64) ([]Segment, error) {
+	sampleCount := uint32(idx.SampleCount())
+	if sampleCount == 0 || len(startTimes) == 0 {
+		return nil, nil
+	}
+
+	boundaries := []uint32{1}
+	for _, t := range startTimes[1:] {
+		nr := idx.SampleAt(t)
+		if nr > sampleCount {
+			break
+		}
+		if nr > boundaries[len(boundaries)-1] {
+			boundaries = append(boundaries, nr)
+		}
+	}
+
+	return segmentsFromBoundaries(idx, boundaries), nil
+}
+
+func segmentsFromBoundaries(idx *SampleIndex, boundaries []uint32) []Segment {
+	end := uint32(idx.SampleCount() + 1)
+	segments := make([]Segment, 0, len(boundaries))
+	for i, start := range boundaries {
+		next := end
+		if i+1 < len(boundaries) {
+			next = boundaries[i+1]
+		}
+		segments = append(segments, Segment{
+			StartSample: start,
+			EndSample:   next,
+			StartTime:   idx.Time(start),
+			Duration:    idx.Time(next) - idx.Time(start),
+			Size:        idx.Size(start, next),
+		})
+	}
+	return segments
+}
+
+// segmentBandwidth measures peak and average bitrate (bits/s) of segments
+func segmentBandwidth(segments []Segment, timescale uint32) (peak, average uint32) {
+	var totalSize, totalDur uint64
+	for _, seg := range segments {
+		totalSize += seg.Size
+		totalDur += seg.Duration
+		if seg.Duration == 0 {
+			continue
+		}
+		if bw := uint32(seg.Size * 8 * uint64(timescale) / seg.Duration); bw > peak {
+			peak = bw
+		}
+	}
+	if totalDur > 0 {
+		average = uint32(totalSize * 8 * uint64(timescale) / totalDur)
+	}
+	return peak, average
+}
+
+// rescaleTime converts time value between timescales
+func rescaleTime(t uint64, from, to uint32) uint64 {
+	if from == to || from == 0 {
+		return t
+	}
+	return t * uint64(to) / uint64(from)
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"slices"
+	"testing"
+)
+
+// syntheticIndex returns index of count samples lasting one tick each, so
+// sample nr is decoded at nr-1. keyframes lists sync samples
+func syntheticIndex(count int, keyframes ...uint32) *SampleIndex {
+	idx := &SampleIndex{
+		DecodeTimes: make([]uint64, count+1),
+		Offsets:     make([]uint64, count),
+		Sizes:       make([]uint32, count),
+		Sync:        make([]bool, count),
+	}
+	for i := range idx.DecodeTimes {
+		idx.DecodeTimes[i] = uint64(i)
+	}
+	for i := range idx.Sizes {
+		idx.Offsets[i] = uint64(i) * 100
+		idx.Sizes[i] = 100
+	}
+	for _, nr := range keyframes {
+		idx.Sync[nr-1] = true
+	}
+	idx.indexKeyframes()
+	return idx
+}
+
+func TestBuildKeyframeSegments(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		count     int
+		keyframes []uint32
+		open      bool
+		starts    []uint32 // first sample of every segment
+	}{
+		{"regular GOPs", 150, []uint32{1, 26, 51, 76, 101, 126}, false, []uint32{1, 51, 101}},
+		// Boundary at 50 snaps back to the keyframe at 44, the next one is
+		// still aimed at 100
+		{"nearest keyframe", 150, []uint32{1, 45, 70, 95, 120}, false, []uint32{1, 45, 95}},
+		{"later keyframe", 150, []uint32{1, 40, 57, 120}, false, []uint32{1, 57, 120}},
+		{"sparse GOPs", 150, []uint32{1, 120}, false, []uint32{1, 120}},
+		{"single keyframe", 150, []uint32{1}, false, []uint32{1}},
+		{"short final segment", 110, []uint32{1, 26, 51, 76, 101}, false, []uint32{1, 51, 101}},
+		// No keyframe after the last target, the one before it still
+		// splits the tail
+		{"keyframe before end", 200, []uint32{1, 51, 95}, false, []uint32{1, 51, 95}},
+		{"open track", 150, []uint32{1, 26, 51, 76, 101, 126}, true, []uint32{1, 51}},
+		{"open track waiting for keyframe", 200, []uint32{1, 51, 95}, true, []uint32{1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			idx := syntheticIndex(tc.count, tc.keyframes...)
+			segments, err := buildKeyframeSegments(idx, 50, tc.open)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var starts []uint32
+			for i, seg := range segments {
+				starts = append(starts, seg.StartSample)
+				if !idx.IsSync(seg.StartSample) {
+					t.Errorf("segment %d starts with non-sync sample %d", i, seg.StartSample)
+				}
+				if seg.StartTime != idx.Time(seg.StartSample) || seg.Duration != idx.Time(seg.EndSample)-seg.StartTime {
+					t.Errorf("segment %d timing %d+%d does not match samples [%d, %d)", i, seg.StartTime, seg.Duration, seg.StartSample, seg.EndSample)
+				}
+				if seg.Size != 100*uint64(seg.EndSample-seg.StartSample) {
+					t.Errorf("segment %d size %d", i, seg.Size)
+				}
+				if i > 0 && seg.StartSample != segments[i-1].EndSample {
+					t.Errorf("segment %d starts at %d, previous ends at %d", i, seg.StartSample, segments[i-1].EndSample)
+				}
+			}
+			if !slices.Equal(starts, tc.starts) {
+				t.Errorf("segments start at %v, want %v", starts, tc.starts)
+			}
+			if !tc.open && segments[len(segments)-1].EndSample != uint32(tc.count+1) {
+				t.Errorf("last segment ends at %d, want track end", segments[len(segments)-1].EndSample)
+			}
+		})
+	}
+
+	// Leading empty edit longer than a segment does not cut an empty one,
+	// targets are counted from the first sample
+	idx := syntheticIndex(150, 1, 26, 51, 76, 101, 126)
+	idx.TimeShift = 120
+	segments, err := buildKeyframeSegments(idx, 50, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var starts []uint32
+	for _, seg := range segments {
+		starts = append(starts, seg.StartSample)
+		if seg.Duration == 0 {
+			t.Errorf("empty segment at sample %d", seg.StartSample)
+		}
+	}
+	if want := []uint32{1, 51, 101}; !slices.Equal(starts, want) || segments[0].StartTime != 120 {
+		t.Errorf("segments after an empty edit start at %v from %d, want %v from 120", starts, segments[0].StartTime, want)
+	}
+
+	if _, err := buildKeyframeSegments(syntheticIndex(10, 1), 0, false); err == nil {
+		t.Error("zero segment duration accepted")
+	}
+	if _, err := buildKeyframeSegments(syntheticIndex(0), 50, false); err == nil {
+		t.Error("empty track accepted")
+	}
+}
+
+func TestBuildAlignedSegments(t *testing.T) {
+	idx := syntheticIndex(100)
+	segments, err := buildAlignedSegments(idx, []uint64{0, 30, 60, 120})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var starts []uint32
+	for _, seg := range segments {
+		starts = append(starts, seg.StartSample)
+	}
+	// Start past the last sample is dropped, the last segment runs to the end
+	if want := []uint32{1, 31, 61}; !slices.Equal(starts, want) || segments[2].EndSample != 101 {
+		t.Errorf("segments start at %v ending at %d, want %v ending at 101", starts, segments[len(segments)-1].EndSample, want)
+	}
+}
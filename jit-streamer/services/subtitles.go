@@ -0,0 +1,334 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// Sidecar subtitles are converted to WebVTT and cut along video segments,
+// so subtitle segment N covers the same time as video segment N. HLS gets
+// WebVTT segments repeating cues that span a boundary, DASH gets fMP4 wvtt
+// segments (ISO/IEC 14496-30) whose samples split the segment at every cue
+// start and end. Both are on the output timeline of the video: shifted to
+// the start of a clip and in the video timescale
+
+// Cue is a subtitle cue with WebVTT text
+type Cue struct {
+	ID       string
+	Start    time.Duration
+	End      time.Duration
+	Settings string // WebVTT cue settings, e.g. "line:0 align:start"
+	Text     string
+}
+
+// LoadSubtitles reads an SRT or WebVTT file and returns its cues sorted by
+// start time
+func LoadSubtitles(path string) ([]Cue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cues, err := parseSubtitles(string(data), strings.EqualFold(filepath.Ext(path), ".srt"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return cues, nil
+}
+
+// parseSubtitles parses SRT or WebVTT text. Blocks without timing, like
+// WebVTT NOTE, STYLE and REGION blocks, are skipped
+func parseSubtitles(text string, srt bool) ([]Cue, error) {
+	text = strings.TrimPrefix(text, "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	var blocks [][]string
+	var block []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			if len(block) > 0 {
+				blocks = append(blocks, block)
+				block = nil
+			}
+			continue
+		}
+		block = append(block, line)
+	}
+	if len(block) > 0 {
+		blocks = append(blocks, block)
+	}
+
+	if !srt {
+		if len(blocks) == 0 || !strings.HasPrefix(blocks[0][0], "WEBVTT") {
+			return nil, fmt.Errorf("missing WEBVTT header")
+		}
+		blocks = blocks[1:]
+	}
+
+	var cues []Cue
+	for _, lines := range blocks {
+		// Timing is the first line, or the second after a cue identifier
+		timing := -1
+		for i := 0; i < min(2, len(lines)); i++ {
+			if strings.Contains(lines[i], "-->") {
+				timing = i
+				break
+			}
+		}
+		if timing < 0 {
+			continue
+		}
+
+		start, rest, _ := strings.Cut(lines[timing], "-->")
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("bad cue timing %q", lines[timing])
+		}
+		cue := Cue{Text: strings.Join(lines[timing+1:], "\n")}
+		var err error
+		if cue.Start, err = parseCueTime(start, srt); err != nil {
+			return nil, err
+		}
+		if cue.End, err = parseCueTime(fields[0], srt); err != nil {
+			return nil, err
+		}
+		if srt {
+			// Sequence numbers and X1:Y1 coordinates of SRT are dropped
+			cue.Text = srtText(cue.Text)
+		} else {
+			if timing == 1 {
+				cue.ID = lines[0]
+			}
+			cue.Settings = strings.Join(fields[1:], " ")
+		}
+		if cue.End <= cue.Start || cue.Text == "" {
+			continue
+		}
+		cues = append(cues, cue)
+	}
+
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].Start < cues[j].Start })
+	return cues, nil
+}
+
+// parseCueTime parses [hh:]mm:ss.ttt, SRT uses a comma before milliseconds
+func parseCueTime(s string, srt bool) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if srt {
+		s = strings.Replace(s, ",", ".", 1)
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("bad cue time %q", s)
+	}
+	var minutes int
+	for i, part := range parts[:len(parts)-1] {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 || (i > 0 && v >= 60) {
+			return 0, fmt.Errorf("bad cue time %q", s)
+		}
+		minutes = minutes*60 + v
+	}
+	sec, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil || sec < 0 || sec >= 60 {
+		return 0, fmt.Errorf("bad cue time %q", s)
+	}
+	return time.Duration(minutes)*time.Minute + time.Duration(sec*1000+0.5)*time.Millisecond, nil
+}
+
+// srtTag matches SRT formatting: HTML-like tags and ASS overrides like {\an8}
+var srtTag = regexp.MustCompile(`(?i)</?(b|i|u|font)(\s[^>]*)?>|\{\\[^}]*\}`)
+
+var cueTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// srtText converts SRT cue text to WebVTT. Bold, italic and underline are
+// kept, fonts and ASS overrides are dropped and the rest is escaped
+func srtText(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range srtTag.FindAllStringIndex(text, -1) {
+		b.WriteString(cueTextEscaper.Replace(text[last:m[0]]))
+		switch tag := strings.ToLower(text[m[0]:m[1]]); tag {
+		case "<b>", "</b>", "<i>", "</i>", "<u>", "</u>":
+			b.WriteString(tag)
+		}
+		last = m[1]
+	}
+	b.WriteString(cueTextEscaper.Replace(text[last:]))
+	return strings.TrimSpace(b.String())
+}
+
+// timedCue is a cue on the output timeline of a video in its timescale
+type timedCue struct {
+	Cue
+	start, end uint64
+}
+
+// placeCues moves cues to the output timeline of vf. Cues outside of it are
+// dropped, cues cut by its start or end are shortened
+func placeCues(vf *VideoFile, cues []Cue) []timedCue {
+	if len(vf.Segments) == 0 || vf.Timescale == 0 {
+		return nil
+	}
+	last := vf.Segments[len(vf.Segments)-1]
+	end := int64(last.StartTime + last.Duration)
+	origin := int64(vf.ClipOrigin) - int64(shiftTime(vf.Offset, vf.Timescale))
+
+	var placed []timedCue
+	for _, cue := range cues {
+		start := int64(uint64(cue.Start)*uint64(vf.Timescale)/uint64(time.Second)) - origin
+		stop := int64(uint64(cue.End)*uint64(vf.Timescale)/uint64(time.Second)) - origin
+		start, stop = max(start, 0), min(stop, end)
+		if stop <= start {
+			continue
+		}
+		placed = append(placed, timedCue{Cue: cue, start: uint64(start), end: uint64(stop)})
+	}
+	return placed
+}
+
+// subtitleWindow returns time range of video segment n in Timescale. The
+// first segment reaches back to zero, so cues before the first frame show
+func subtitleWindow(vf *VideoFile, n int) (uint64, uint64) {
+	seg := vf.Segments[n]
+	start := seg.StartTime
+	if n == 0 {
+		start = 0
+	}
+	return start, seg.StartTime + seg.Duration
+}
+
+// GenerateWebVTT writes the whole subtitle track as a single WebVTT file
+func (s *Segmenter) GenerateWebVTT(vf *VideoFile, cues []Cue) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n")
+	for _, cue := range placeCues(vf, cues) {
+		writeCue(&buf, cue, vf.Timescale)
+	}
+	return buf.Bytes()
+}
+
+// GenerateWebVTTSegment writes subtitles_<lang>_N.vtt with the cues shown
+// during video segment n. The timestamp map ties cue times to media time
+// zero of the fMP4 segments
+func (s *Segmenter) GenerateWebVTTSegment(vf *VideoFile, cues []Cue, segmentIndex int) ([]byte, error) {
+	if segmentIndex < 0 || segmentIndex >= len(vf.Segments) {
+		return nil, fmt.Errorf("segment %d out of range", segmentIndex)
+	}
+	start, end := subtitleWindow(vf, segmentIndex)
+
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n")
+	buf.WriteString("X-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n")
+	for _, cue := range placeCues(vf, cues) {
+		if cue.start < end && cue.end > start {
+			writeCue(&buf, cue, vf.Timescale)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCue(buf *bytes.Buffer, cue timedCue, timescale uint32) {
+	buf.WriteString("\n")
+	if cue.ID != "" {
+		buf.WriteString(cue.ID + "\n")
+	}
+	buf.WriteString(formatVTTTime(float64(cue.start)/float64(timescale)) + " --> " + formatVTTTime(float64(cue.end)/float64(timescale)))
+	if cue.Settings != "" {
+		buf.WriteString(" " + cue.Settings)
+	}
+	buf.WriteString("\n" + cue.Text + "\n")
+}
+
+// GenerateSubtitleInitSegment returns init segment of the wvtt track. It
+// uses the video timescale, so DASH shares the video SegmentTimeline
+func (s *Segmenter) GenerateSubtitleInitSegment(vf *VideoFile, lang string) ([]byte, error) {
+	if vf.Timescale == 0 {
+		return nil, fmt.Errorf("no video track")
+	}
+	init := mp4.CreateEmptyInit()
+	init.AddEmptyTrack(vf.Timescale, "wvtt", lang)
+	if err := init.Moov.Trak.SetWvttDescriptor("WEBVTT"); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := init.Encode(buf); err != nil {
+		return nil, fmt.Errorf("failed to encode init segment: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// GenerateSubtitleMediaSegment writes subtitles_<lang>_N.m4s. Every sample
+// holds the cues shown over its span, or an empty cue box when none are
+func (s *Segmenter) GenerateSubtitleMediaSegment(vf *VideoFile, cues []Cue, segmentIndex int) ([]byte, error) {
+	if segmentIndex < 0 || segmentIndex >= len(vf.Segments) {
+		return nil, fmt.Errorf("segment %d out of range", segmentIndex)
+	}
+	seg := vf.Segments[segmentIndex]
+	start, end := seg.StartTime, seg.StartTime+seg.Duration
+
+	var active []timedCue
+	bounds := []uint64{start, end}
+	for _, cue := range placeCues(vf, cues) {
+		if cue.start >= end || cue.end <= start {
+			continue
+		}
+		active = append(active, cue)
+		bounds = append(bounds, max(cue.start, start), min(cue.end, end))
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	var samples []mp4.Sample
+	var mdat bytes.Buffer
+	for i := 1; i < len(bounds); i++ {
+		from, to := bounds[i-1], bounds[i]
+		if from == to {
+			continue
+		}
+		size := mdat.Len()
+		shown := 0
+		for _, cue := range active {
+			if cue.start <= from && cue.end >= to {
+				if err := cueBox(cue.Cue).Encode(&mdat); err != nil {
+					return nil, err
+				}
+				shown++
+			}
+		}
+		if shown == 0 {
+			if err := (&mp4.VtteBox{}).Encode(&mdat); err != nil {
+				return nil, err
+			}
+		}
+		samples = append(samples, mp4.Sample{
+			Flags: 0x2000000, // Sync sample
+			Dur:   uint32(to - from),
+			Size:  uint32(mdat.Len() - size),
+		})
+	}
+
+	return s.encodeMediaSegment(uint32(segmentIndex+1), start, samples, mdat.Bytes())
+}
+
+// cueBox returns the vttc box of a cue
+func cueBox(cue Cue) *mp4.VttcBox {
+	vttc := &mp4.VttcBox{}
+	if cue.ID != "" {
+		vttc.AddChild(&mp4.IdenBox{CueID: cue.ID})
+	}
+	if cue.Settings != "" {
+		vttc.AddChild(&mp4.SttgBox{Settings: cue.Settings})
+	}
+	vttc.AddChild(&mp4.PaylBox{CueText: cue.Text})
+	return vttc
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// TestParseSubtitles checks SRT conversion to WebVTT text and WebVTT cue
+// identifiers and settings
+func TestParseSubtitles(t *testing.T) {
+	srt := "\ufeff1\r\n00:00:01,000 --> 00:00:02,500\r\n<font color=\"red\">Tom</font> & <i>Jerry</i>\r\n\r\n" +
+		"2\r\n00:00:00,500 --> 00:00:04,000 X1:10 X2:20 Y1:1 Y2:2\r\n{\\an8}a -> b\r\n"
+	cues, err := parseSubtitles(srt, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Cue{
+		{Start: 500 * time.Millisecond, End: 4 * time.Second, Text: "a -&gt; b"},
+		{Start: time.Second, End: 2500 * time.Millisecond, Text: "Tom &amp; <i>Jerry</i>"},
+	}
+	if !reflect.DeepEqual(cues, want) {
+		t.Errorf("SRT cues %+v, want %+v", cues, want)
+	}
+
+	vtt := "WEBVTT - with header text\n\nNOTE no cues here\n\nintro\n01:00:01.000 --> 01:00:02.000 line:0 align:start\nHi\nthere\n\n00:03.000 --> 00:04.000\n<v Bob>Bye\n"
+	cues, err = parseSubtitles(vtt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []Cue{
+		{Start: 3 * time.Second, End: 4 * time.Second, Text: "<v Bob>Bye"},
+		{ID: "intro", Start: time.Hour + time.Second, End: time.Hour + 2*time.Second, Settings: "line:0 align:start", Text: "Hi\nthere"},
+	}
+	if !reflect.DeepEqual(cues, want) {
+		t.Errorf("WebVTT cues %+v, want %+v", cues, want)
+	}
+
+	if _, err := parseSubtitles("1\n00:00:01,000 --> 00:61:02,000\nx\n", true); err == nil {
+		t.Error("cue time with 61 minutes parsed")
+	}
+	if _, err := parseSubtitles("00:01.000 --> 00:02.000\nx\n", false); err == nil {
+		t.Error("WebVTT without header parsed")
+	}
+}
+
+// TestSubtitleSegments checks that subtitle segments follow video segments:
+// WebVTT segments repeat cues spanning a boundary and wvtt samples cover
+// their segment without gaps
+func TestSubtitleSegments(t *testing.T) {
+	s := NewSegmenter(3, 0, 0)
+	t.Cleanup(s.Close)
+	vf, err := s.OpenVideo(writeFixture(t, fixtureVideo(), fixtureAudio()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cues := []Cue{
+		{Start: 1 * time.Second, End: 2 * time.Second, Text: "a"},
+		{Start: 2500 * time.Millisecond, End: 4 * time.Second, Text: "b"}, // spans 3 s boundary
+		{Start: 5 * time.Second, End: 7 * time.Second, Text: "c"},         // past the end at 6 s
+	}
+
+	var texts []string
+	for n := range vf.Segments {
+		data, err := s.GenerateWebVTTSegment(vf, cues, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		texts = append(texts, string(data))
+	}
+	header := "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n"
+	want := []string{
+		header + "\n00:00:01.000 --> 00:00:02.000\na\n\n00:00:02.500 --> 00:00:04.000\nb\n",
+		header + "\n00:00:02.500 --> 00:00:04.000\nb\n\n00:00:05.000 --> 00:00:06.000\nc\n",
+	}
+	if !reflect.DeepEqual(texts, want) {
+		t.Errorf("WebVTT segments %q, want %q", texts, want)
+	}
+
+	init, err := s.GenerateSubtitleInitSegment(vf, "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Shown text per sample: "" for empty cue boxes
+	wantShown := [][]string{{"", "a", "", "b"}, {"b", "", "c"}}
+	for n, seg := range vf.Segments {
+		data, err := s.GenerateSubtitleMediaSegment(vf, cues, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := mp4.DecodeFile(bytes.NewReader(append(append([]byte{}, init...), data...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Init.Moov.Trak.Mdia.Mdhd.Timescale != vf.Timescale {
+			t.Fatal("wvtt track is not in video timescale")
+		}
+		frag := f.Segments[0].Fragments[0]
+		if tfdt := frag.Moof.Traf.Tfdt.BaseMediaDecodeTime(); tfdt != seg.StartTime {
+			t.Errorf("segment %d tfdt %d, want %d", n, tfdt, seg.StartTime)
+		}
+		samples, err := frag.GetFullSamples(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total uint64
+		var shown []string
+		for _, sample := range samples {
+			total += uint64(sample.Dur)
+			box, err := mp4.DecodeBox(0, bytes.NewReader(sample.Data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vttc, ok := box.(*mp4.VttcBox); ok {
+				shown = append(shown, vttc.Payl.CueText)
+			} else {
+				shown = append(shown, "")
+			}
+		}
+		if total != seg.Duration {
+			t.Errorf("segment %d samples last %d, segment %d", n, total, seg.Duration)
+		}
+		if !reflect.DeepEqual(shown, wantShown[n]) {
+			t.Errorf("segment %d samples show %q, want %q", n, shown, wantShown[n])
+		}
+	}
+
+	// Clip from 2 s: a ends at the clip start, b moves to 0.5 s
+	clip, err := s.ClipVideo(vf, &Clip{Start: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vtt := string(s.GenerateWebVTT(clip, cues))
+	if strings.Contains(vtt, "\na\n") || !strings.Contains(vtt, "00:00:00.500 --> 00:00:02.000\nb\n") {
+		t.Errorf("cues of clip from 2 s:\n%s", vtt)
+	}
+}
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// Thumbnail sprite sheets for seek-bar previews. Thumbnails are taken every
+// interval from the sync sample at or before that time, found via stss, so
+// ffmpeg decodes keyframes only. A sheet tiles thumbnailColumns x
+// thumbnailRows of them left to right, top to bottom
+const (
+	thumbnailWidth   = 160
+	thumbnailColumns = 5
+	thumbnailRows    = 5
+)
+
+// Thumbnailer renders sprite sheets of thumbnails with ffmpeg
+type Thumbnailer struct {
+	segmenter *Segmenter
+	interval  time.Duration
+}
+
+// NewThumbnailer takes a thumbnail every intervalSec seconds, 0 disables
+// thumbnails
+func NewThumbnailer(seg *Segmenter, intervalSec int) *Thumbnailer {
+	return &Thumbnailer{segmenter: seg, interval: time.Duration(intervalSec) * time.Second}
+}
+
+// ThumbnailParams describes the thumbnail track of a video
+type ThumbnailParams struct {
+	Width     uint32 // of a single thumbnail
+	Height    uint32
+	Columns   int
+	Rows      int
+	Interval  float64 // seconds between thumbnails
+	Count     int     // thumbnails in all sheets
+	Bandwidth uint32  // estimate, sheets are not rendered in advance
+}
+
+// Sheets returns number of sprite sheets
+func (p *ThumbnailParams) Sheets() int {
+	perSheet := p.Columns * p.Rows
+	return (p.Count + perSheet - 1) / perSheet
+}
+
+// SheetDuration returns seconds covered by a full sheet
+func (p *ThumbnailParams) SheetDuration() float64 {
+	return p.Interval * float64(p.Columns*p.Rows)
+}
+
+// Params returns thumbnail track of the video, nil when thumbnails are
+// disabled or the video is live
+func (t *Thumbnailer) Params(vf *VideoFile) *ThumbnailParams {
+	if t.interval <= 0 || vf.Live || vf.VideoIndex == nil || len(vf.VideoIndex.Keyframes) == 0 || vf.Timescale == 0 || vf.Width == 0 {
+		return nil
+	}
+	interval := uint64(t.interval) * uint64(vf.Timescale) / uint64(time.Second)
+	duration := vf.VideoIndex.Time(uint32(vf.VideoIndex.SampleCount() + 1))
+	p := &ThumbnailParams{
+		Width:    thumbnailWidth,
+		Height:   (thumbnailWidth*vf.Height/vf.Width + 1) &^ 1,
+		Columns:  thumbnailColumns,
+		Rows:     thumbnailRows,
+		Interval: t.interval.Seconds(),
+		Count:    int((duration + interval - 1) / interval),
+	}
+	// About a bit per pixel of JPEG
+	sheetBits := uint64(p.Width) * uint64(p.Height) * uint64(p.Columns*p.Rows)
+	p.Bandwidth = uint32(float64(sheetBits) / p.SheetDuration())
+	return p
+}
+
+// thumbnailFrames returns sync samples shown by thumbnails of sheet n
+func (t *Thumbnailer) thumbnailFrames(vf *VideoFile, params *ThumbnailParams, n int) []uint32 {
+	idx := vf.VideoIndex
+	perSheet := params.Columns * params.Rows
+	var frames []uint32
+	for i := n * perSheet; i < min((n+1)*perSheet, params.Count); i++ {
+		at := uint64(i) * uint64(t.interval) * uint64(vf.Timescale) / uint64(time.Second)
+		// Last keyframe at or before the thumbnail time, or the first one
+		k := max(idx.KeyframeAt(at+1), 1)
+		frames = append(frames, idx.Keyframes[k-1])
+	}
+	return frames
+}
+
+// GenerateSheet renders sprite sheet n as JPEG
+func (t *Thumbnailer) GenerateSheet(vf *VideoFile, n int) ([]byte, error) {
+	params := t.Params(vf)
+	if params == nil {
+		return nil, fmt.Errorf("no thumbnails")
+	}
+	if n < 0 || n >= params.Sheets() {
+		return nil, fmt.Errorf("sheet %d out of range", n)
+	}
+	input, err := t.sheetInput(vf, t.thumbnailFrames(vf, params, n))
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-f", "mp4",
+		"-i", "pipe:0",
+		"-map", "0:v:0",
+		"-an", "-sn",
+		// Last sheet is flushed at end of input with empty tiles left black
+		"-vf", fmt.Sprintf("scale=%d:%d,tile=%dx%d", params.Width, params.Height, params.Columns, params.Rows),
+		"-frames:v", "1",
+		"-q:v", "5",
+		"-f", "image2",
+		"-c:v", "mjpeg",
+		"pipe:1",
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("ffmpeg wrote no thumbnail sheet")
+	}
+	return stdout.Bytes(), nil
+}
+
+// sheetInput writes the sync samples as a fragmented MP4 for the decoder.
+// Every frame gets its own fragment one second after the previous one, the
+// same keyframe may appear twice when keyframes are sparse
+func (t *Thumbnailer) sheetInput(vf *VideoFile, frames []uint32) ([]byte, error) {
+	init, err := t.segmenter.GenerateInitSegment(vf)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(init)
+	for i, nr := range frames {
+		samples, data, err := t.segmenter.readSamples(vf, vf.VideoIndex, nr, nr+1)
+		if err != nil {
+			return nil, err
+		}
+		samples[0].Dur = vf.Timescale
+		samples[0].CompositionTimeOffset = 0
+		if err := t.segmenter.encodeFragment(buf, uint32(i+1), uint64(i)*uint64(vf.Timescale), samples, data); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
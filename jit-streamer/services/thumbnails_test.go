@@ -0,0 +1,66 @@
+package services
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// TestThumbnailFrames checks that thumbnails show the last keyframe at or
+// before their time and that the decoder gets exactly those frames
+func TestThumbnailFrames(t *testing.T) {
+	video := fixtureVideo()
+	video.keyframeEvery = 45 // 1.8 s, thumbnail times fall between keyframes
+	s, vf := openFixture(t, video, fixtureAudio())
+	th := NewThumbnailer(s, 2)
+
+	params := th.Params(vf)
+	if params == nil {
+		t.Fatal("no thumbnails")
+	}
+	if params.Count != 3 || params.Sheets() != 1 || params.Width != 160 || params.Height != 90 {
+		t.Errorf("thumbnails %+v", *params)
+	}
+
+	// 0 s, 2 s and 4 s show keyframes at 0 s, 1.8 s and 3.6 s
+	frames := th.thumbnailFrames(vf, params, 0)
+	if want := []uint32{1, 46, 91}; !reflect.DeepEqual(frames, want) {
+		t.Fatalf("thumbnail frames %v, want %v", frames, want)
+	}
+
+	input, err := th.sheetInput(vf, frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := mp4.DecodeFile(bytes.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Init == nil || len(f.Segments) != 1 || len(f.Segments[0].Fragments) != len(frames) {
+		t.Fatal("decoder input is not an init segment with a fragment per thumbnail")
+	}
+	var last uint64
+	for i, frag := range f.Segments[0].Fragments {
+		samples, err := frag.GetFullSamples(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) != 1 || !samples[0].IsSync() {
+			t.Fatalf("fragment %d has %d samples", i, len(samples))
+		}
+		if i > 0 && samples[0].DecodeTime <= last {
+			t.Errorf("fragment %d decodes at %d after %d", i, samples[0].DecodeTime, last)
+		}
+		last = samples[0].DecodeTime
+		if want := fixtureSampleData(0, int(frames[i]), true, true); !bytes.Equal(samples[0].Data, want) {
+			t.Errorf("fragment %d data differs from keyframe %d", i, frames[i])
+		}
+	}
+
+	vf.Live = true
+	if th.Params(vf) != nil {
+		t.Error("thumbnails of a live source")
+	}
+}
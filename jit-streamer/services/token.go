@@ -0,0 +1,155 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Playback tokens sign the scope a client may stream, an expiry and
+// optionally the client address with HMAC-SHA256. A token is
+// base64url(JSON claims) "." base64url(signature) and travels in the token
+// query parameter, manifests carry it onto every child URI
+
+var (
+	ErrTokenRequired = errors.New("playback token required")
+	ErrInvalidToken  = errors.New("invalid playback token")
+	ErrTokenExpired  = errors.New("playback token expired")
+	ErrTokenScope    = errors.New("playback token not valid for this stream")
+)
+
+// Kinds of streams a token scope names. A scope is <kind>:<name>, so a token
+// of a video does not grant an asset or a channel of the same name
+const (
+	ScopeVideo   = "video"
+	ScopeChannel = "channel"
+	ScopeAsset   = "asset"
+)
+
+// Scope returns the token scope of the stream of kind called name
+func Scope(kind, name string) string {
+	return kind + ":" + name
+}
+
+// ValidScope reports whether scope names a kind of stream and a name
+func ValidScope(scope string) bool {
+	kind, name, ok := strings.Cut(scope, ":")
+	switch kind {
+	case ScopeVideo, ScopeChannel, ScopeAsset:
+		return ok && name != ""
+	}
+	return false
+}
+
+// TokenClaims is the signed payload of a playback token
+type TokenClaims struct {
+	Scope   string `json:"scope"`        // kind:name of the stream, a trailing * matches a prefix of the name
+	Expires int64  `json:"exp"`          // unix time
+	IP      string `json:"ip,omitempty"` // client address the token is bound to
+}
+
+// Allows reports whether the claims grant streaming scope, as returned by
+// Scope, to a client at ip
+func (c TokenClaims) Allows(scope, ip string) error {
+	if prefix, ok := strings.CutSuffix(c.Scope, "*"); ok {
+		if !strings.HasPrefix(scope, prefix) {
+			return ErrTokenScope
+		}
+	} else if scope != c.Scope {
+		return ErrTokenScope
+	}
+	if c.IP != "" && !net.ParseIP(c.IP).Equal(net.ParseIP(ip)) {
+		return fmt.Errorf("%w: bound to another client", ErrTokenScope)
+	}
+	return nil
+}
+
+// TokenService signs and verifies playback tokens. Without a secret tokens
+// are not required
+type TokenService struct {
+	secret   []byte
+	adminKey string // authorizes minting tokens through the API, empty disables it
+}
+
+func NewTokenService(secret, adminKey string) *TokenService {
+	return &TokenService{secret: []byte(secret), adminKey: adminKey}
+}
+
+func (s *TokenService) Enabled() bool {
+	return len(s.secret) > 0
+}
+
+// Authorize reports whether key may mint tokens
+func (s *TokenService) Authorize(key string) bool {
+	return s.Enabled() && s.adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(s.adminKey)) == 1
+}
+
+// Sign returns the token of claims
+func (s *TokenService) Sign(claims TokenClaims) (string, error) {
+	if !s.Enabled() {
+		return "", errors.New("no token secret configured")
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.mac(encoded)), nil
+}
+
+// Verify checks signature and expiry of token and returns its claims
+func (s *TokenService) Verify(token string, now time.Time) (TokenClaims, error) {
+	if token == "" {
+		return TokenClaims{}, ErrTokenRequired
+	}
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return TokenClaims{}, ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, s.mac(encoded)) {
+		return TokenClaims{}, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return TokenClaims{}, ErrInvalidToken
+	}
+	var claims TokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return TokenClaims{}, ErrInvalidToken
+	}
+	if now.Unix() >= claims.Expires {
+		return TokenClaims{}, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+// Derive returns a token like claims for another scope. Channel playlists
+// hand one out for every video whose segments they reference
+func (s *TokenService) Derive(claims TokenClaims, scope string) (string, error) {
+	claims.Scope = scope
+	return s.Sign(claims)
+}
+
+func (s *TokenService) mac(payload string) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// SignVideo returns a view of vf whose manifests carry token on every URI
+func (s *Segmenter) SignVideo(vf *VideoFile, token string) *VideoFile {
+	if vf.Token == token {
+		return vf
+	}
+	c := *vf
+	c.Token = token
+	return &c
+}
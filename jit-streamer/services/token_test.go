@@ -0,0 +1,75 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlaybackTokens(t *testing.T) {
+	s := NewTokenService("secret", "admin")
+	now := time.Unix(1700000000, 0)
+
+	token, err := s.Sign(TokenClaims{Scope: "video:news*", Expires: now.Add(time.Minute).Unix(), IP: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.Verify(token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := claims.Allows(Scope(ScopeVideo, "news_evening"), "10.0.0.1"); err != nil {
+		t.Errorf("Allows(news_evening) = %v", err)
+	}
+	if err := claims.Allows(Scope(ScopeVideo, "sports"), "10.0.0.1"); !errors.Is(err, ErrTokenScope) {
+		t.Errorf("Allows(sports) = %v, want ErrTokenScope", err)
+	}
+	// Channels and assets named like the video are not granted
+	for _, kind := range []string{ScopeChannel, ScopeAsset} {
+		if err := claims.Allows(Scope(kind, "news"), "10.0.0.1"); !errors.Is(err, ErrTokenScope) {
+			t.Errorf("Allows(%s news) = %v, want ErrTokenScope", kind, err)
+		}
+	}
+	if err := claims.Allows(Scope(ScopeVideo, "news"), "10.0.0.2"); !errors.Is(err, ErrTokenScope) {
+		t.Errorf("Allows from another client = %v, want ErrTokenScope", err)
+	}
+
+	if _, err := s.Verify(token, now.Add(time.Minute)); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Verify after expiry = %v, want ErrTokenExpired", err)
+	}
+	if _, err := s.Verify("", now); !errors.Is(err, ErrTokenRequired) {
+		t.Errorf("Verify without token = %v, want ErrTokenRequired", err)
+	}
+	payload, sig, _ := strings.Cut(token, ".")
+	for _, bad := range []string{payload + "x." + sig, payload + "." + sig[1:], payload, "." + sig} {
+		if _, err := s.Verify(bad, now); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verify(%q) = %v, want ErrInvalidToken", bad, err)
+		}
+	}
+	if _, err := NewTokenService("other", "").Verify(token, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Verify with another secret = %v, want ErrInvalidToken", err)
+	}
+
+	derived, err := s.Derive(claims, Scope(ScopeVideo, "news_evening"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Verify(derived, now)
+	if err != nil || got != (TokenClaims{Scope: "video:news_evening", Expires: claims.Expires, IP: claims.IP}) {
+		t.Errorf("derived claims %+v, %v", got, err)
+	}
+
+	for scope, valid := range map[string]bool{"video:news": true, "channel:*": true, "asset:show": true, "news": false, "*": false, "video:": false, "clip:news": false} {
+		if ValidScope(scope) != valid {
+			t.Errorf("ValidScope(%q) = %v", scope, !valid)
+		}
+	}
+
+	if !s.Authorize("admin") || s.Authorize("") || s.Authorize("admin2") {
+		t.Error("Authorize accepts a wrong admin key or rejects the right one")
+	}
+	if NewTokenService("secret", "").Authorize("") {
+		t.Error("Authorize accepts without an admin key configured")
+	}
+}
@@ -0,0 +1,309 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+
+	"amka.ru/jit-streamer/models"
+)
+
+// Transcoder builds the ABR ladder from models.DefaultQualities by
+// re-encoding every requested source segment with ffmpeg. Source segment map
+// and decode timeline are kept, so renditions are switchable at any segment
+type Transcoder struct {
+	segmenter *Segmenter
+
+	mu sync.Mutex
+	// Parameter sets of the init segments generated, media segments are
+	// checked against them
+	params map[transcodeKey][][]byte
+}
+
+// maxTranscodeParams bounds the number of renditions parameter sets are
+// kept of
+const maxTranscodeParams = 1024
+
+// transcodeKey identifies a rung of a source view as it was opened
+type transcodeKey struct {
+	path    string
+	modTime int64
+	size    int64
+	clip    string
+	quality string
+}
+
+func NewTranscoder(seg *Segmenter) *Transcoder {
+	return &Transcoder{segmenter: seg, params: make(map[transcodeKey][][]byte)}
+}
+
+// GetQualities returns ladder rungs no taller than the source
+func (t *Transcoder) GetQualities(vf *VideoFile) []models.Quality {
+	var qualities []models.Quality
+	for _, q := range models.DefaultQualities {
+		if uint32(q.Height) <= vf.Height {
+			qualities = append(qualities, q)
+		}
+	}
+	return qualities
+}
+
+// FindQuality returns rung by name if it is available for the video
+func (t *Transcoder) FindQuality(vf *VideoFile, name string) (models.Quality, bool) {
+	for _, q := range t.GetQualities(vf) {
+		if q.Name == name {
+			return q, true
+		}
+	}
+	return models.Quality{}, false
+}
+
+// ScaledWidth returns width of the rung keeping source aspect ratio
+func (t *Transcoder) ScaledWidth(vf *VideoFile, q models.Quality) uint32 {
+	if vf.Height == 0 {
+		return uint32(q.Width)
+	}
+	w := (uint64(vf.Width)*uint64(q.Height) + uint64(vf.Height)/2) / uint64(vf.Height)
+	return uint32(w+1) &^ 1
+}
+
+// Codec returns RFC 6381 codec string of the rung. Profile and level are
+// fixed in ffmpeg arguments so it is known before anything is encoded
+func (t *Transcoder) Codec(q models.Quality) string {
+	return fmt.Sprintf("avc1.6400%02x", h264Level(q.Height))
+}
+
+func h264Level(height int) int {
+	switch {
+	case height <= 480:
+		return 31
+	case height <= 720:
+		return 40
+	default:
+		return 42
+	}
+}
+
+// GenerateInitSegment returns the init segment of the rung. Its sample
+// description comes from the first segment encoded with the settings of
+// every other one, their parameter sets are checked against it
+func (t *Transcoder) GenerateInitSegment(vf *VideoFile, q models.Quality) ([]byte, error) {
+	out, err := t.transcode(vf, q, 0)
+	if err != nil {
+		return nil, err
+	}
+	if out.Init == nil || out.Init.Moov == nil || out.Init.Moov.Trak == nil {
+		return nil, fmt.Errorf("no moov in transcoded output")
+	}
+
+	trak := out.Init.Moov.Trak
+	sets, err := parameterSets(trak)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	if len(t.params) >= maxTranscodeParams {
+		clear(t.params)
+	}
+	t.params[newTranscodeKey(vf, q)] = sets
+	t.mu.Unlock()
+
+	trak.Mdia.Mdhd.Timescale = vf.Timescale
+	return t.segmenter.generateInitSegment(trak, vf.Timescale, videoBrands(extractVideoCodec(trak)))
+}
+
+func newTranscodeKey(vf *VideoFile, q models.Quality) transcodeKey {
+	key := transcodeKey{path: vf.Path, modTime: vf.ModTime.UnixNano(), size: vf.Size, quality: q.Name}
+	if vf.Clip != nil {
+		key.clip = vf.Clip.String()
+	}
+	return key
+}
+
+// checkParameterSets fails when the segment encoded in trak cannot be
+// decoded with the init segment of the rung
+func (t *Transcoder) checkParameterSets(vf *VideoFile, q models.Quality, segmentIndex int, trak *mp4.TrakBox) error {
+	sets, err := parameterSets(trak)
+	if err != nil {
+		return err
+	}
+	key := newTranscodeKey(vf, q)
+	t.mu.Lock()
+	want, ok := t.params[key]
+	t.mu.Unlock()
+	if !ok {
+		// Init segment was generated before a restart or forgotten since
+		if _, err := t.GenerateInitSegment(vf, q); err != nil {
+			return err
+		}
+		t.mu.Lock()
+		want = t.params[key]
+		t.mu.Unlock()
+	}
+	if !slices.EqualFunc(sets, want, bytes.Equal) {
+		return fmt.Errorf("transcoded segment %d has other parameter sets than the init segment", segmentIndex)
+	}
+	return nil
+}
+
+// parameterSets returns SPS and PPS of the H.264 sample description
+func parameterSets(trak *mp4.TrakBox) ([][]byte, error) {
+	stsd := trak.Mdia.Minf.Stbl.Stsd
+	if stsd == nil || stsd.AvcX == nil || stsd.AvcX.AvcC == nil {
+		return nil, fmt.Errorf("no avcC in transcoded output")
+	}
+	avcC := stsd.AvcX.AvcC
+	return slices.Concat(avcC.SPSnalus, avcC.PPSnalus), nil
+}
+
+func (t *Transcoder) GenerateMediaSegment(vf *VideoFile, q models.Quality, segmentIndex int) ([]byte, error) {
+	if segmentIndex < 0 || segmentIndex >= len(vf.Segments) {
+		return nil, fmt.Errorf("segment %d out of range", segmentIndex)
+	}
+	seg := vf.Segments[segmentIndex]
+
+	out, err := t.transcode(vf, q, segmentIndex)
+	if err != nil {
+		return nil, err
+	}
+	if out.Init == nil || out.Init.Moov == nil || out.Init.Moov.Trak == nil {
+		return nil, fmt.Errorf("no moov in transcoded output")
+	}
+	if err := t.checkParameterSets(vf, q, segmentIndex, out.Init.Moov.Trak); err != nil {
+		return nil, err
+	}
+
+	outTimescale := out.Init.Moov.Trak.Mdia.Mdhd.Timescale
+	var trex *mp4.TrexBox
+	if out.Init.Moov.Mvex != nil {
+		trex = out.Init.Moov.Mvex.Trex
+	}
+
+	var samples []mp4.Sample
+	var mdatData bytes.Buffer
+	for _, ms := range out.Segments {
+		for _, frag := range ms.Fragments {
+			fullSamples, err := frag.GetFullSamples(trex)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read transcoded samples: %w", err)
+			}
+			for _, fs := range fullSamples {
+				sample := fs.Sample
+				sample.Dur = uint32(rescaleTime(uint64(sample.Dur), outTimescale, vf.Timescale))
+				samples = append(samples, sample)
+				mdatData.Write(fs.Data)
+			}
+		}
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("no samples in transcoded segment %d", segmentIndex)
+	}
+
+	// Output has no B-frames, so every frame gets the composition offset of
+	// the source keyframe to keep presentation times of the original
+	cto := vf.VideoIndex.CTO(seg.StartSample)
+	for i := range samples {
+		samples[i].CompositionTimeOffset = cto
+	}
+	if err := fitDuration(samples, seg.Duration); err != nil {
+		return nil, fmt.Errorf("transcoded segment %d: %w", segmentIndex, err)
+	}
+
+	return t.segmenter.encodeMediaSegment(uint32(segmentIndex+1), seg.StartTime, samples, mdatData.Bytes())
+}
+
+// fitDuration makes samples last exactly duration, so the next segment
+// starts exactly where the source one does. The last frame is stretched, or
+// frames from the end are shortened to a tick each at least when the
+// encoder output runs over
+func fitDuration(samples []mp4.Sample, duration uint64) error {
+	var total uint64
+	for _, s := range samples {
+		total += uint64(s.Dur)
+	}
+	if total <= duration {
+		samples[len(samples)-1].Dur += uint32(duration - total)
+		return nil
+	}
+	excess := total - duration
+	for i := len(samples) - 1; i >= 0 && excess > 0; i-- {
+		if samples[i].Dur <= 1 {
+			continue
+		}
+		cut := min(excess, uint64(samples[i].Dur-1))
+		samples[i].Dur -= uint32(cut)
+		excess -= cut
+	}
+	if excess > 0 {
+		return fmt.Errorf("%d frames do not fit in %d ticks", len(samples), duration)
+	}
+	return nil
+}
+
+// transcode re-encodes remuxed source segment
+func (t *Transcoder) transcode(vf *VideoFile, q models.Quality, segmentIndex int) (*mp4.File, error) {
+	initData, err := t.segmenter.GenerateInitSegment(vf)
+	if err != nil {
+		return nil, err
+	}
+	mediaData, err := t.segmenter.GenerateMediaSegment(vf, segmentIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	seg := vf.Segments[segmentIndex]
+	gop := int(seg.EndSample - seg.StartSample)
+	if gop < 1 {
+		gop = 1
+	}
+
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-f", "mp4",
+		"-i", "pipe:0",
+		"-map", "0:v:0",
+		"-an", "-sn",
+		"-vf", fmt.Sprintf("scale=%d:%d", t.ScaledWidth(vf, q), q.Height),
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-profile:v", "high",
+		"-level:v", fmt.Sprintf("%d.%d", h264Level(q.Height)/10, h264Level(q.Height)%10),
+		"-pix_fmt", "yuv420p",
+		"-b:v", strconv.Itoa(q.Bitrate),
+		"-maxrate", strconv.Itoa(q.Bandwidth),
+		"-bufsize", strconv.Itoa(2 * q.Bitrate),
+		// One closed GOP without reordering per segment
+		"-bf", "0",
+		"-g", strconv.Itoa(gop),
+		"-sc_threshold", "0",
+		"-fps_mode", "passthrough",
+		"-video_track_timescale", strconv.FormatUint(uint64(vf.Timescale), 10),
+	}
+	args = append(args,
+		"-f", "mp4",
+		"-movflags", "empty_moov+default_base_moof+frag_keyframe",
+		"pipe:1",
+	)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stdin = bytes.NewReader(append(initData, mediaData...))
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	out, err := mp4.DecodeFile(bytes.NewReader(stdout.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse transcoded segment: %w", err)
+	}
+	return out, nil
+}
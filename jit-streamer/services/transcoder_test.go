@@ -0,0 +1,108 @@
+package services
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+
+	"amka.ru/jit-streamer/models"
+)
+
+func TestFitDuration(t *testing.T) {
+	durations := func(samples []mp4.Sample) []uint32 {
+		var durs []uint32
+		for _, s := range samples {
+			durs = append(durs, s.Dur)
+		}
+		return durs
+	}
+	for _, tc := range []struct {
+		name     string
+		durs     []uint32
+		duration uint64
+		want     []uint32 // nil when the frames do not fit
+	}{
+		{"exact", []uint32{10, 10, 10}, 30, []uint32{10, 10, 10}},
+		{"short", []uint32{10, 10, 10}, 35, []uint32{10, 10, 15}},
+		{"over by less than a frame", []uint32{10, 10, 10}, 25, []uint32{10, 10, 5}},
+		{"over by a frame", []uint32{10, 10, 10}, 20, []uint32{10, 9, 1}},
+		{"over by more", []uint32{10, 10, 10}, 12, []uint32{10, 1, 1}},
+		{"too many frames", []uint32{10, 10, 10}, 2, nil},
+	} {
+		samples := make([]mp4.Sample, len(tc.durs))
+		for i, d := range tc.durs {
+			samples[i].Dur = d
+		}
+		err := fitDuration(samples, tc.duration)
+		switch {
+		case tc.want == nil && err == nil:
+			t.Errorf("%s: fitted to %v, want an error", tc.name, durations(samples))
+		case tc.want != nil && (err != nil || !slices.Equal(durations(samples), tc.want)):
+			t.Errorf("%s: fitted to %v, %v, want %v", tc.name, durations(samples), err, tc.want)
+		}
+	}
+}
+
+// TestTranscodeSegments transcodes a few segments of a rung and checks they
+// continue each other on the source timeline and decode with the init
+// segment. Needs ffmpeg with libx264
+func TestTranscodeSegments(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not found")
+	}
+	src := filepath.Join(t.TempDir(), "movie.mp4")
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error",
+		"-f", "lavfi", "-i", "testsrc=size=320x180:rate=25:duration=4",
+		"-c:v", "libx264", "-g", "25", "-bf", "2", "-video_track_timescale", "12800",
+		src)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("ffmpeg cannot write the source: %v: %s", err, out)
+	}
+
+	s := NewSegmenter(1, 0, 0)
+	t.Cleanup(s.Close)
+	vf, err := s.OpenVideo(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vf.Segments) < 3 {
+		t.Fatalf("%d source segments, want 3 at least", len(vf.Segments))
+	}
+	tc := NewTranscoder(s)
+	q := models.Quality{Name: "144p", Width: 256, Height: 144, Bitrate: 200000, Bandwidth: 214000}
+
+	if _, err := tc.GenerateInitSegment(vf, q); err != nil {
+		t.Fatal(err)
+	}
+	next := vf.Segments[0].StartTime
+	for i, seg := range vf.Segments[:3] {
+		data, err := tc.GenerateMediaSegment(vf, q, i)
+		if err != nil {
+			t.Fatalf("segment %d: %v", i, err)
+		}
+		f, err := mp4.DecodeFile(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		frag := f.Segments[0].Fragments[0]
+		if tfdt := frag.Moof.Traf.Tfdt.BaseMediaDecodeTime(); tfdt != next {
+			t.Errorf("segment %d tfdt %d, want %d", i, tfdt, next)
+		}
+		samples, err := frag.GetFullSamples(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total uint64
+		for _, sample := range samples {
+			total += uint64(sample.Dur)
+		}
+		if total != seg.Duration {
+			t.Errorf("segment %d lasts %d, want %d", i, total, seg.Duration)
+		}
+		next += total
+	}
+}
@@ -0,0 +1,525 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/Eyevinn/mp4ff/aac"
+	"github.com/Eyevinn/mp4ff/avc"
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+const (
+	tsPacketSize = 188
+
+	tsPATPID   = 0x0000
+	tsPMTPID   = 0x1000
+	tsVideoPID = 0x0100
+	tsAudioPID = 0x0101
+
+	tsStreamTypeH264 = 0x1b
+	tsStreamTypeAAC  = 0x0f
+
+	tsStreamIDVideo = 0xe0
+	tsStreamIDAudio = 0xc0
+
+	// Timestamps are shifted so that PCR can run ahead of the first DTS,
+	// same values as ffmpeg uses by default
+	tsTimestampOffset = 126000
+	tsPCRDelay        = 63000
+
+	// AAC frames are grouped into PES packets to reduce overhead
+	tsAudioFramesPerPES = 8
+
+	// ADTS header without CRC
+	aacADTSHeaderSize = 7
+)
+
+// GenerateTSSegment returns MPEG-TS segment with the same timing as the fMP4
+// segment with the same index. AVC video is converted to Annex-B and AAC
+// audio, when present, is muxed in as ADTS
+func (s *Segmenter) GenerateTSSegment(vf *VideoFile, segmentIndex int) ([]byte, error) {
+	if vf.VideoTrack == nil {
+		return nil, fmt.Errorf("no video track")
+	}
+	if segmentIndex < 0 || segmentIndex >= len(vf.Segments) {
+		return nil, fmt.Errorf("segment %d out of range", segmentIndex)
+	}
+
+	stsd := vf.VideoTrack.Mdia.Minf.Stbl.Stsd
+	if stsd == nil || stsd.AvcX == nil || stsd.AvcX.AvcC == nil {
+		return nil, fmt.Errorf("MPEG-TS output supports AVC video only")
+	}
+	avcC := stsd.AvcX.AvcC
+
+	var units []tsPESUnit
+
+	seg := vf.Segments[segmentIndex]
+	samples, data, err := s.readSamples(vf, vf.VideoIndex, seg.StartSample, seg.EndSample)
+	if err != nil {
+		return nil, err
+	}
+	// Composition offsets carry the edit list shift, which moves decode
+	// times too so PTS never falls below DTS
+	decodeTime := seg.StartTime
+	shift := int64(vf.VideoIndex.CTOShift)
+	var offset uint32
+	for _, sample := range samples {
+		sampleData := data[offset : offset+sample.Size]
+		offset += sample.Size
+
+		dts := toTSTime(int64(decodeTime)+shift, vf.Timescale)
+		pts := toTSTime(int64(decodeTime)+int64(sample.CompositionTimeOffset), vf.Timescale)
+		decodeTime += uint64(sample.Dur)
+
+		payload, err := avcToAnnexB(sampleData, avcC, sample.IsSync())
+		if err != nil {
+			return nil, err
+		}
+		units = append(units, tsPESUnit{
+			pid:       tsVideoPID,
+			streamID:  tsStreamIDVideo,
+			pts:       pts,
+			dts:       dts,
+			keyframe:  sample.IsSync(),
+			payload:   payload,
+			withPCR:   true,
+			unbounded: true,
+		})
+	}
+
+	padVideoPES(units)
+
+	asc := audioSpecificConfig(vf)
+	hasAudio := asc != nil && segmentIndex < len(vf.AudioSegments)
+	if hasAudio {
+		audioUnits, err := s.audioPESUnits(vf, vf.AudioSegments[segmentIndex], asc)
+		if err != nil {
+			return nil, err
+		}
+		units = append(units, audioUnits...)
+	}
+
+	// Interleave streams by decode time
+	sort.SliceStable(units, func(i, j int) bool { return units[i].dts < units[j].dts })
+
+	// Continuity counters run on across segments, which are generated
+	// independently. PAT and PMT take one packet per segment, video is
+	// padded to whole cycles of 16 packets and audio packets of earlier
+	// segments are counted from frame sizes
+	mux := newTSMuxer()
+	mux.cc[tsPATPID] = byte(segmentIndex) & 0x0f
+	mux.cc[tsPMTPID] = byte(segmentIndex) & 0x0f
+	if hasAudio {
+		mux.cc[tsAudioPID] = tsAudioContinuity(vf, segmentIndex)
+	}
+	mux.writePAT()
+	mux.writePMT(hasAudio)
+	for _, u := range units {
+		mux.writePES(u)
+	}
+	return mux.buf.Bytes(), nil
+}
+
+func (s *Segmenter) audioPESUnits(vf *VideoFile, seg Segment, asc *aac.AudioSpecificConfig) ([]tsPESUnit, error) {
+	samples, data, err := s.readSamples(vf, vf.AudioIndex, seg.StartSample, seg.EndSample)
+	if err != nil {
+		return nil, err
+	}
+
+	// HE-AAC is signalled implicitly, ADTS header carries the AAC-LC core
+	var units []tsPESUnit
+	var payload bytes.Buffer
+	var pts, dts int64 // of the first frame in PES
+	var frames int
+	decodeTime := seg.StartTime
+	shift := int64(vf.AudioIndex.CTOShift)
+	var offset uint32
+	for i, sample := range samples {
+		if frames == 0 {
+			pts = int64(decodeTime) + int64(sample.CompositionTimeOffset)
+			dts = int64(decodeTime) + shift
+		}
+		hdr, err := aac.NewADTSHeader(asc.SamplingFrequency, asc.ChannelConfiguration, aac.AAClc, uint16(sample.Size))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ADTS header: %w", err)
+		}
+		payload.Write(hdr.Encode())
+		payload.Write(data[offset : offset+sample.Size])
+		offset += sample.Size
+		decodeTime += uint64(sample.Dur)
+		frames++
+
+		if frames == tsAudioFramesPerPES || i == len(samples)-1 {
+			units = append(units, tsPESUnit{
+				pid:      tsAudioPID,
+				streamID: tsStreamIDAudio,
+				pts:      toTSTime(pts, vf.AudioTimescale),
+				dts:      toTSTime(dts, vf.AudioTimescale),
+				payload:  append([]byte(nil), payload.Bytes()...),
+			})
+			payload.Reset()
+			frames = 0
+		}
+	}
+	return units, nil
+}
+
+// padVideoPES appends zero bytes to the last video access unit so video
+// takes a multiple of 16 packets. In the Annex-B byte stream they are
+// trailing_zero_8bits, which decoders skip
+func padVideoPES(units []tsPESUnit) {
+	if len(units) == 0 {
+		return
+	}
+	var packets int
+	for _, u := range units {
+		packets += u.packets()
+	}
+	missing := (16 - packets%16) % 16
+	if missing == 0 {
+		return
+	}
+	last := &units[len(units)-1]
+	n := len(last.header()) + len(last.payload)
+	capacity := tsPayloadCapacity(last.packets()+missing, len(last.adaptationField()))
+	last.payload = append(last.payload, make([]byte, capacity-n)...)
+}
+
+// tsAudioContinuity returns continuity counter of the first audio packet of
+// segment segmentIndex. PES packets group frames like audioPESUnits does
+// and take as many packets as their size needs, so earlier segments are
+// counted without reading sample data
+func tsAudioContinuity(vf *VideoFile, segmentIndex int) byte {
+	idx := vf.AudioIndex
+	var packets int
+	for _, seg := range vf.AudioSegments[:segmentIndex] {
+		for start := seg.StartSample; start < seg.EndSample; start += tsAudioFramesPerPES {
+			end := min(start+tsAudioFramesPerPES, seg.EndSample)
+			withDTS := idx.CTO(start) != idx.CTOShift
+			n := tsPESHeaderSize(withDTS) + int(idx.Size(start, end)) + aacADTSHeaderSize*int(end-start)
+			packets += tsPackets(n, 0)
+		}
+	}
+	return byte(packets) & 0x0f
+}
+
+// audioSpecificConfig returns AAC config of the audio track or nil if there
+// is no AAC audio to mux
+func audioSpecificConfig(vf *VideoFile) *aac.AudioSpecificConfig {
+	if vf.AudioTrack == nil || vf.AudioTrack.Mdia.Minf == nil || vf.AudioTrack.Mdia.Minf.Stbl == nil {
+		return nil
+	}
+	stsd := vf.AudioTrack.Mdia.Minf.Stbl.Stsd
+	if stsd == nil || stsd.Mp4a == nil || stsd.Mp4a.Esds == nil {
+		return nil
+	}
+	dcd := stsd.Mp4a.Esds.DecConfigDescriptor
+	if dcd == nil || dcd.DecSpecificInfo == nil {
+		return nil
+	}
+	asc, err := aac.DecodeAudioSpecificConfig(bytes.NewReader(dcd.DecSpecificInfo.DecConfig))
+	if err != nil {
+		return nil
+	}
+	return asc
+}
+
+// avcToAnnexB replaces 4-byte NALU lengths with start codes, prepends an
+// access unit delimiter and inserts SPS/PPS in front of keyframes
+func avcToAnnexB(sample []byte, avcC *mp4.AvcCBox, keyframe bool) ([]byte, error) {
+	startCode := []byte{0, 0, 0, 1}
+
+	var out bytes.Buffer
+	out.Write(startCode)
+	out.Write([]byte{0x09, 0xf0}) // AUD, any primary picture type
+
+	if keyframe && !avc.HasParameterSets(sample) {
+		for _, sps := range avcC.SPSnalus {
+			out.Write(startCode)
+			out.Write(sps)
+		}
+		for _, pps := range avcC.PPSnalus {
+			out.Write(startCode)
+			out.Write(pps)
+		}
+	}
+
+	for pos := 0; pos < len(sample); {
+		if pos+4 > len(sample) {
+			return nil, fmt.Errorf("truncated NALU length")
+		}
+		naluLen := int(binary.BigEndian.Uint32(sample[pos : pos+4]))
+		pos += 4
+		if naluLen == 0 || pos+naluLen > len(sample) {
+			return nil, fmt.Errorf("invalid NALU length %d", naluLen)
+		}
+		nalu := sample[pos : pos+naluLen]
+		pos += naluLen
+
+		if avc.GetNaluType(nalu[0]) == avc.NALU_AUD {
+			continue
+		}
+		out.Write(startCode)
+		out.Write(nalu)
+	}
+	return out.Bytes(), nil
+}
+
+// toTSTime converts track time to the 90 kHz MPEG-TS clock. Times slightly
+// below zero, left by edit list shifts, are covered by the timestamp offset
+func toTSTime(t int64, timescale uint32) int64 {
+	if timescale == 0 {
+		return t + tsTimestampOffset
+	}
+	return t*90000/int64(timescale) + tsTimestampOffset
+}
+
+// tsPESUnit is one access unit (or group of audio frames) to packetize
+type tsPESUnit struct {
+	pid       uint16
+	streamID  byte
+	pts, dts  int64
+	keyframe  bool
+	payload   []byte
+	withPCR   bool
+	unbounded bool // PES_packet_length 0, allowed for video only
+}
+
+// tsMuxer writes MPEG-TS packets keeping continuity counter per PID
+type tsMuxer struct {
+	buf bytes.Buffer
+	cc  map[uint16]byte
+}
+
+func newTSMuxer() *tsMuxer {
+	return &tsMuxer{cc: make(map[uint16]byte)}
+}
+
+func (m *tsMuxer) writePAT() {
+	section := []byte{
+		0x00,       // table_id
+		0xb0, 0x00, // section_syntax_indicator, section_length (set below)
+		0x00, 0x01, // transport_stream_id
+		0xc1,       // version 0, current_next_indicator
+		0x00, 0x00, // section_number, last_section_number
+		0x00, 0x01, // program_number
+		0xe0 | byte(tsPMTPID>>8), byte(tsPMTPID & 0xff),
+	}
+	m.writePSI(tsPATPID, section)
+}
+
+func (m *tsMuxer) writePMT(hasAudio bool) {
+	section := []byte{
+		0x02,       // table_id
+		0xb0, 0x00, // section_syntax_indicator, section_length (set below)
+		0x00, 0x01, // program_number
+		0xc1,       // version 0, current_next_indicator
+		0x00, 0x00, // section_number, last_section_number
+		0xe0 | byte(tsVideoPID>>8), byte(tsVideoPID & 0xff), // PCR_PID
+		0xf0, 0x00, // program_info_length
+		tsStreamTypeH264, 0xe0 | byte(tsVideoPID>>8), byte(tsVideoPID & 0xff), 0xf0, 0x00,
+	}
+	if hasAudio {
+		section = append(section, tsStreamTypeAAC, 0xe0|byte(tsAudioPID>>8), byte(tsAudioPID&0xff), 0xf0, 0x00)
+	}
+	m.writePSI(tsPMTPID, section)
+}
+
+// writePSI completes section length and CRC and writes it in one packet
+func (m *tsMuxer) writePSI(pid uint16, section []byte) {
+	sectionLength := len(section) - 3 + 4 // bytes after section_length, CRC included
+	section[1] |= byte(sectionLength>>8) & 0x0f
+	section[2] = byte(sectionLength)
+	section = binary.BigEndian.AppendUint32(section, crc32MPEG2(section))
+
+	pkt := m.packetHeader(pid, true, false)
+	pkt = append(pkt, 0x00) // pointer_field
+	pkt = append(pkt, section...)
+	for len(pkt) < tsPacketSize {
+		pkt = append(pkt, 0xff)
+	}
+	m.buf.Write(pkt)
+}
+
+// header returns PES header of the unit
+func (u *tsPESUnit) header() []byte {
+	header := []byte{0x00, 0x00, 0x01, u.streamID, 0x00, 0x00, 0x80}
+	if u.pts != u.dts {
+		header = append(header, 0xc0, 10)
+		header = append(header, encodeTSTimestamp(0x3, u.pts)...)
+		header = append(header, encodeTSTimestamp(0x1, u.dts)...)
+	} else {
+		header = append(header, 0x80, 5)
+		header = append(header, encodeTSTimestamp(0x2, u.pts)...)
+	}
+	if pesLength := len(header) - 6 + len(u.payload); !u.unbounded && pesLength <= 0xffff {
+		binary.BigEndian.PutUint16(header[4:6], uint16(pesLength))
+	}
+	return header
+}
+
+// adaptationField returns adaptation field of the first packet of the unit
+// without its length byte, nil when there is none
+func (u *tsPESUnit) adaptationField() []byte {
+	var flags byte
+	if u.keyframe {
+		flags |= 0x40 // random_access_indicator
+	}
+	if u.withPCR {
+		flags |= 0x10
+	}
+	if flags == 0 {
+		return nil
+	}
+	af := []byte{flags}
+	if u.withPCR {
+		af = append(af, encodePCR(u.dts-tsPCRDelay)...)
+	}
+	return af
+}
+
+// packets returns number of TS packets writePES writes for the unit
+func (u *tsPESUnit) packets() int {
+	return tsPackets(len(u.header())+len(u.payload), len(u.adaptationField()))
+}
+
+// tsPESHeaderSize returns size of a PES header with PTS and, when
+// withDTS, DTS
+func tsPESHeaderSize(withDTS bool) int {
+	if withDTS {
+		return 19
+	}
+	return 14
+}
+
+// tsPackets returns number of packets carrying n bytes of PES when the
+// first packet has an adaptation field of afLen bytes besides its length
+func tsPackets(n, afLen int) int {
+	first := tsPayloadCapacity(1, afLen)
+	if n <= first {
+		return 1
+	}
+	return 1 + (n-first+tsPacketSize-5)/(tsPacketSize-4)
+}
+
+// tsPayloadCapacity returns PES bytes carried by the given number of packets
+func tsPayloadCapacity(packets, afLen int) int {
+	capacity := packets * (tsPacketSize - 4)
+	if afLen > 0 {
+		capacity -= 1 + afLen
+	}
+	return capacity
+}
+
+func (m *tsMuxer) writePES(u tsPESUnit) {
+	payload := append(u.header(), u.payload...)
+	first := true
+	for len(payload) > 0 {
+		var af []byte
+		if first {
+			af = u.adaptationField()
+		}
+
+		n := m.writePayloadPacket(u.pid, first, af, payload)
+		payload = payload[n:]
+		first = false
+	}
+}
+
+// writePayloadPacket writes one packet with optional adaptation field and
+// returns number of payload bytes consumed. Short payload is padded with
+// adaptation field stuffing
+func (m *tsMuxer) writePayloadPacket(pid uint16, pusi bool, af []byte, payload []byte) int {
+	hasAF := len(af) > 0
+	space := tsPacketSize - 4
+	if hasAF {
+		space -= 1 + len(af)
+	}
+	n := len(payload)
+	if n > space {
+		n = space
+	}
+	if pad := space - n; pad > 0 {
+		if !hasAF {
+			hasAF = true
+			pad-- // adaptation_field_length byte
+			if pad > 0 {
+				af = append(af, 0x00) // no flags
+				pad--
+			}
+		}
+		for ; pad > 0; pad-- {
+			af = append(af, 0xff)
+		}
+	}
+
+	pkt := m.packetHeader(pid, pusi, hasAF)
+	if hasAF {
+		pkt = append(pkt, byte(len(af)))
+		pkt = append(pkt, af...)
+	}
+	pkt = append(pkt, payload[:n]...)
+	m.buf.Write(pkt)
+	return n
+}
+
+func (m *tsMuxer) packetHeader(pid uint16, pusi bool, hasAF bool) []byte {
+	pkt := make([]byte, 4, tsPacketSize)
+	pkt[0] = 0x47
+	pkt[1] = byte(pid>>8) & 0x1f
+	if pusi {
+		pkt[1] |= 0x40
+	}
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | m.cc[pid] // payload present
+	if hasAF {
+		pkt[3] |= 0x20
+	}
+	m.cc[pid] = (m.cc[pid] + 1) & 0x0f
+	return pkt
+}
+
+func encodeTSTimestamp(prefix byte, ts int64) []byte {
+	ts &= 0x1ffffffff
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0e | 1,
+		byte(ts >> 22),
+		byte(ts>>14)&0xfe | 1,
+		byte(ts >> 7),
+		byte(ts<<1)&0xfe | 1,
+	}
+}
+
+func encodePCR(base int64) []byte {
+	if base < 0 {
+		base = 0
+	}
+	base &= 0x1ffffffff
+	return []byte{
+		byte(base >> 25),
+		byte(base >> 17),
+		byte(base >> 9),
+		byte(base >> 1),
+		byte(base<<7) | 0x7e, // reserved bits, extension high bit 0
+		0x00,
+	}
+}
+
+// crc32MPEG2 is CRC-32/MPEG-2 used by PSI sections
+func crc32MPEG2(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
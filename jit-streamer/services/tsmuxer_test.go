@@ -0,0 +1,175 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// tsTestPES is a PES packet parsed back from generated MPEG-TS
+type tsTestPES struct {
+	pid      uint16
+	pts, dts int64 // dts equals pts when the header has no DTS
+	data     []byte
+}
+
+// parseTS checks packet structure of MPEG-TS: 188-byte packets, PSI CRCs,
+// PES start codes and lengths, and continuity counters running on over the
+// whole input, which may span consecutive segments
+func parseTS(t *testing.T, data []byte) []tsTestPES {
+	t.Helper()
+	if len(data)%tsPacketSize != 0 {
+		t.Fatalf("%d bytes is not a whole number of packets", len(data))
+	}
+
+	cc := make(map[uint16]byte)
+	open := make(map[uint16]*tsTestPES)
+	var pes []tsTestPES
+	flush := func(pid uint16) {
+		p := open[pid]
+		if p == nil {
+			return
+		}
+		if length := int(binary.BigEndian.Uint16(p.data[4:6])); length != 0 && length != len(p.data)-6 {
+			t.Errorf("PID %#x: PES_packet_length %d, carried %d bytes", pid, length, len(p.data)-6)
+		}
+		pes = append(pes, *p)
+		delete(open, pid)
+	}
+
+	for n := 0; n < len(data); n += tsPacketSize {
+		pkt := data[n : n+tsPacketSize]
+		if pkt[0] != 0x47 {
+			t.Fatalf("packet %d: sync byte %#x", n/tsPacketSize, pkt[0])
+		}
+		pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+		pusi := pkt[1]&0x40 != 0
+		afc := pkt[3] >> 4 & 0x3
+		payload := pkt[4:]
+		if afc&0x2 != 0 {
+			payload = payload[1+int(payload[0]):]
+		}
+		if afc&0x1 == 0 {
+			continue
+		}
+
+		if want, ok := cc[pid]; ok && pkt[3]&0x0f != want {
+			t.Errorf("packet %d: PID %#x continuity counter %d, want %d", n/tsPacketSize, pid, pkt[3]&0x0f, want)
+		}
+		cc[pid] = (pkt[3] + 1) & 0x0f
+
+		switch pid {
+		case tsPATPID, tsPMTPID:
+			section := payload[1+int(payload[0]):]
+			length := 3 + int(binary.BigEndian.Uint16(section[1:3])&0x0fff)
+			if crc32MPEG2(section[:length]) != 0 {
+				t.Errorf("packet %d: PSI section of PID %#x fails CRC", n/tsPacketSize, pid)
+			}
+		default:
+			if pusi {
+				flush(pid)
+				if !bytes.HasPrefix(payload, []byte{0, 0, 1}) {
+					t.Fatalf("packet %d: PES of PID %#x without start code", n/tsPacketSize, pid)
+				}
+				p := &tsTestPES{pid: pid}
+				flags := payload[7] >> 6
+				p.pts = decodeTestTimestamp(payload[9:14])
+				p.dts = p.pts
+				if flags == 0x3 {
+					p.dts = decodeTestTimestamp(payload[14:19])
+				}
+				open[pid] = p
+			}
+			if open[pid] == nil {
+				t.Fatalf("packet %d: PES continuation of PID %#x without start", n/tsPacketSize, pid)
+			}
+			open[pid].data = append(open[pid].data, payload...)
+		}
+	}
+	for pid := range open {
+		flush(pid)
+	}
+	return pes
+}
+
+func decodeTestTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// TestTSSegmentPackets parses every segment of several sources back and
+// checks that continuity counters run on from segment to segment
+func TestTSSegmentPackets(t *testing.T) {
+	bframes := fixtureVideo()
+	bframes.cto = make([]int32, bframes.sampleCount)
+	for i := range bframes.cto {
+		bframes.cto[i] = int32(i%3) * 512
+	}
+
+	for _, tc := range []struct {
+		name   string
+		tracks []fixtureTrack
+	}{
+		{"video", []fixtureTrack{fixtureVideo()}},
+		{"video and audio", []fixtureTrack{fixtureVideo(), fixtureAudio()}},
+		{"b-frames and audio", []fixtureTrack{bframes, fixtureAudio()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, vf := openFixture(t, tc.tracks...)
+			var stream []byte
+			for i := range vf.Segments {
+				data, err := s.GenerateTSSegment(vf, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stream = append(stream, data...)
+			}
+
+			counts := make(map[uint16]int)
+			for _, p := range parseTS(t, stream) {
+				counts[p.pid]++
+			}
+			if counts[tsVideoPID] != vf.VideoIndex.SampleCount() {
+				t.Errorf("%d video PES, want %d", counts[tsVideoPID], vf.VideoIndex.SampleCount())
+			}
+			if len(tc.tracks) > 1 && counts[tsAudioPID] == 0 {
+				t.Error("no audio PES")
+			}
+		})
+	}
+}
+
+// TestTSEditListTimestamps checks that edit list shifts, which make
+// composition offsets of B-frame video and primed audio negative, keep PTS
+// at or after DTS
+func TestTSEditListTimestamps(t *testing.T) {
+	video := fixtureVideo()
+	video.cto = make([]int32, video.sampleCount)
+	for i := range video.cto {
+		switch i % video.keyframeEvery % 4 {
+		case 0:
+			video.cto[i] = 1024
+		case 1:
+			video.cto[i] = 2048
+		}
+	}
+	video.edits = []mp4.ElstEntry{{SegmentDuration: 6 * fixtureMovieTimescale, MediaTime: 1024, MediaRateInteger: 1}}
+	audio := fixtureAudio()
+	audio.edits = []mp4.ElstEntry{{SegmentDuration: 6 * fixtureMovieTimescale, MediaTime: 2112, MediaRateInteger: 1}}
+	s, vf := openFixture(t, video, audio)
+
+	var stream []byte
+	for i := range vf.Segments {
+		data, err := s.GenerateTSSegment(vf, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, data...)
+	}
+	for i, p := range parseTS(t, stream) {
+		if p.pts < p.dts {
+			t.Errorf("PES %d of PID %#x: PTS %d before DTS %d", i, p.pid, p.pts, p.dts)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -18,6 +20,19 @@ type VideoService struct {
 	cfg *config.Config
 }
 
+// Rendition is a pre-encoded sibling of a video, e.g. movie_720p.mp4 for movie
+type Rendition struct {
+	Name   string // quality suffix, e.g. 720p
+	Height int
+	Path   string
+}
+
+// Subtitle is a sidecar subtitle file of a video, e.g. movie.en.srt for movie
+type Subtitle struct {
+	Language string // BCP 47 tag from the file name, "und" when it has none
+	Path     string
+}
+
 func NewVideoService(cfg *config.Config) *VideoService {
 	return &VideoService{cfg: cfg}
 }
@@ -29,6 +44,7 @@ func (s *VideoService) ListVideos() ([]models.VideoInfo, error) {
 	}
 
 	var videos []models.VideoInfo
+	listed := make(map[string]bool)
 	for _, entry := range entries {
 		if entry.IsDir() {
 			continue
@@ -38,13 +54,27 @@ func (s *VideoService) ListVideos() ([]models.VideoInfo, error) {
 			continue
 		}
 
-		videoPath := filepath.Join(s.cfg.VideosPath, entry.Name())
+		// Group of renditions is listed once under its base name
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		if base, _, ok := splitRenditionName(name); ok {
+			name = base
+		}
+		if listed[name] {
+			continue
+		}
+
+		videoPath, err := s.GetVideoPath(name)
+		if err != nil {
+			continue
+		}
 		info, err := s.GetVideoInfo(videoPath)
 		if err != nil {
 			continue
 		}
-		info.Name = strings.TrimSuffix(entry.Name(), ext)
+		info.Name = name
+		info.Subtitles = s.SubtitleLanguages(name)
 		videos = append(videos, *info)
+		listed[name] = true
 	}
 	return videos, nil
 }
@@ -125,5 +155,126 @@ func (s *VideoService) GetVideoPath(name string) (string, error) {
 			return filepath.Join(s.cfg.VideosPath, entry.Name()), nil
 		}
 	}
+
+	// No file with exact name - the tallest rendition stands for the group
+	renditions, err := s.GetRenditions(name)
+	if err != nil {
+		return "", err
+	}
+	if len(renditions) > 0 {
+		return renditions[len(renditions)-1].Path, nil
+	}
 	return "", fmt.Errorf("video not found: %s", name)
 }
+
+// GetRenditions returns pre-encoded siblings named <name>_<height>p.<ext>
+// sorted by height
+func (s *VideoService) GetRenditions(name string) ([]Rendition, error) {
+	entries, err := os.ReadDir(s.cfg.VideosPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read videos directory: %w", err)
+	}
+
+	var renditions []Rendition
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		baseName := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		base, height, ok := splitRenditionName(baseName)
+		if !ok || base != name {
+			continue
+		}
+		renditions = append(renditions, Rendition{
+			Name:   baseName[len(base)+1:],
+			Height: height,
+			Path:   filepath.Join(s.cfg.VideosPath, entry.Name()),
+		})
+	}
+
+	sort.Slice(renditions, func(i, j int) bool { return renditions[i].Height < renditions[j].Height })
+	return renditions, nil
+}
+
+// splitRenditionName splits "movie_720p" into "movie" and 720
+func splitRenditionName(baseName string) (string, int, bool) {
+	idx := strings.LastIndex(baseName, "_")
+	if idx <= 0 {
+		return "", 0, false
+	}
+	suffix := baseName[idx+1:]
+	if !strings.HasSuffix(suffix, "p") {
+		return "", 0, false
+	}
+	height, err := strconv.Atoi(strings.TrimSuffix(suffix, "p"))
+	if err != nil || height <= 0 {
+		return "", 0, false
+	}
+	return baseName[:idx], height, true
+}
+
+// GetSubtitles returns sidecar subtitles named <name>.<lang>.srt or
+// <name>.<lang>.vtt sorted by language. WebVTT wins over SRT of the same
+// language
+func (s *VideoService) GetSubtitles(name string) ([]Subtitle, error) {
+	entries, err := os.ReadDir(s.cfg.VideosPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read videos directory: %w", err)
+	}
+
+	byLanguage := make(map[string]Subtitle)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), name+".") {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if ext != ".srt" && ext != ".vtt" {
+			continue
+		}
+		lang := strings.TrimSuffix(strings.TrimPrefix(entry.Name(), name), filepath.Ext(entry.Name()))
+		if lang == "" {
+			lang = "und"
+		} else if lang = lang[1:]; !languageTag.MatchString(lang) {
+			continue
+		}
+		if prev, ok := byLanguage[lang]; ok && strings.EqualFold(filepath.Ext(prev.Path), ".vtt") {
+			continue
+		}
+		byLanguage[lang] = Subtitle{Language: lang, Path: filepath.Join(s.cfg.VideosPath, entry.Name())}
+	}
+
+	subtitles := make([]Subtitle, 0, len(byLanguage))
+	for _, sub := range byLanguage {
+		subtitles = append(subtitles, sub)
+	}
+	sort.Slice(subtitles, func(i, j int) bool { return subtitles[i].Language < subtitles[j].Language })
+	return subtitles, nil
+}
+
+// GetSubtitle returns sidecar subtitles of the video in the language
+func (s *VideoService) GetSubtitle(name, lang string) (*Subtitle, error) {
+	subtitles, err := s.GetSubtitles(name)
+	if err != nil {
+		return nil, err
+	}
+	for i := range subtitles {
+		if subtitles[i].Language == lang {
+			return &subtitles[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no %s subtitles for %s", lang, name)
+}
+
+// SubtitleLanguages returns languages of sidecar subtitles of the video
+func (s *VideoService) SubtitleLanguages(name string) []string {
+	subtitles, _ := s.GetSubtitles(name)
+	var languages []string
+	for _, sub := range subtitles {
+		languages = append(languages, sub.Language)
+	}
+	return languages
+}
+
+// languageTag matches language tags like en, eng or pt-BR. Underscores are
+// left out as they separate the language in segment names
+var languageTag = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)